@@ -0,0 +1,534 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"nds/dns"
+	"nds/gateway"
+	"nds/mdns"
+	"nds/peer"
+	"nds/util"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//errUsage is returned once a command line not understood has been told to the user
+var errUsage = errors.New("bad usage")
+
+//configPath is the config file given by --config
+var configPath string
+
+//option is an option of a command: it is given as --<long> or, if it has one, as -<short>;
+//--<long>=<arg> is accepted as well.
+type option struct {
+	long, short string
+	arg         string //the name of the argument in the help, empty for a switch
+	usage       string
+	files       bool     //shell completion: the argument is a file name
+	words       []string //shell completion: the values the argument can take
+	register    func(fs *flag.FlagSet, name string)
+}
+
+func switchOption(p *bool, long, short, usage string) option {
+	return option{long: long, short: short, usage: usage, register: func(fs *flag.FlagSet, name string) {
+		fs.BoolVar(p, name, false, usage)
+	}}
+}
+
+func stringOption(p *string, long, short, arg, def, usage string) option {
+	return option{long: long, short: short, arg: arg, usage: usage, register: func(fs *flag.FlagSet, name string) {
+		fs.StringVar(p, name, def, usage)
+	}}
+}
+
+func uintOption(p *uint, long, short, arg string, def uint, usage string) option {
+	return option{long: long, short: short, arg: arg, usage: usage, register: func(fs *flag.FlagSet, name string) {
+		fs.UintVar(p, name, def, usage)
+	}}
+}
+
+func durationOption(p *time.Duration, long, short, arg string, def time.Duration, usage string) option {
+	return option{long: long, short: short, arg: arg, usage: usage, register: func(fs *flag.FlagSet, name string) {
+		fs.DurationVar(p, name, def, usage)
+	}}
+}
+
+func (o option) withFiles() option {
+	o.files = true
+	return o
+}
+
+func (o option) withWords(words ...string) option {
+	o.words = words
+	return o
+}
+
+//synopsis returns the option as shown by the help, e.g. "-p, --port <port>"
+func (o option) synopsis() string {
+	s := "    --" + o.long
+	if o.short != "" {
+		s = "-" + o.short + ", --" + o.long
+	}
+	if o.arg != "" {
+		s += " <" + o.arg + ">"
+	}
+	return s
+}
+
+//command is a subcommand of nds, e.g. nds set <value>
+type command struct {
+	name     string
+	operands string //the operands as shown by the help, e.g. "<value>"
+	minArgs  int
+	maxArgs  int
+	words    []string //shell completion: the values the operands can take
+	summary  string
+	options  []option
+	run      func(operands []string) error
+}
+
+//commands returns the subcommands of nds, binding their options to c and, for the config file, to path
+func commands(c *util.Config, path *string) []command {
+	levels := []string{util.OffStr, util.TraceStr, util.InfoStr, util.WarnStr, util.ErrStr, util.CriticalStr}
+	common := []option{
+		stringOption(path, configOption, "c", "file", "", "read the settings not given on the command line from the specified YAML file").withFiles(),
+		stringOption(&c.MulticastAddress, "join", "j", "address", util.DefaultMulticastAddress, "join the cluster at the specified multicast group"),
+		uintOption(&c.MulticastPort, "join-port", "", "port", util.DefaultMulticastPort, "the UDP port of the multicast group"),
+		uintOption(&c.ListeningPort, "port", "p", "port", 31582, "listen on the specified TCP port"),
+		stringOption(&c.LogType, "log", "l", "file", "console", "log into the specified file instead of the console").withFiles(),
+		stringOption(&c.LogLevel, "verbosity", "v", "level", util.InfoStr, "logging verbosity: off, trace, info, warn, err, critical").withWords(levels...),
+		stringOption(&c.LogFormat, "log-format", "", "format", util.LogFormatText, "logging format: text, json, logfmt").withWords(util.LogFormatText, util.LogFormatJSON, util.LogFormatLogfmt),
+		stringOption(&c.AuthKeyFile, "auth-key", "", "file", "", "sign and verify every frame with the cluster keys in the specified file, one per line").withFiles(),
+		switchOption(&c.EncryptMulticast, "encrypt-multicast", "", "encrypt the alive messages sent with the cluster key of --auth-key, instead of just signing them"),
+		durationOption(&c.AuthMaxSkew, "auth-max-skew", "", "duration", util.AuthReplayWindow, "how far apart the clocks of the nodes can be: the signed frames sent longer ago, or later, are refused"),
+		stringOption(&c.TLSCertFile, "tls-cert", "", "file", "", "secure the TCP connections with TLS, presenting the specified PEM certificate").withFiles(),
+		stringOption(&c.TLSKeyFile, "tls-key", "", "file", "", "the PEM private key of --tls-cert").withFiles(),
+		stringOption(&c.TLSCAFile, "tls-ca", "", "file", "", "the PEM CA the certificates of the nodes connected must chain to, instead of the system roots").withFiles(),
+		stringOption(&c.Token, "token", "", "token", "", "present the specified bearer token with the requests, checked against the ACL of the cluster"),
+	}
+	with := func(options ...option) []option {
+		return append(append([]option{}, common...), options...)
+	}
+	var certDir, certHosts string
+	var certValid time.Duration
+
+	cmds := []command{
+		{
+			name:    "daemon",
+			summary: "run a daemon node, keeping the value for the cluster until interrupted",
+			options: with(
+				switchOption(&c.LogShared, "log-shared", "", "all the components log into the file, instead of <component>.<file>"),
+				uintOption(&c.LogMaxSize, "log-max-size", "", "MB", 0, "rotate a log file once it would grow beyond the specified megabytes"),
+				durationOption(&c.LogMaxAge, "log-max-age", "", "duration", 0, "rotate a log file once written for the specified duration (e.g. 24h)"),
+				uintOption(&c.LogMaxBackups, "log-max-backups", "", "n", 0, "number of rotated log files retained, 0 retains all"),
+				switchOption(&c.LogCompress, "log-compress", "", "gzip the rotated log files"),
+				stringOption(&c.Val, "set", "s", "value", "", "set the value shared across the cluster once joined"),
+				durationOption(&c.TTL, "ttl", "", "duration", 0, "the value set expires after the specified duration"),
+				uintOption(&c.HistorySize, "history-size", "", "n", peer.DefaultHistorySize, "number of values retained"),
+				durationOption(&c.TombstoneGrace, "tombstone-grace", "", "duration", peer.DefaultTombstoneGrace, "time a deleted value is retained before being collected"),
+				switchOption(&c.TLSVerifyClients, "tls-verify-clients", "", "accept only the connections presenting a certificate that chains to --tls-ca (mutual TLS)"),
+				durationOption(&c.AuthGrace, "auth-grace", "", "duration", util.DefaultAuthGrace, "time the replaced cluster keys remain accepted once the auth-key file is reloaded"),
+				stringOption(&c.ACLFile, "acl", "", "file", "", "enforce the JSON access control list in the specified file, unless the cluster holds a newer one").withFiles(),
+				stringOption(&c.DaemonKeyFile, "daemon-key", "", "file", "", "prove to the other daemons, with the keys in the specified file, that this node is a daemon").withFiles(),
+				stringOption(&c.HTTPAddress, "http", "", "address", "", "serve the HTTP/JSON gateway at the specified address (e.g. :8080)"),
+				stringOption(&c.GRPCAddress, "grpc", "", "address", "", "serve the gRPC service at the specified address (e.g. :9090)"),
+				stringOption(&c.RESPAddress, "resp", "", "address", "", "serve the Redis protocol (RESP2) at the specified address (e.g. :6379)"),
+				stringOption(&c.MemcacheAddress, "memcache", "", "address", "", "serve the memcached ASCII protocol at the specified address (e.g. :11211)"),
+				switchOption(&c.MDNS, "mdns", "", "advertise the node via mDNS/DNS-SD as "+mdns.Service),
+				stringOption(&c.DNSAddress, "dns", "", "address", "", "answer DNS queries for <cluster>.nds. TXT at the specified address (e.g. :5300)"),
+				stringOption(&c.DNSCluster, "dns-cluster", "", "name", dns.DefaultCluster, "the cluster name served by --dns"),
+				stringOption(&c.MetricsAddress, "metrics", "", "address", "", "serve the Prometheus metrics at the specified address (e.g. :9100)"),
+			),
+			run: func([]string) error {
+				c.StartNode = true
+				return runPeer()
+			},
+		},
+		{
+			name:    "get",
+			summary: "print the value held by the cluster",
+			options: with(
+				switchOption(&c.PrintTS, "ts", "t", "print the timestamp before the value"),
+				uintOption(&c.GetAt, "at", "a", "ts", 0, "print the value the cluster held at the specified timestamp"),
+			),
+			run: func([]string) error {
+				c.GetVal = true
+				return runPeer()
+			},
+		},
+		{
+			name:     "set",
+			operands: "<value>",
+			minArgs:  1,
+			maxArgs:  1,
+			summary:  "set the value shared across the cluster",
+			options: with(
+				durationOption(&c.TTL, "ttl", "t", "duration", 0, "the value expires after the specified duration (e.g. 30s, 5m)"),
+				uintOption(&c.IfTS, "if-ts", "i", "ts", 0, "set the value only if the cluster is at the specified timestamp, printing the timestamp afterwards"),
+			),
+			run: func(operands []string) error {
+				c.Val, c.SetVal = operands[0], true
+				return runPeer()
+			},
+		},
+		{
+			name:    "delete",
+			summary: "delete the value shared across the cluster",
+			options: with(
+				uintOption(&c.IfTS, "if-ts", "i", "ts", 0, "delete the value only if the cluster is at the specified timestamp, printing the timestamp afterwards"),
+			),
+			run: func([]string) error {
+				c.Delete = true
+				return runPeer()
+			},
+		},
+		{
+			name:    "watch",
+			summary: "print \"<ts> <value>\" every time the value changes in the cluster",
+			options: with(
+				uintOption(&c.WatchFrom, "from", "f", "ts", 0, "resume from the specified timestamp"),
+			),
+			run: func([]string) error {
+				c.Watch = true
+				return runPeer()
+			},
+		},
+		{
+			name:    "history",
+			summary: "print the values retained by a daemon, oldest first",
+			options: with(),
+			run: func([]string) error {
+				c.History = true
+				return runPeer()
+			},
+		},
+		{
+			name:     "restore",
+			operands: "<ts>",
+			minArgs:  1,
+			maxArgs:  1,
+			summary:  "set again the value the cluster held at the specified timestamp",
+			options:  with(),
+			run: func(operands []string) error {
+				ts, err := strconv.ParseUint(operands[0], 10, 32)
+				if err != nil || ts == 0 {
+					fmt.Fprintf(os.Stderr, "nds restore: %q is not a timestamp\n", operands[0])
+					return errUsage
+				}
+				c.Restore = uint(ts)
+				return runPeer()
+			},
+		},
+		{
+			name:    "members",
+			summary: "print the daemon nodes of the cluster: \"<node id> <address>:<port> <ts>\"",
+			options: with(),
+			run: func([]string) error {
+				c.Members = true
+				return runPeer()
+			},
+		},
+		{
+			name:    "status",
+			summary: "print a summary of the cluster, as seen by a daemon",
+			options: with(),
+			run: func([]string) error {
+				c.Status = true
+				return runPeer()
+			},
+		},
+		{
+			name:    "cert",
+			summary: "write a self-signed CA and a certificate signed by it for a node, for labs (the CA is reused)",
+			options: []option{
+				stringOption(&certDir, "dir", "d", "dir", ".", "write the files into the specified directory").withFiles(),
+				stringOption(&certHosts, "host", "", "names", "", "comma separated host names and addresses of the node, the first one naming the files"),
+				durationOption(&certValid, "valid", "", "duration", util.DefaultCertValidity, "validity of the certificates"),
+			},
+			run: func([]string) error {
+				var hosts []string
+				for _, h := range strings.Split(certHosts, ",") {
+					if h = strings.TrimSpace(h); h != "" {
+						hosts = append(hosts, h)
+					}
+				}
+				files, err := util.GenerateCerts(certDir, hosts, certValid)
+				for _, f := range files {
+					fmt.Println(f)
+				}
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "nds cert:", err.Error())
+					return &util.NDSError{Code: util.RetCode_IOERR}
+				}
+				return nil
+			},
+		},
+		{
+			name:     "reload",
+			operands: "<address>",
+			minArgs:  1,
+			maxArgs:  1,
+			summary:  "make the daemon serving the HTTP gateway at the specified address read its configuration again",
+			options: []option{
+				stringOption(&c.TLSCertFile, "tls-cert", "", "file", "", "connect with HTTPS, presenting the specified PEM certificate").withFiles(),
+				stringOption(&c.TLSKeyFile, "tls-key", "", "file", "", "the PEM private key of --tls-cert").withFiles(),
+				stringOption(&c.TLSCAFile, "tls-ca", "", "file", "", "connect with HTTPS, the certificate of the daemon must chain to the specified PEM CA").withFiles(),
+				stringOption(&c.Token, "token", "", "token", "", "present the specified bearer token, the ACL of the cluster must grant it the admin permission"),
+			},
+			run: func(operands []string) error {
+				return requestReload(operands[0], c)
+			},
+		},
+		{
+			name:     "completion",
+			operands: "<shell>",
+			minArgs:  1,
+			maxArgs:  1,
+			words:    []string{"bash", "zsh", "fish"},
+			summary:  "print the completion script of the specified shell: bash, zsh or fish",
+			run: func(operands []string) error {
+				return printCompletion(os.Stdout, operands[0], commands(c, path))
+			},
+		},
+		{
+			name:     "help",
+			operands: "[<command>]",
+			maxArgs:  1,
+			summary:  "print the help of the specified command",
+			run: func(operands []string) error {
+				cmds := commands(c, path)
+				if len(operands) == 0 {
+					printUsage(os.Stdout, cmds)
+					return nil
+				}
+				cmd := findCommand(cmds, operands[0])
+				if cmd == nil {
+					fmt.Fprintf(os.Stderr, "nds help: unknown command %q\n", operands[0])
+					return errUsage
+				}
+				cmd.printHelp(os.Stdout, cmd.flagSet())
+				return nil
+			},
+		},
+	}
+	help := &cmds[len(cmds)-1]
+	for _, cmd := range cmds {
+		help.words = append(help.words, cmd.name)
+	}
+	return cmds
+}
+
+func findCommand(cmds []command, name string) *command {
+	for i := range cmds {
+		if cmds[i].name == name {
+			return &cmds[i]
+		}
+	}
+	return nil
+}
+
+//setting returns the setting of the option named name, named as its long form
+func (c *command) setting(name string) string {
+	for _, o := range c.options {
+		if o.short != "" && o.short == name {
+			return o.long
+		}
+	}
+	return name
+}
+
+//flagSet returns the flag set parsing the options of c, each one under both its names
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("nds "+c.name, flag.ContinueOnError)
+	for _, o := range c.options {
+		o.register(fs, o.long)
+		if o.short != "" {
+			o.register(fs, o.short)
+		}
+	}
+	fs.Usage = func() { c.printHelp(fs.Output(), fs) }
+	return fs
+}
+
+func (c *command) printHelp(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: nds %s", c.name)
+	if len(c.options) > 0 {
+		fmt.Fprint(w, " [options]")
+	}
+	if c.operands != "" {
+		fmt.Fprint(w, " "+c.operands)
+	}
+	fmt.Fprintf(w, "\n\n%s%s.\n\nOptions:\n", strings.ToUpper(c.summary[:1]), c.summary[1:])
+
+	width := len("-h, --help")
+	for _, o := range c.options {
+		if l := len(o.synopsis()); l > width {
+			width = l
+		}
+	}
+	for _, o := range c.options {
+		usage := o.usage
+		f := fs.Lookup(o.long)
+		if def := f.DefValue; o.arg != "" && def != "" && def != "0" && def != "0s" {
+			if kind, _ := flag.UnquoteUsage(f); kind == "string" {
+				def = strconv.Quote(def)
+			}
+			usage += fmt.Sprintf(" (default %s)", def)
+		}
+		fmt.Fprintf(w, "  %-*s  %s\n", width, o.synopsis(), usage)
+	}
+	fmt.Fprintf(w, "  %-*s  %s\n", width, "-h, --help", "print this help")
+}
+
+//printUsage prints the help of nds: the list of its commands
+func printUsage(w io.Writer, cmds []command) {
+	fmt.Fprint(w, "Usage: nds <command> [options] [arguments]\n\nCommands:\n")
+	width := 0
+	for _, c := range cmds {
+		if len(c.name) > width {
+			width = len(c.name)
+		}
+	}
+	for _, c := range cmds {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, c.name, c.summary)
+	}
+	fmt.Fprint(w, "\nRun \"nds help <command>\" for the options of a command.\n")
+}
+
+//parseArgs parses the options of args with fs, returning the operands;
+//unlike fs.Parse, options are accepted after the operands too (e.g. nds set Jerico --ttl 30s), until "--".
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var operands []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			return append(operands, rest...), nil
+		}
+		if len(rest) == 0 {
+			return operands, nil
+		}
+		operands, args = append(operands, rest[0]), rest[1:]
+	}
+}
+
+//runCommand runs the command called name with args, the command line following its name
+func runCommand(name string, args []string) error {
+	cmds := commands(&cfg, &configPath)
+	c := findCommand(cmds, name)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "nds: unknown command %q\n\n", name)
+		printUsage(os.Stderr, cmds)
+		return errUsage
+	}
+
+	fs := c.flagSet()
+	operands, err := parseArgs(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	} else if err != nil {
+		return errUsage
+	}
+	if len(operands) < c.minArgs || len(operands) > c.maxArgs {
+		fmt.Fprintf(fs.Output(), "nds %s: wrong number of arguments\n\n", c.name)
+		fs.Usage()
+		return errUsage
+	}
+
+	if fs.Lookup(configOption) != nil {
+		if err := loadConfig(fs, c.setting); err != nil {
+			fmt.Fprintln(os.Stderr, "nds:", err.Error())
+			return err
+		}
+	}
+	//an empty value is a value: it must be told apart from no --set at all
+	fs.Visit(func(f *flag.Flag) {
+		if c.setting(f.Name) == "set" {
+			cfg.SetVal = true
+		}
+	})
+	return c.run(operands)
+}
+
+//requestReload asks the daemon serving the HTTP gateway at address (e.g. localhost:8080) to read its configuration again,
+//printing the settings changed: "applied <setting>: <old> -> <new>", or "restart" for those taking a restart.
+//The gateway is reached with HTTPS if cfg has TLS certificates, as the gateway of a daemon having them;
+//the token of cfg, if any, is presented as bearer token.
+func requestReload(address string, cfg *util.Config) error {
+	t, err := util.LoadTLS(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nds reload:", err.Error())
+		return &util.NDSError{Code: util.RetCode_BADCFG}
+	}
+	client := http.DefaultClient
+	url := address
+	if t.Enabled() {
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: t.ClientConfig("")}}
+		if !strings.Contains(url, "://") {
+			url = "https://" + url
+		}
+	} else if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(url, "/")+"/reload", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nds reload:", err.Error())
+		return &util.NDSError{Code: util.RetCode_BADCFG}
+	}
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nds reload:", err.Error())
+		return &util.NDSError{Code: util.RetCode_SCKERR}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "nds reload: %s: %s", resp.Status, body)
+		return &util.NDSError{Code: util.RetCode_KO}
+	}
+	var r gateway.Reload
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		fmt.Fprintln(os.Stderr, "nds reload:", err.Error())
+		return &util.NDSError{Code: util.RetCode_MALFORM}
+	}
+	for _, c := range r.Applied {
+		fmt.Printf("applied %s: %q -> %q\n", c.Setting, c.Old, c.New)
+	}
+	for _, c := range r.RestartRequired {
+		fmt.Printf("restart %s: %q -> %q\n", c.Setting, c.Old, c.New)
+	}
+	return nil
+}
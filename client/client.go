@@ -0,0 +1,431 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+//Package client lets Go programs talk to the daemon nodes of a NDS cluster without joining it.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"nds/mdns"
+	"nds/network"
+	"nds/util"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//time allowed, when not configured, to find a daemon node
+const DefaultDiscoveryTimeout = 4 * time.Second
+
+//errors returned by the client: they are *util.NDSError, so errors.Is and errors.As both work on them
+var (
+	ErrNoData      error = &util.NDSError{Code: util.RetCode_NODATA}  //the cluster holds no value
+	ErrUnavailable error = &util.NDSError{Code: util.RetCode_UNVRSC}  //no daemon node could be reached
+	ErrTSMismatch  error = &util.NDSError{Code: util.RetCode_TSMISMT} //a conditional write was refused
+	ErrNetwork     error = &util.NDSError{Code: util.RetCode_SCKERR}  //the connection with the daemon node failed
+	ErrMalformed   error = &util.NDSError{Code: util.RetCode_MALFORM} //the daemon node sent an unexpected answer
+	ErrDropped     error = &util.NDSError{Code: util.RetCode_DRPPKT}  //the answer of the daemon node failed authentication
+	ErrDenied      error = &util.NDSError{Code: util.RetCode_DENIED}  //a write was denied by the ACL of the cluster
+)
+
+type Options struct {
+	//the multicast group used to discover daemon nodes, defaults to util.DefaultMulticastAddress:DefaultMulticastPort
+	MulticastAddress string
+	MulticastPort    uint
+
+	//daemon nodes to use instead of multicast discovery, as "host:port" (the listening port),
+	//tried in order
+	Seeds []string
+
+	//find daemon nodes through their mDNS advertisement (nds daemon --mdns) instead of the multicast group
+	MDNS bool
+
+	//time allowed to find a daemon node, defaults to DefaultDiscoveryTimeout
+	DiscoveryTimeout time.Duration
+
+	//the keys of the cluster, if it has any (see util.ReadAuthKeys): the first one signs, all of them are accepted
+	AuthKeys [][]byte
+
+	//encrypt the alive messages soliciting the daemon nodes, as nds --encrypt-multicast does; requires AuthKeys
+	EncryptMulticast bool
+
+	//how far apart the clocks of the client and of the daemon nodes can be, as nds --auth-max-skew;
+	//defaults to util.AuthReplayWindow
+	AuthMaxSkew time.Duration
+
+	//secures the connections with the daemon nodes when they use TLS; util.LoadTLS and util.TLS.ClientConfig
+	//build it from the files a node uses. The server name defaults to the host connected.
+	TLS *tls.Config
+
+	//the bearer token presented with the requests, checked against the ACL of the cluster (nds --token)
+	Token string
+
+	//logging of the multicast discovery, defaults to console and off
+	LogType  string
+	LogLevel string
+}
+
+//Value is the value held by the cluster at timestamp Ts
+type Value struct {
+	Ts uint32
+
+	//the value; empty if deleted
+	Data string
+
+	//the node that set the value
+	Origin string
+
+	//the value has been deleted (or it expired)
+	Deleted bool
+}
+
+//Member is a daemon node of the cluster
+type Member struct {
+	NodeID  string
+	Address string
+	Port    uint
+
+	//the latest timestamp announced by the node
+	Ts uint32
+}
+
+//Client sends requests to a daemon node of the cluster, moving to another one when it becomes unreachable.
+//A Client is safe for concurrent use.
+type Client struct {
+	opts Options
+	cfg  util.Config
+	auth *util.Auth
+
+	mu     sync.Mutex
+	daemon string
+}
+
+//Dial finds a daemon node of the cluster described by opts
+func Dial(opts Options) (*Client, error) {
+	if opts.MulticastAddress == "" {
+		opts.MulticastAddress = util.DefaultMulticastAddress
+	}
+	if opts.MulticastPort == 0 {
+		opts.MulticastPort = util.DefaultMulticastPort
+	}
+	if opts.DiscoveryTimeout == 0 {
+		opts.DiscoveryTimeout = DefaultDiscoveryTimeout
+	}
+	if opts.LogType == "" {
+		opts.LogType = "console"
+	}
+	if opts.LogLevel == "" {
+		opts.LogLevel = "off"
+	}
+
+	c := &Client{
+		opts: opts,
+		cfg: util.Config{
+			MulticastAddress: opts.MulticastAddress,
+			MulticastPort:    opts.MulticastPort,
+			LogType:          opts.LogType,
+			LogLevel:         opts.LogLevel,
+		},
+		auth: util.NewAuth(opts.AuthKeys),
+	}
+	c.auth.SetEncryption(opts.EncryptMulticast)
+	c.auth.SetReplayWindow(opts.AuthMaxSkew)
+	if _, err := c.discover(context.Background()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//Close releases the client
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.daemon = ""
+	c.mu.Unlock()
+	return nil
+}
+
+//discover finds a daemon node, different from the one currently used if possible
+func (c *Client) discover(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.DiscoveryTimeout)
+	defer cancel()
+
+	c.mu.Lock()
+	failed := c.daemon
+	c.mu.Unlock()
+
+	var daemon string
+	if len(c.opts.Seeds) > 0 {
+		for _, seed := range c.opts.Seeds {
+			if seed == failed && len(c.opts.Seeds) > 1 {
+				continue
+			}
+			if conn, err := c.dialAddr(ctx, seed); err == nil {
+				conn.Close()
+				daemon = seed
+				break
+			}
+		}
+	} else if c.opts.MDNS {
+		mdns.Browse(ctx, func(n mdns.Node) bool {
+			addr := net.JoinHostPort(n.Address, strconv.Itoa(int(n.Port)))
+			if n.Ts == 0 {
+				return false
+			}
+			daemon = addr
+			return addr != failed
+		})
+	} else {
+		network.Discover(ctx, &c.cfg, c.auth, func(msg util.AliveMsg) bool {
+			addr := net.JoinHostPort(msg.Si, strconv.Itoa(int(msg.Lp)))
+			if !msg.Dn || msg.Ts == 0 {
+				return false
+			}
+			daemon = addr
+			return addr != failed
+		})
+	}
+
+	if daemon == "" {
+		if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+			return "", ctx.Err()
+		}
+		return "", ErrUnavailable
+	}
+
+	c.mu.Lock()
+	c.daemon = daemon
+	c.mu.Unlock()
+	return daemon, nil
+}
+
+func (c *Client) dialAddr(ctx context.Context, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: network.DialTimeout}
+	if c.opts.TLS != nil {
+		td := tls.Dialer{NetDialer: &d, Config: c.opts.TLS}
+		return td.DialContext(ctx, "tcp", addr)
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+//open connects to the current daemon node and sends req;
+//if the daemon node is unreachable, another one is discovered.
+func (c *Client) open(ctx context.Context, req util.ReqMsg) (net.Conn, error) {
+	c.mu.Lock()
+	daemon := c.daemon
+	c.mu.Unlock()
+
+	var conn net.Conn
+	var err error
+	if daemon != "" {
+		conn, err = c.dialAddr(ctx, daemon)
+	}
+	if daemon == "" || err != nil {
+		if daemon, err = c.discover(ctx); err != nil {
+			return nil, err
+		}
+		if conn, err = c.dialAddr(ctx, daemon); err != nil {
+			return nil, ErrNetwork
+		}
+	}
+
+	req.Pt, req.Tk = util.MsgPktTypeReq, c.opts.Token
+	buff, err := req.MarshalJSON()
+	if err != nil {
+		conn.Close()
+		return nil, ErrMalformed
+	}
+	if _, err := conn.Write(c.auth.NewFrame(buff)); err != nil {
+		conn.Close()
+		return nil, ErrNetwork
+	}
+	return conn, nil
+}
+
+//request sends req to a daemon node and decodes its answer in resp
+func (c *Client) request(ctx context.Context, req util.ReqMsg, resp interface{}) error {
+	conn, err := c.open(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	buff, err := c.auth.ReadFrame(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var nerr *util.NDSError
+		if errors.As(err, &nerr) {
+			return nerr
+		}
+		return ErrNetwork
+	}
+	if err := json.Unmarshal(buff, resp); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+func toValue(msg util.DataMsg) Value {
+	return Value{Ts: uint32(msg.Ts), Data: msg.Dv, Origin: msg.Og, Deleted: msg.Tb}
+}
+
+//Get returns the value held by the cluster; ErrNoData is returned if there is none (or it was deleted),
+//along with the timestamp of the deletion, if any.
+func (c *Client) Get(ctx context.Context) (Value, error) {
+	msg := util.DataMsg{}
+	if err := c.request(ctx, util.ReqMsg{Op: util.ReqOpGet}, &msg); err != nil {
+		return Value{}, err
+	}
+	if v := toValue(msg); v.Ts == 0 || v.Deleted {
+		return v, ErrNoData
+	} else {
+		return v, nil
+	}
+}
+
+func (c *Client) write(ctx context.Context, req util.ReqMsg) (uint32, error) {
+	resp := util.RespMsg{}
+	if err := c.request(ctx, req, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Rc != util.RetCode_OK {
+		return uint32(resp.Ts), &util.NDSError{Code: resp.Rc}
+	}
+	return uint32(resp.Ts), nil
+}
+
+//Set makes the cluster share value; it returns the timestamp of the value.
+func (c *Client) Set(ctx context.Context, value string) (uint32, error) {
+	return c.write(ctx, util.ReqMsg{Op: util.ReqOpSet, Dv: value})
+}
+
+//SetIf is like Set, but value is accepted only if the cluster is at timestamp ifTS;
+//otherwise ErrTSMismatch is returned, along with the timestamp of the cluster.
+func (c *Client) SetIf(ctx context.Context, value string, ifTS uint32) (uint32, error) {
+	ct := uint64(ifTS)
+	return c.write(ctx, util.ReqMsg{Op: util.ReqOpSet, Dv: value, Ct: &ct})
+}
+
+//Delete makes the cluster drop the value; it returns the timestamp of the deletion.
+func (c *Client) Delete(ctx context.Context) (uint32, error) {
+	return c.write(ctx, util.ReqMsg{Op: util.ReqOpDel})
+}
+
+//Members returns the daemon nodes of the cluster, as known by a daemon node
+func (c *Client) Members(ctx context.Context) ([]Member, error) {
+	resp := util.MembersMsg{}
+	if err := c.request(ctx, util.ReqMsg{Op: util.ReqOpMembers}, &resp); err != nil {
+		return nil, err
+	}
+	members := make([]Member, 0, len(resp.Mb))
+	for _, m := range resp.Mb {
+		members = append(members, Member{NodeID: m.Ni, Address: m.Si, Port: uint(m.Lp), Ts: uint32(m.Ts)})
+	}
+	return members, nil
+}
+
+//Watch delivers the value held by the cluster, starting with the current one, every time it changes;
+//a deletion is delivered as a Value with Deleted set.
+//When the daemon node goes away, the watch is resumed with another one from the last timestamp seen:
+//values superseded in the meantime are skipped.
+//The channel is closed once ctx is done.
+func (c *Client) Watch(ctx context.Context) (<-chan Value, error) {
+	conn, err := c.open(ctx, util.ReqMsg{Op: util.ReqOpWatch})
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(chan Value)
+	go func() {
+		defer close(values)
+		var last Value
+		for {
+			last = c.consumeWatch(ctx, conn, last, values)
+			conn = nil
+			for conn == nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if conn, err = c.open(ctx, util.ReqMsg{Op: util.ReqOpWatch, Ts: uint64(last.Ts)}); err != nil {
+					select {
+					case <-time.After(network.SolicitPeriod):
+					case <-ctx.Done():
+					}
+				}
+			}
+		}
+	}()
+	return values, nil
+}
+
+//consumeWatch delivers the values streamed over conn until the session drops or ctx is done;
+//it returns the last value delivered.
+func (c *Client) consumeWatch(ctx context.Context, conn net.Conn, last Value, values chan<- Value) Value {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	for {
+		buff, err := c.auth.ReadFrame(conn)
+		if err != nil {
+			return last
+		}
+		msg := util.DataMsg{}
+		if err := json.Unmarshal(buff, &msg); err != nil {
+			return last
+		}
+		//an expired value turns into a tombstone keeping its timestamp
+		v := toValue(msg)
+		if v.Ts < last.Ts || (v.Ts == last.Ts && (!v.Deleted || last.Deleted)) {
+			continue
+		}
+		select {
+		case values <- v:
+			last = v
+		case <-ctx.Done():
+			return last
+		}
+	}
+}
@@ -0,0 +1,55 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"nds/sim"
+	"os"
+	"time"
+)
+
+func main() {
+	var opts sim.Options
+	var runs int
+	flag.IntVar(&opts.Nodes, "nodes", 4, "number of daemon nodes")
+	flag.IntVar(&opts.Ops, "ops", 20, "number of ops per workload")
+	flag.Int64Var(&opts.Seed, "seed", time.Now().UnixNano(), "random seed of the first workload")
+	flag.IntVar(&runs, "runs", 1, "number of workloads to run (seeds are consecutive)")
+	flag.DurationVar(&opts.MaxPause, "pause", 500*time.Millisecond, "max pause before each op")
+	flag.DurationVar(&opts.Settle, "settle", 0, "time given to the cluster to converge (0: default)")
+	flag.BoolVar(&opts.AllowTies, "ties", false, "allow several sets within the same second")
+	flag.IntVar(&opts.MaxShrinkRuns, "shrink", 16, "max executions spent minimizing a failing workload")
+	flag.StringVar(&opts.LogLevel, "v", "off", "logging verbosity of simulated peers [off (default), trace, info, warn, err]")
+	flag.Parse()
+
+	failed := false
+	for i := 0; i < runs; i++ {
+		r := sim.Run(opts)
+		fmt.Print(r.String())
+		failed = failed || r.Failed()
+		opts.Seed++
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,232 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+//printCompletion prints the completion script of shell for the commands cmds, e.g. for bash:
+//
+//	source <(nds completion bash)
+func printCompletion(w io.Writer, shell string, cmds []command) error {
+	switch shell {
+	case "bash":
+		bashCompletion(w, cmds)
+	case "zsh":
+		zshCompletion(w, cmds)
+	case "fish":
+		fishCompletion(w, cmds)
+	default:
+		fmt.Fprintf(os.Stderr, "nds completion: unsupported shell %q, expected one of bash, zsh, fish\n", shell)
+		return errUsage
+	}
+	return nil
+}
+
+//names returns the names an option is given with, e.g. "-p --port"
+func (o option) names(sep string) string {
+	if o.short == "" {
+		return "--" + o.long
+	}
+	return "-" + o.short + sep + "--" + o.long
+}
+
+func bashCompletion(w io.Writer, cmds []command) {
+	var names []string
+	for _, c := range cmds {
+		names = append(names, c.name)
+	}
+
+	fmt.Fprint(w, "# bash completion of nds, generated by: nds completion bash\n\n")
+	fmt.Fprint(w, "_nds() {\n")
+	fmt.Fprint(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprint(w, "    COMPREPLY=()\n")
+	fmt.Fprint(w, "    if [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprint(w, "        return\n")
+	fmt.Fprint(w, "    fi\n\n")
+	fmt.Fprint(w, "    local options words\n")
+	fmt.Fprint(w, "    case \"${COMP_WORDS[1]}\" in\n")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "    %s)\n", c.name)
+		//the word following an option taking an argument is the argument
+		var options, files, free []string
+		var cases []string
+		for _, o := range c.options {
+			options = append(options, o.names(" "))
+			switch {
+			case o.arg == "":
+			case o.files:
+				files = append(files, o.names("|"))
+			case len(o.words) > 0:
+				cases = append(cases, fmt.Sprintf("        %s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return ;;\n", o.names("|"), strings.Join(o.words, " ")))
+			default:
+				free = append(free, o.names("|"))
+			}
+		}
+		if len(files) > 0 {
+			cases = append(cases, fmt.Sprintf("        %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(files, "|")))
+		}
+		if len(free) > 0 {
+			cases = append(cases, fmt.Sprintf("        %s) return ;;\n", strings.Join(free, "|")))
+		}
+		if len(cases) > 0 {
+			fmt.Fprint(w, "        case \"$prev\" in\n")
+			fmt.Fprint(w, strings.Join(cases, ""))
+			fmt.Fprint(w, "        esac\n")
+		}
+		fmt.Fprintf(w, "        options=\"%s\"\n", strings.Join(append(options, "-h --help"), " "))
+		fmt.Fprintf(w, "        words=\"%s\"\n", strings.Join(c.words, " "))
+		fmt.Fprint(w, "        ;;\n")
+	}
+	fmt.Fprint(w, "    *)\n")
+	fmt.Fprint(w, "        return ;;\n")
+	fmt.Fprint(w, "    esac\n\n")
+	fmt.Fprint(w, "    if [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprint(w, "        COMPREPLY=($(compgen -W \"$options\" -- \"$cur\"))\n")
+	fmt.Fprint(w, "    else\n")
+	fmt.Fprint(w, "        COMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	fmt.Fprint(w, "    fi\n")
+	fmt.Fprint(w, "}\n\n")
+	fmt.Fprint(w, "complete -F _nds nds\n")
+}
+
+//zshQuote quotes s as a single word of zsh
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+//zshSpec returns the _arguments spec of an option
+func zshSpec(o option) string {
+	usage := strings.NewReplacer("[", `\[`, "]", `\]`).Replace(o.usage)
+
+	var action string
+	switch {
+	case o.arg == "":
+	case o.files:
+		action = ":" + o.arg + ":_files"
+	case len(o.words) > 0:
+		action = ":" + o.arg + ":(" + strings.Join(o.words, " ") + ")"
+	default:
+		action = ":" + o.arg + ": "
+	}
+	long := "--" + o.long
+	if o.arg != "" {
+		long += "="
+	}
+
+	if o.short == "" {
+		return zshQuote(long + "[" + usage + "]" + action)
+	}
+	return zshQuote("(-"+o.short+" --"+o.long+")") + "{-" + o.short + "," + long + "}" + zshQuote("["+usage+"]"+action)
+}
+
+func zshCompletion(w io.Writer, cmds []command) {
+	fmt.Fprint(w, "#compdef nds\n")
+	fmt.Fprint(w, "# zsh completion of nds, generated by: nds completion zsh\n\n")
+	fmt.Fprint(w, "_nds() {\n")
+	fmt.Fprint(w, "    local -a commands\n")
+	fmt.Fprint(w, "    commands=(\n")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "        %s\n", zshQuote(c.name+":"+c.summary))
+	}
+	fmt.Fprint(w, "    )\n")
+	fmt.Fprint(w, "    if (( CURRENT == 2 )); then\n")
+	fmt.Fprint(w, "        _describe -t commands 'nds command' commands\n")
+	fmt.Fprint(w, "        return\n")
+	fmt.Fprint(w, "    fi\n\n")
+	fmt.Fprint(w, "    local cmd=$words[2]\n")
+	fmt.Fprint(w, "    shift words\n")
+	fmt.Fprint(w, "    (( CURRENT-- ))\n")
+	fmt.Fprint(w, "    case $cmd in\n")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "    %s)\n", c.name)
+		fmt.Fprint(w, "        _arguments -s \\\n")
+		for _, o := range c.options {
+			fmt.Fprintf(w, "            %s \\\n", zshSpec(o))
+		}
+		fmt.Fprintf(w, "            %s", zshQuote("(- *)"+"{-h,--help}"+"[print the help]"))
+		if c.operands != "" {
+			arg := strings.Trim(c.operands, "[<>]")
+			action := " "
+			if len(c.words) > 0 {
+				action = "(" + strings.Join(c.words, " ") + ")"
+			}
+			spec := ":" + arg + ":" + action
+			if c.minArgs == 0 {
+				spec = ":" + spec
+			}
+			fmt.Fprintf(w, " \\\n            %s", zshQuote(spec))
+		}
+		fmt.Fprint(w, "\n        ;;\n")
+	}
+	fmt.Fprint(w, "    esac\n")
+	fmt.Fprint(w, "}\n\n")
+	fmt.Fprint(w, "if [ \"$funcstack[1]\" = \"_nds\" ]; then\n")
+	fmt.Fprint(w, "    _nds \"$@\"\n")
+	fmt.Fprint(w, "else\n")
+	fmt.Fprint(w, "    compdef _nds nds\n")
+	fmt.Fprint(w, "fi\n")
+}
+
+//fishQuote quotes s as a single word of fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func fishCompletion(w io.Writer, cmds []command) {
+	fmt.Fprint(w, "# fish completion of nds, generated by: nds completion fish\n\n")
+	fmt.Fprint(w, "complete -c nds -f\n")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "complete -c nds -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.summary))
+	}
+
+	for _, c := range cmds {
+		cond := fishQuote("__fish_seen_subcommand_from " + c.name)
+		fmt.Fprintln(w)
+		for _, o := range c.options {
+			fmt.Fprintf(w, "complete -c nds -n %s", cond)
+			if o.short != "" {
+				fmt.Fprintf(w, " -s %s", o.short)
+			}
+			fmt.Fprintf(w, " -l %s", o.long)
+			switch {
+			case o.arg == "":
+			case o.files:
+				fmt.Fprint(w, " -r -F")
+			case len(o.words) > 0:
+				fmt.Fprintf(w, " -x -a %s", fishQuote(strings.Join(o.words, " ")))
+			default:
+				fmt.Fprint(w, " -x")
+			}
+			fmt.Fprintf(w, " -d %s\n", fishQuote(o.usage))
+		}
+		fmt.Fprintf(w, "complete -c nds -n %s -s h -l help -d 'print the help'\n", cond)
+		if len(c.words) > 0 {
+			fmt.Fprintf(w, "complete -c nds -n %s -a %s\n", cond, fishQuote(strings.Join(c.words, " ")))
+		}
+	}
+}
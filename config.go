@@ -0,0 +1,177 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"nds/util"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//settingNames maps the single-dash short options to the names of their settings in config files and environment variables;
+//the other settings are named as their options
+var settingNames = map[string]string{"n": "node", "j": "join", "jp": "join-port", "p": "port", "l": "log", "v": "verbosity"}
+
+//configOption is the option naming the config file, also read from NDS_CONFIG
+const configOption = "config"
+
+func settingName(option string) string {
+	if name, ok := settingNames[option]; ok {
+		return name
+	}
+	return option
+}
+
+//envVar returns the environment variable of a setting: NDS_ followed by its name in upper case, with '_' for '-'
+func envVar(setting string) string {
+	return "NDS_" + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+/**
+ * loadConfig fills the options of fs not given on the command line; the sources are, in order of precedence:
+ *
+ *  1. the command line;
+ *  2. the environment variables NDS_<SETTING> (e.g. NDS_JOIN_PORT=8745, NDS_HTTP=:8080);
+ *  3. the config file given by -config (or NDS_CONFIG), a YAML mapping of settings (e.g. join-port: 8745, http: ":8080");
+ *  4. the defaults of the options.
+ *
+ * Settings are named as the long form of the options, as returned by setting; the settings of the options
+ * of other commands are ignored, so that the same config file serves every command.
+ */
+func loadConfig(fs *flag.FlagSet, setting func(option string) string) error {
+	//the names of an option share its variable: setting either one sets the option
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[setting(f.Name)] = true })
+
+	options := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != configOption {
+			options[setting(f.Name)] = f.Name
+		}
+	})
+
+	apply := func(setting, value, source string) error {
+		if err := fs.Set(options[setting], value); err != nil {
+			return &util.ConfigError{Setting: setting, Reason: fmt.Sprintf("bad value %q from %s", value, source)}
+		}
+		given[setting] = true
+		return nil
+	}
+
+	for setting := range options {
+		if given[setting] {
+			continue
+		}
+		if value, ok := os.LookupEnv(envVar(setting)); ok {
+			if err := apply(setting, value, envVar(setting)); err != nil {
+				return err
+			}
+		}
+	}
+
+	path := fs.Lookup(configOption).Value.String()
+	if path == "" {
+		path = os.Getenv(envVar(configOption))
+	}
+	if path == "" {
+		return nil
+	}
+	buff, err := os.ReadFile(path)
+	if err != nil {
+		return &util.ConfigError{Setting: configOption, Reason: err.Error()}
+	}
+	settings := make(map[string]interface{})
+	if err := yaml.Unmarshal(buff, &settings); err != nil {
+		return &util.ConfigError{Setting: configOption, Reason: fmt.Sprintf("%s: %s", path, err.Error())}
+	}
+	known := knownSettings()
+	for setting, value := range settings {
+		if !known[setting] {
+			return &util.ConfigError{Setting: setting, Reason: fmt.Sprintf("unknown setting in %s", path)}
+		}
+		if _, ok := options[setting]; !ok || given[setting] {
+			continue
+		}
+		var str string
+		switch value.(type) {
+		case nil:
+		case map[string]interface{}, []interface{}:
+			return &util.ConfigError{Setting: setting, Reason: fmt.Sprintf("a single value is expected in %s", path)}
+		default:
+			str = fmt.Sprint(value)
+		}
+		if err := apply(setting, str, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//knownSettings returns the settings of every option: the single-dash options cover those of every command
+func knownSettings() map[string]bool {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	var path string
+	legacyFlags(fs, &util.Config{}, &path)
+
+	known := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) { known[settingName(f.Name)] = true })
+	return known
+}
+
+//rereadConfig reads the configuration of this process again as it was at startup: from its command line,
+//the environment variables and the config file, the latter two possibly changed in the meantime
+func rereadConfig() (util.Config, error) {
+	var c util.Config
+	var path string
+	args := os.Args[1:]
+
+	var fs *flag.FlagSet
+	setting := settingName
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd := findCommand(commands(&c, &path), args[0])
+		if cmd == nil {
+			return c, &util.NDSError{Code: util.RetCode_BADARG}
+		}
+		fs, setting = cmd.flagSet(), cmd.setting
+		fs.SetOutput(io.Discard)
+		if _, err := parseArgs(fs, args[1:]); err != nil {
+			return c, err
+		}
+	} else {
+		fs = flag.NewFlagSet("nds", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		legacyFlags(fs, &c, &path)
+		if err := fs.Parse(args); err != nil {
+			return c, err
+		}
+	}
+
+	if err := loadConfig(fs, setting); err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
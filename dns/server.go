@@ -0,0 +1,366 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+//Package dns answers DNS queries with the value held by a daemon node, for hosts where only a resolver is available.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"nds/peer"
+	"nds/util"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//Zone is the parent of the names served: a cluster is served as <cluster>.nds.
+const Zone = "nds."
+
+//DefaultCluster is the cluster name served when none is configured
+const DefaultCluster = "default"
+
+const (
+	//the largest UDP response for queries without EDNS(0) (RFC 1035 section 4.2.1)
+	maxUDPSize = 512
+
+	//the largest UDP response sent whatever size the client advertises with EDNS(0): it bounds what a spoofed
+	//query can make the server send to its victim, and avoids IP fragmentation (DNS flag day 2020)
+	maxEDNSSize = 1232
+
+	//the longest string a TXT record can hold
+	maxTXTString = 255
+
+	//time allowed to a TCP client to send its query
+	tcpReadTimeout = 10 * time.Second
+)
+
+/**
+ * Server is an authoritative DNS server, over UDP and TCP, for the zone <cluster>.nds.:
+ *
+ *     default.nds.       0  TXT  "Jerico"
+ *     ts.default.nds.    0  TXT  "1612981862"
+ *     default.nds.       0  SOA  default.nds. hostmaster.default.nds. 1612981862 0 0 0 0
+ *
+ * The value is split into strings of 255 bytes: they must be concatenated to rebuild it.
+ * The TS record is sent along as additional record of the value; the SOA serial is the TS as well.
+ * Records have TTL 0 so that resolvers do not cache them: every answer reflects the value held right then.
+ * There is no value record if the cluster holds no value (or it was deleted).
+ * Responses too large for UDP are truncated, for the client to query again over TCP.
+ * Queries are refused if the ACL of the cluster does not let anonymous clients read.
+ */
+type Server struct {
+	peer   *peer.Peer
+	logger util.Logger
+
+	apex   dnsmessage.Name
+	tsName dnsmessage.Name
+
+	pconn    net.PacketConn
+	listener net.Listener
+
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+//Listen starts serving p at address (e.g. ":5353") as cluster; it returns once listening
+func Listen(address string, cluster string, p *peer.Peer) (*Server, error) {
+	s := &Server{peer: p, conns: make(map[net.Conn]struct{})}
+	if err := s.logger.Init("dns.", &p.Cfg); err != nil {
+		return nil, err
+	}
+
+	if cluster == "" {
+		cluster = DefaultCluster
+	}
+	var err error
+	if s.apex, err = dnsmessage.NewName(strings.ToLower(cluster) + "." + Zone); err != nil {
+		s.logger.Err("cluster name %s:%s", cluster, err.Error())
+		return nil, &util.NDSError{Code: util.RetCode_BADCFG}
+	}
+	if s.tsName, err = dnsmessage.NewName("ts." + s.apex.String()); err != nil {
+		return nil, &util.NDSError{Code: util.RetCode_BADCFG}
+	}
+
+	if s.pconn, err = net.ListenPacket("udp", address); err != nil {
+		s.logger.Err("listening on udp %s:%s", address, err.Error())
+		return nil, err
+	}
+	//TCP on the port chosen for UDP, which may have been picked by the system
+	if s.listener, err = net.Listen("tcp", s.pconn.LocalAddr().String()); err != nil {
+		s.logger.Err("listening on tcp %s:%s", address, err.Error())
+		s.pconn.Close()
+		return nil, err
+	}
+	s.logger.Trace("serving %s on %s", s.apex.String(), s.pconn.LocalAddr().String())
+
+	go s.serveUDP()
+	go s.accept()
+	return s, nil
+}
+
+//Addr returns the UDP address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.pconn.LocalAddr()
+}
+
+//Close stops the server and drops its connections
+func (s *Server) Close() error {
+	err := s.pconn.Close()
+	s.listener.Close()
+	s.mtx.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mtx.Unlock()
+	s.logger.Stop()
+	return err
+}
+
+func (s *Server) serveUDP() {
+	buff := make([]byte, 65535)
+	for {
+		nread, addr, err := s.pconn.ReadFrom(buff)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Err("ReadFrom:%s", err.Error())
+			continue
+		}
+		if resp := s.handle(buff[:nread], addr, true); resp != nil {
+			if _, err := s.pconn.WriteTo(resp, addr); err != nil {
+				s.logger.Err("WriteTo %s:%s", addr.String(), err.Error())
+			}
+		}
+	}
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Err("accepting connection:%s", err.Error())
+			}
+			return
+		}
+		s.mtx.Lock()
+		s.conns[conn] = struct{}{}
+		s.mtx.Unlock()
+		go s.serveTCP(conn)
+	}
+}
+
+//serveTCP answers the queries of conn, each framed by its length on 2 bytes (RFC 1035 section 4.2.2)
+func (s *Server) serveTCP(conn net.Conn) {
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpReadTimeout))
+		var hdr [2]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := s.handle(query, conn.RemoteAddr(), false)
+		if resp == nil {
+			return
+		}
+		frame := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(frame, uint16(len(resp)))
+		copy(frame[2:], resp)
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+//handle returns the packed response to query, sent from addr, nil if query deserves none
+func (s *Server) handle(query []byte, addr net.Addr, udp bool) []byte {
+	var parser dnsmessage.Parser
+	qhdr, err := parser.Start(query)
+	if err != nil || qhdr.Response {
+		return nil
+	}
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               qhdr.ID,
+			Response:         true,
+			OpCode:           qhdr.OpCode,
+			RecursionDesired: qhdr.RecursionDesired,
+		},
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		resp.Header.RCode = dnsmessage.RCodeFormatError
+		return s.pack(resp, maxUDPSize)
+	}
+	resp.Questions = msg.Questions
+
+	//EDNS(0) (RFC 6891): the client may accept UDP responses larger than 512 bytes
+	size := maxUDPSize
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			if int(rr.Header.Class) > size {
+				size = int(rr.Header.Class)
+			}
+			if size > maxEDNSSize {
+				size = maxEDNSSize
+			}
+			var opt dnsmessage.Resource
+			opt.Header.SetEDNS0(size, dnsmessage.RCodeSuccess, false)
+			opt.Body = &dnsmessage.OPTResource{}
+			resp.Additionals = append(resp.Additionals, opt)
+		}
+	}
+	if !udp {
+		size = 65535
+	}
+
+	if qhdr.OpCode != 0 {
+		resp.Header.RCode = dnsmessage.RCodeNotImplemented
+		return s.pack(resp, size)
+	}
+	s.answer(&resp, msg.Questions[0], addr)
+	return s.pack(resp, size)
+}
+
+//answer fills resp with the answer to q, sent from addr
+func (s *Server) answer(resp *dnsmessage.Message, q dnsmessage.Question, addr net.Addr) {
+	name := strings.ToLower(q.Name.String())
+	if name != s.apex.String() && !strings.HasSuffix(name, "."+s.apex.String()) {
+		resp.Header.RCode = dnsmessage.RCodeRefused
+		return
+	}
+	resp.Header.Authoritative = true
+	if q.Class != dnsmessage.ClassINET && q.Class != dnsmessage.ClassANY {
+		resp.Header.RCode = dnsmessage.RCodeRefused
+		return
+	}
+	//DNS clients cannot authenticate: they read only if the ACL of the cluster lets anyone read
+	if err := s.peer.Authorize(peer.Caller{Addr: addr.String()}, util.ReqOpGet); err != nil {
+		resp.Header.RCode = dnsmessage.RCodeRefused
+		return
+	}
+
+	e, err := s.peer.Get()
+	if err != nil && !errors.Is(err, &util.NDSError{Code: util.RetCode_NODATA}) {
+		resp.Header.RCode = dnsmessage.RCodeServerFailure
+		return
+	}
+	want := func(t dnsmessage.Type) bool {
+		return q.Type == t || q.Type == dnsmessage.TypeALL
+	}
+	header := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET}
+	}
+	tsRecord := dnsmessage.Resource{
+		Header: header(s.tsName),
+		Body:   &dnsmessage.TXTResource{TXT: []string{strconv.FormatUint(uint64(e.Ts), 10)}},
+	}
+	soa := dnsmessage.Resource{
+		Header: header(s.apex),
+		Body: &dnsmessage.SOAResource{
+			NS:     s.apex,
+			MBox:   dnsmessage.MustNewName("hostmaster." + s.apex.String()),
+			Serial: e.Ts,
+		},
+	}
+
+	switch name {
+	case s.apex.String():
+		if want(dnsmessage.TypeTXT) && err == nil {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: header(s.apex),
+				Body:   &dnsmessage.TXTResource{TXT: split(e.Value)},
+			})
+			resp.Additionals = append(resp.Additionals, tsRecord)
+		}
+		if want(dnsmessage.TypeSOA) {
+			resp.Answers = append(resp.Answers, soa)
+		}
+	case s.tsName.String():
+		if want(dnsmessage.TypeTXT) {
+			resp.Answers = append(resp.Answers, tsRecord)
+		}
+	default:
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	}
+
+	//negative answers carry the SOA of the zone (RFC 2308)
+	if len(resp.Answers) == 0 {
+		resp.Authorities = append(resp.Authorities, soa)
+	}
+}
+
+//split splits val into TXT strings; an empty value is a single empty string
+func split(val string) []string {
+	strs := []string{}
+	for len(val) > maxTXTString {
+		strs = append(strs, val[:maxTXTString])
+		val = val[maxTXTString:]
+	}
+	return append(strs, val)
+}
+
+//pack packs resp; if it does not fit size, records are dropped and the response is marked as truncated
+func (s *Server) pack(resp dnsmessage.Message, size int) []byte {
+	buff, err := resp.Pack()
+	if err == nil && len(buff) <= size {
+		return buff
+	}
+
+	if err != nil {
+		//e.g. a value too large even for TCP
+		s.logger.Err("Pack:%s", err.Error())
+		resp.Header.RCode = dnsmessage.RCodeServerFailure
+	} else {
+		resp.Header.Truncated = true
+	}
+	resp.Answers, resp.Authorities = nil, nil
+	var opts []dnsmessage.Resource
+	for _, rr := range resp.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			opts = append(opts, rr)
+		}
+	}
+	resp.Additionals = opts
+	if buff, err = resp.Pack(); err != nil {
+		s.logger.Err("Pack:%s", err.Error())
+		return nil
+	}
+	return buff
+}
@@ -0,0 +1,263 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"nds/peer"
+	"nds/sim"
+	"nds/util"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//startServer starts a daemon node alone on an in-memory network, once it holds a timestamp, and serves it as cluster "test"
+func startServer(t *testing.T) (*peer.Peer, *Server) {
+	t.Helper()
+	p, err := peer.New(util.Config{StartNode: true, LogType: "console", LogLevel: util.OffStr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Transport = sim.NewBus().Endpoint("n0")
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	deadline := time.Now().Add(time.Second * (peer.NodeSynchDuration + 5))
+	for p.Self("").Ts == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the node did not generate a timestamp")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	s, err := Listen("127.0.0.1:0", "test", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return p, s
+}
+
+//query packs a query of name and type t, advertising an EDNS(0) UDP size if not 0
+func query(t *testing.T, name string, typ dnsmessage.Type, udpSize int) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x4e44},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	if udpSize > 0 {
+		var opt dnsmessage.Resource
+		opt.Header.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, false)
+		opt.Body = &dnsmessage.OPTResource{}
+		msg.Additionals = append(msg.Additionals, opt)
+	}
+	buff, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buff
+}
+
+func unpack(t *testing.T, buff []byte) dnsmessage.Message {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buff); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 0x4e44 || !msg.Header.Response {
+		t.Fatalf("got header %v, want the response to the query", msg.Header)
+	}
+	return msg
+}
+
+func exchangeUDP(t *testing.T, s *Server, q []byte) dnsmessage.Message {
+	t.Helper()
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(q); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 65535)
+	n, err := conn.Read(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unpack(t, buff[:n])
+}
+
+func exchangeTCP(t *testing.T, s *Server, q []byte) dnsmessage.Message {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	//messages over TCP are prefixed by their length (RFC 1035 section 4.2.2)
+	if _, err := conn.Write(append([]byte{byte(len(q) >> 8), byte(len(q))}, q...)); err != nil {
+		t.Fatal(err)
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buff); err != nil {
+		t.Fatal(err)
+	}
+	return unpack(t, buff)
+}
+
+//txt returns the strings of the TXT answers to name
+func txt(msg dnsmessage.Message, name string) [][]string {
+	var strs [][]string
+	for _, rr := range msg.Answers {
+		if body, ok := rr.Body.(*dnsmessage.TXTResource); ok && rr.Header.Name.String() == name {
+			strs = append(strs, body.TXT)
+		}
+	}
+	return strs
+}
+
+func TestValue(t *testing.T) {
+	p, s := startServer(t)
+	ts, err := p.Set("Jerico")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for transport, exchange := range map[string]func(*testing.T, *Server, []byte) dnsmessage.Message{"udp": exchangeUDP, "tcp": exchangeTCP} {
+		msg := exchange(t, s, query(t, "test.nds.", dnsmessage.TypeTXT, 0))
+		if msg.Header.RCode != dnsmessage.RCodeSuccess || !msg.Header.Authoritative {
+			t.Fatalf("%s: got header %v, want an authoritative answer", transport, msg.Header)
+		}
+		if got := txt(msg, "test.nds."); len(got) != 1 || len(got[0]) != 1 || got[0][0] != "Jerico" {
+			t.Fatalf("%s: got %v, want Jerico", transport, got)
+		}
+
+		msg = exchange(t, s, query(t, "ts.test.nds.", dnsmessage.TypeTXT, 0))
+		if got := txt(msg, "ts.test.nds."); len(got) != 1 || got[0][0] != strconv.FormatUint(uint64(ts), 10) {
+			t.Fatalf("%s: got %v, want ts:%d", transport, got, ts)
+		}
+	}
+}
+
+func TestLongValue(t *testing.T) {
+	p, s := startServer(t)
+	value := strings.Repeat("a", 255) + strings.Repeat("b", 255) + strings.Repeat("c", 190)
+	if _, err := p.Set(value); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(transport string, msg dnsmessage.Message) {
+		t.Helper()
+		if msg.Header.Truncated {
+			t.Fatalf("%s: got a truncated answer", transport)
+		}
+		got := txt(msg, "test.nds.")
+		if len(got) != 1 || len(got[0]) != 3 {
+			t.Fatalf("%s: got %v, want a record of 3 strings", transport, got)
+		}
+		for _, str := range got[0] {
+			if len(str) > 255 {
+				t.Fatalf("%s: got a string of %d bytes", transport, len(str))
+			}
+		}
+		if strings.Join(got[0], "") != value {
+			t.Fatalf("%s: the strings do not rebuild the value", transport)
+		}
+	}
+	check("tcp", exchangeTCP(t, s, query(t, "test.nds.", dnsmessage.TypeTXT, 0)))
+	check("udp+edns", exchangeUDP(t, s, query(t, "test.nds.", dnsmessage.TypeTXT, 4096)))
+}
+
+func TestTruncatedUDP(t *testing.T) {
+	p, s := startServer(t)
+	if _, err := p.Set(strings.Repeat("x", 600)); err != nil {
+		t.Fatal(err)
+	}
+
+	//without EDNS(0) an answer larger than 512 bytes does not fit UDP: the client must query again over TCP
+	msg := exchangeUDP(t, s, query(t, "test.nds.", dnsmessage.TypeTXT, 0))
+	if !msg.Header.Truncated || len(msg.Answers) != 0 {
+		t.Fatalf("got header %v with %d answers, want a truncated answer without records", msg.Header, len(msg.Answers))
+	}
+	msg = exchangeTCP(t, s, query(t, "test.nds.", dnsmessage.TypeTXT, 0))
+	if got := txt(msg, "test.nds."); msg.Header.Truncated || len(got) != 1 || strings.Join(got[0], "") != strings.Repeat("x", 600) {
+		t.Fatalf("got header %v, want the whole value over tcp", msg.Header)
+	}
+}
+
+func TestEDNSSizeClamped(t *testing.T) {
+	p, s := startServer(t)
+	if _, err := p.Set(strings.Repeat("x", 2000)); err != nil {
+		t.Fatal(err)
+	}
+
+	//a client advertising the largest size still gets no more than maxEDNSSize over UDP
+	msg := exchangeUDP(t, s, query(t, "test.nds.", dnsmessage.TypeTXT, 65535))
+	if !msg.Header.Truncated || len(msg.Answers) != 0 {
+		t.Fatalf("got header %v with %d answers, want a truncated answer without records", msg.Header, len(msg.Answers))
+	}
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT && int(rr.Header.Class) != maxEDNSSize {
+			t.Fatalf("got an advertised size of %d, want %d", rr.Header.Class, maxEDNSSize)
+		}
+	}
+	msg = exchangeTCP(t, s, query(t, "test.nds.", dnsmessage.TypeTXT, 65535))
+	if got := txt(msg, "test.nds."); msg.Header.Truncated || len(got) != 1 || strings.Join(got[0], "") != strings.Repeat("x", 2000) {
+		t.Fatalf("got header %v, want the whole value over tcp", msg.Header)
+	}
+}
+
+func TestNoValue(t *testing.T) {
+	p, s := startServer(t)
+	if _, err := p.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := exchangeUDP(t, s, query(t, "test.nds.", dnsmessage.TypeTXT, 0))
+	if msg.Header.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 || len(msg.Authorities) != 1 {
+		t.Fatalf("got %v, want no answer and the SOA of the zone", msg)
+	}
+	msg = exchangeUDP(t, s, query(t, "other.test.nds.", dnsmessage.TypeTXT, 0))
+	if msg.Header.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("got rcode %v, want NXDOMAIN", msg.Header.RCode)
+	}
+	msg = exchangeUDP(t, s, query(t, "example.com.", dnsmessage.TypeTXT, 0))
+	if msg.Header.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("got rcode %v, want REFUSED", msg.Header.RCode)
+	}
+}
@@ -0,0 +1,417 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+//Package gateway exposes the value held by a daemon node over HTTP/JSON.
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"nds/metrics"
+	"nds/peer"
+	"nds/util"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//LongPollTimeout is the longest time a GET /value?wait=<ts> waits for a change
+const LongPollTimeout = 30 * time.Second
+
+//Value is the JSON body describing the value held by the cluster
+type Value struct {
+	Ts      uint32 `json:"ts"`
+	Value   string `json:"value"`
+	Origin  string `json:"origin,omitempty"`
+	TTL     int64  `json:"ttl_ms,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+//Member is the JSON body describing a daemon node
+type Member struct {
+	NodeID  string `json:"node_id"`
+	Address string `json:"address"`
+	Port    uint   `json:"port"`
+	Ts      uint32 `json:"ts"`
+}
+
+//ACL is the JSON body describing the ACL held by a node
+type ACL struct {
+	Version uint64 `json:"version"`
+	Hash    string `json:"hash"`
+}
+
+//SettingChange is the JSON body describing a setting changed by a reload
+type SettingChange struct {
+	Setting string `json:"setting"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+}
+
+//Reload is the JSON body describing the outcome of a reload
+type Reload struct {
+	Applied         []SettingChange `json:"applied"`
+	RestartRequired []SettingChange `json:"restart_required"`
+}
+
+//Gateway serves the HTTP API of a node:
+//
+//	GET    /value[?wait=<ts>]  the value; with wait, returns once the TS differs from <ts> (304 if it never does)
+//	PUT    /value[?ttl=<dur>]  sets the value to the request body; If-Match makes it conditional on the TS
+//	DELETE /value              deletes the value; If-Match makes it conditional on the TS
+//	GET    /members            the daemon nodes of the cluster
+//	GET    /metrics            the counters of the node, in the Prometheus text format
+//	GET    /loglevel           the logging level of every component of the process
+//	PUT    /loglevel           changes logging levels, e.g. {"peer":"trace"} ("all" selects every component)
+//	POST   /reload             reads the configuration again, as on SIGHUP, applying the settings that can change live
+//
+//Responses about the value carry its TS as ETag. The gateway serves HTTPS if the node has a TLS certificate
+//(see peer.Peer.TLS); every request but GET /loglevel is checked against the ACL of the cluster.
+type Gateway struct {
+	peer     *peer.Peer
+	server   http.Server
+	listener net.Listener
+	logger   util.Logger
+}
+
+//Listen starts serving the HTTP API of p at address (e.g. ":8080"); it returns once listening
+func Listen(address string, p *peer.Peer) (*Gateway, error) {
+	g := &Gateway{peer: p}
+	if err := g.logger.Init("http.", &p.Cfg); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/value", g.serveValue)
+	mux.HandleFunc("/members", g.serveMembers)
+	mux.HandleFunc("/acl", g.serveACL)
+	mux.Handle(metrics.Path, metrics.Handler(p))
+	mux.HandleFunc("/loglevel", g.serveLogLevel)
+	mux.HandleFunc("/reload", g.serveReload)
+	g.server.Handler = mux
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		g.logger.Err("listening on %s:%s", address, err.Error())
+		return nil, err
+	}
+	g.listener = p.TLS().Listener(l)
+	g.logger.Trace("listening on %s", g.listener.Addr().String())
+
+	go func() {
+		if err := g.server.Serve(g.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			g.logger.Err("serving:%s", err.Error())
+		}
+	}()
+	return g, nil
+}
+
+//Addr returns the address the gateway listens on
+func (g *Gateway) Addr() net.Addr {
+	return g.listener.Addr()
+}
+
+//Close stops the gateway
+func (g *Gateway) Close() error {
+	err := g.server.Close()
+	g.logger.Stop()
+	return err
+}
+
+func (g *Gateway) serveValue(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		g.getValue(w, r)
+	case http.MethodPut:
+		g.putValue(w, r, false)
+	case http.MethodDelete:
+		g.putValue(w, r, true)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (g *Gateway) getValue(w http.ResponseWriter, r *http.Request) {
+	if err := g.peer.Authorize(peer.RequestCaller(r), util.ReqOpGet); err != nil {
+		writeError(w, err)
+		return
+	}
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		ts, err := strconv.ParseUint(wait, 10, 32)
+		if err != nil {
+			http.Error(w, "bad wait: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !g.waitChange(r, uint32(ts)) {
+			w.Header().Set("ETag", etag(uint32(ts)))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	e, err := g.peer.Get()
+	g.writeValue(w, e, err)
+}
+
+//waitChange waits until the value changes with respect to timestamp ts;
+//it returns false if this does not happen within LongPollTimeout.
+func (g *Gateway) waitChange(r *http.Request, ts uint32) bool {
+	ch, unwatch, err := g.peer.Watch(ts)
+	if err != nil {
+		return false
+	}
+	defer unwatch()
+
+	tm := time.NewTimer(LongPollTimeout)
+	defer tm.Stop()
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			//an expired value turns into a tombstone keeping its timestamp
+			if !ok || uint32(msg.Ts) != ts || msg.Tb {
+				return true
+			}
+		case <-tm.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+//caller returns who sent r: the bearer token of the Authorization header, the verified TLS client certificate
+func (g *Gateway) putValue(w http.ResponseWriter, r *http.Request, del bool) {
+	c := peer.Change{Delete: del, Caller: peer.RequestCaller(r)}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" {
+		ts, err := parseETag(ifMatch)
+		if err != nil {
+			http.Error(w, "bad If-Match: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.IfTS = &ts
+	}
+
+	if !del {
+		if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil || d < 0 {
+				http.Error(w, "bad ttl: "+ttl, http.StatusBadRequest)
+				return
+			}
+			c.TTL = d
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, util.MaxFrameLen+1))
+		if err != nil {
+			http.Error(w, "reading body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > util.MaxFrameLen {
+			http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		c.Value = string(body)
+	}
+
+	if ts, err := g.peer.Apply(c); err != nil {
+		w.Header().Set("ETag", etag(ts))
+		writeError(w, err)
+	} else if del {
+		g.logger.Trace("value deleted by %s, ts:%d", r.RemoteAddr, ts)
+		w.Header().Set("ETag", etag(ts))
+		writeJSON(w, http.StatusOK, Value{Ts: ts, Deleted: true})
+	} else {
+		g.logger.Trace("value changed by %s, ts:%d", r.RemoteAddr, ts)
+		e, err := g.peer.Get()
+		g.writeValue(w, e, err)
+	}
+}
+
+func (g *Gateway) writeValue(w http.ResponseWriter, e peer.HistoryEntry, err error) {
+	status := http.StatusOK
+	if err != nil {
+		var ndsErr *util.NDSError
+		if !errors.As(err, &ndsErr) || ndsErr.Code != util.RetCode_NODATA {
+			writeError(w, err)
+			return
+		}
+		status = http.StatusNotFound
+	}
+
+	if e.Ts != 0 {
+		w.Header().Set("ETag", etag(e.Ts))
+	}
+	writeJSON(w, status, Value{Ts: e.Ts, Value: e.Value, Origin: e.Origin, TTL: e.TTL.Milliseconds(), Deleted: e.Tombstone})
+}
+
+func (g *Gateway) serveMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := g.peer.Authorize(peer.RequestCaller(r), util.ReqOpMembers); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	//this node is reached at the address the client connected to
+	var address string
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		address, _, _ = net.SplitHostPort(addr.String())
+	}
+
+	self := g.peer.Self(address)
+	members := []Member{{NodeID: self.NodeID, Address: self.Address, Port: self.Port, Ts: self.Ts}}
+	for _, m := range g.peer.Members() {
+		members = append(members, Member{NodeID: m.NodeID, Address: m.Address, Port: m.Port, Ts: m.Ts})
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+//serveACL tells the version and hash of the ACL held by the node, which the daemons converge on
+func (g *Gateway) serveACL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := g.peer.Authorize(peer.RequestCaller(r), util.ReqOpACL); err != nil {
+		writeError(w, err)
+		return
+	}
+	acl := g.peer.ACL()
+	if acl == nil {
+		http.Error(w, "no acl", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, ACL{Version: acl.Version, Hash: acl.Hash()})
+}
+
+func (g *Gateway) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		if err := g.peer.Authorize(peer.RequestCaller(r), peer.OpLogLevel); err != nil {
+			writeError(w, err)
+			return
+		}
+		levels := make(map[string]string)
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&levels); err != nil {
+			http.Error(w, "body must be a JSON object, e.g. {\"peer\":\"trace\"}", http.StatusBadRequest)
+			return
+		}
+		for class, level := range levels {
+			if err := util.SetLogLevel(class, level); err != nil {
+				var ndsErr *util.NDSError
+				if errors.As(err, &ndsErr) && ndsErr.Code == util.RetCode_NOTFOUND {
+					http.Error(w, "unknown component: "+class, http.StatusNotFound)
+				} else {
+					http.Error(w, "unknown level: "+level, http.StatusBadRequest)
+				}
+				return
+			}
+			g.logger.Info("log level of %s changed to %s", class, level)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, util.LogLevels())
+}
+
+func (g *Gateway) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := g.peer.Authorize(peer.RequestCaller(r), peer.OpReload); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	g.logger.Info("reload asked by %s", r.RemoteAddr)
+	changes, err := g.peer.Reload()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := Reload{Applied: []SettingChange{}, RestartRequired: []SettingChange{}}
+	for _, c := range changes {
+		if c.Reloadable {
+			resp.Applied = append(resp.Applied, SettingChange{Setting: c.Setting, Old: c.Old, New: c.New})
+		} else {
+			resp.RestartRequired = append(resp.RestartRequired, SettingChange{Setting: c.Setting, Old: c.Old, New: c.New})
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func etag(ts uint32) string {
+	return strconv.Quote(strconv.FormatUint(uint64(ts), 10))
+}
+
+//parseETag parses a TS sent back by a client as ETag: quoted as sent, or bare
+func parseETag(tag string) (uint32, error) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	if unquoted, err := strconv.Unquote(tag); err == nil {
+		tag = unquoted
+	}
+	ts, err := strconv.ParseUint(tag, 10, 32)
+	return uint32(ts), err
+}
+
+//writeError maps err on an HTTP status
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var ndsErr *util.NDSError
+	if errors.As(err, &ndsErr) {
+		switch ndsErr.Code {
+		case util.RetCode_NODATA:
+			status = http.StatusNotFound
+		case util.RetCode_TSMISMT:
+			status = http.StatusPreconditionFailed
+		case util.RetCode_DENIED:
+			status = http.StatusForbidden
+		case util.RetCode_UNVRSC:
+			status = http.StatusServiceUnavailable
+		case util.RetCode_BADCFG:
+			status = http.StatusUnprocessableEntity
+		case util.RetCode_UNSP:
+			status = http.StatusNotImplemented
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
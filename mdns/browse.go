@@ -0,0 +1,165 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package mdns
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//QueryPeriod is the time between two queries sent by Browse
+const QueryPeriod = time.Second
+
+//Node is a daemon node found on the link
+type Node struct {
+	//the DNS-SD instance name, e.g. nds-5f3a09c2._nds._tcp.local.
+	Instance string
+
+	NodeID  string
+	Address string
+	Port    uint
+
+	//the TS held by the node when it answered
+	Ts uint32
+}
+
+//instance gathers the records of an instance, which may come in different packets
+type instance struct {
+	host  string
+	port  uint16
+	txt   map[string]string
+	found string
+}
+
+//Browse queries the link for the daemon nodes advertised via mDNS and passes them to found
+//until it returns true or ctx is done; a node is passed again when its TS changes.
+//Queries are one-shot (RFC 6762 section 5.1): Browse needs neither the mDNS port nor a group membership,
+//so it works alongside the mDNS responder of the host.
+func Browse(ctx context.Context, found func(Node) bool) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32())},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(Service), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+		},
+	}
+	buff, err := query.Pack()
+	if err != nil {
+		return err
+	}
+
+	instances := make(map[string]*instance)
+	addrs := make(map[string]string)
+	get := func(name string) *instance {
+		name = strings.ToLower(name)
+		if instances[name] == nil {
+			instances[name] = &instance{txt: make(map[string]string)}
+		}
+		return instances[name]
+	}
+
+	resp := make([]byte, 9000)
+	var next time.Time
+	for {
+		if now := time.Now(); !now.Before(next) {
+			if _, err := conn.WriteToUDP(buff, Group); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+			next = now.Add(QueryPeriod)
+			conn.SetReadDeadline(next)
+		}
+
+		nread, err := conn.Read(resp)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(resp[:nread]); err != nil || !msg.Header.Response {
+			continue
+		}
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			name := rr.Header.Name.String()
+			switch body := rr.Body.(type) {
+			case *dnsmessage.PTRResource:
+				if strings.EqualFold(name, Service) {
+					get(body.PTR.String())
+				}
+			case *dnsmessage.SRVResource:
+				in := get(name)
+				in.host, in.port = strings.ToLower(body.Target.String()), body.Port
+			case *dnsmessage.TXTResource:
+				in := get(name)
+				for _, kv := range body.TXT {
+					if i := strings.IndexByte(kv, '='); i > 0 {
+						in.txt[kv[:i]] = kv[i+1:]
+					}
+				}
+			case *dnsmessage.AResource:
+				addrs[strings.ToLower(name)] = net.IP(body.A[:]).String()
+			}
+		}
+
+		for name, in := range instances {
+			addr, ok := addrs[in.host]
+			if !ok || in.port == 0 || in.txt["ni"] == "" || in.txt["ts"] == in.found {
+				continue
+			}
+			ts, _ := strconv.ParseUint(in.txt["ts"], 10, 32)
+			in.found = in.txt["ts"]
+			if found(Node{Instance: name, NodeID: in.txt["ni"], Address: addr, Port: uint(in.port), Ts: uint32(ts)}) {
+				return nil
+			}
+		}
+	}
+}
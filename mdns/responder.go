@@ -0,0 +1,395 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+//Package mdns advertises daemon nodes on the local link via mDNS/DNS-SD (RFC 6762, RFC 6763),
+//so that standard tools (avahi-browse, dns-sd) and clients can find them without knowing the multicast group.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"nds/peer"
+	"nds/util"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+//Group is the address mDNS queries and announcements are sent to
+var Group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+//Service is the DNS-SD service type advertised by daemon nodes
+const Service = "_nds._tcp.local."
+
+//servicesEnum is the DNS-SD meta query enumerating the service types available on the link
+const servicesEnum = "_services._dns-sd._udp.local."
+
+const (
+	//record TTLs (RFC 6762 section 10): records naming a host live shorter than the others
+	hostTTL    = 120
+	serviceTTL = 4500
+
+	//TTL bound for the answers to one-shot (legacy unicast) queries (RFC 6762 section 6.7)
+	legacyTTL = 10
+
+	//class bit telling caches that these records replace any other with the same name and type
+	cacheFlush = 1 << 15
+
+	//class bit asking for a unicast response
+	unicastResponse = 1 << 15
+)
+
+/**
+ * Responder advertises a daemon node as the DNS-SD instance nds-<node id>._nds._tcp.local.:
+ *
+ *     _nds._tcp.local.                 PTR  nds-5f3a09c2._nds._tcp.local.
+ *     nds-5f3a09c2._nds._tcp.local.    SRV  0 0 31582 nds-5f3a09c2.local.
+ *     nds-5f3a09c2._nds._tcp.local.    TXT  "ni=5f3a09c2" "ts=1612981862"
+ *     nds-5f3a09c2.local.              A    172.17.0.2
+ *
+ * The SRV port is the one the node actually listens on, the TXT records carry the TS currently held:
+ * every time it advances the records are announced again, flushing the caches of the link.
+ * Names are not probed for conflicts: node identifiers are unique within the cluster.
+ */
+type Responder struct {
+	peer   *peer.Peer
+	logger util.Logger
+
+	nodeID   string
+	port     uint16
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+
+	pconn net.PacketConn
+	conn  *ipv4.PacketConn
+	intfs []net.Interface
+
+	quit          chan struct{}
+	closeOnce     sync.Once
+	announcerDone chan struct{}
+	serveDone     chan struct{}
+}
+
+//Advertise starts advertising the started daemon node p; it returns once the responder has joined the mDNS group
+func Advertise(p *peer.Peer) (*Responder, error) {
+	self := p.Self("")
+	r := &Responder{
+		peer:   p,
+		nodeID: self.NodeID,
+		port:   uint16(self.Port),
+		quit:   make(chan struct{}),
+
+		announcerDone: make(chan struct{}),
+		serveDone:     make(chan struct{}),
+	}
+	if err := r.logger.Init("mdns.", &p.Cfg); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if r.instance, err = dnsmessage.NewName("nds-" + r.nodeID + "." + Service); err != nil {
+		return nil, err
+	}
+	if r.host, err = dnsmessage.NewName("nds-" + r.nodeID + ".local."); err != nil {
+		return nil, err
+	}
+
+	if err := r.join(); err != nil {
+		if r.pconn != nil {
+			r.pconn.Close()
+		}
+		r.logger.Stop()
+		return nil, err
+	}
+
+	go r.serve()
+	go r.announcer()
+	return r, nil
+}
+
+//join binds the mDNS port, shared with any other responder of the host, and joins the group
+//on every multicast capable interface
+func (r *Responder) join() error {
+	config := &net.ListenConfig{Control: reuseAddr}
+	var err error
+	if r.pconn, err = config.ListenPacket(context.Background(), "udp4", "0.0.0.0:"+strconv.Itoa(Group.Port)); err != nil {
+		r.logger.Err("ListenPacket:%s", err.Error())
+		return err
+	}
+	r.conn = ipv4.NewPacketConn(r.pconn)
+
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, intf := range intfs {
+		if intf.Flags&net.FlagUp == 0 || intf.Flags&net.FlagMulticast == 0 || intf.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if err := r.conn.JoinGroup(&intf, Group); err != nil {
+			r.logger.Warn("JoinGroup on %s:%s", intf.Name, err.Error())
+			continue
+		}
+		r.logger.Trace("joined %s on %s", Group.String(), intf.Name)
+		r.intfs = append(r.intfs, intf)
+	}
+	if len(r.intfs) == 0 {
+		r.logger.Err("no interface could join %s", Group.String())
+		return &util.NDSError{Code: util.RetCode_UNVRSC}
+	}
+
+	if err := r.conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		r.logger.Err("SetControlMessage:%s", err.Error())
+		return err
+	}
+	//RFC 6762 section 11: packets whose TTL is not 255 may be discarded
+	if err := r.conn.SetMulticastTTL(255); err != nil {
+		r.logger.Err("SetMulticastTTL:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func reuseAddr(network, address string, conn syscall.RawConn) error {
+	return conn.Control(func(descriptor uintptr) {
+		if err := syscall.SetsockoptInt(int(descriptor), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			util.DefLog().Err("SetsockoptInt:SO_REUSEADDR - %s", err.Error())
+		}
+	})
+}
+
+//Close withdraws the advertisement (sending goodbye records) and stops the responder
+func (r *Responder) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.quit)
+		<-r.announcerDone
+		r.announce(0)
+		r.pconn.Close()
+		<-r.serveDone
+		r.logger.Stop()
+	})
+	return nil
+}
+
+//announcer announces the records at start (twice, RFC 6762 section 8.3) and every time the TS advances
+func (r *Responder) announcer() {
+	defer close(r.announcerDone)
+	ch, unwatch, err := r.peer.Watch(r.peer.Self("").Ts)
+	if err != nil {
+		r.logger.Err("watching the node:%s", err.Error())
+		return
+	}
+	defer func() { unwatch() }()
+
+	r.announce(serviceTTL)
+	again := time.NewTimer(time.Second)
+	defer again.Stop()
+
+	for {
+		select {
+		case <-again.C:
+		case msg, ok := <-ch:
+			if !ok {
+				//fell behind: only the latest TS matters
+				unwatch()
+				if ch, unwatch, err = r.peer.Watch(r.peer.Self("").Ts); err != nil {
+					unwatch = func() {}
+					r.logger.Err("watching the node:%s", err.Error())
+					return
+				}
+				break
+			}
+			r.logger.Trace("ts advanced to:%d", msg.Ts)
+		case <-r.quit:
+			return
+		}
+		r.announce(serviceTTL)
+	}
+}
+
+//announce multicasts all the records on every interface; a ttl of 0 withdraws them
+func (r *Responder) announce(ttl uint32) {
+	for i := range r.intfs {
+		intf := &r.intfs[i]
+		ptr, srv, txt, as := r.records(intf, false)
+		answers := append([]dnsmessage.Resource{ptr, srv, txt}, as...)
+		for i := range answers {
+			if answers[i].Header.TTL > ttl {
+				answers[i].Header.TTL = ttl
+			}
+		}
+		r.send(intf, dnsmessage.Message{
+			Header:  dnsmessage.Header{Response: true, Authoritative: true},
+			Answers: answers,
+		}, Group)
+	}
+}
+
+//records returns the records of this node as seen from intf;
+//legacy answers must not set the cache flush bit and get short TTLs
+func (r *Responder) records(intf *net.Interface, legacy bool) (ptr, srv, txt dnsmessage.Resource, as []dnsmessage.Resource) {
+	class, ttl, addrTTL := dnsmessage.ClassINET|cacheFlush, uint32(serviceTTL), uint32(hostTTL)
+	if legacy {
+		class, ttl, addrTTL = dnsmessage.ClassINET, legacyTTL, legacyTTL
+	}
+
+	ptr = dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(Service), Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.PTRResource{PTR: r.instance},
+	}
+	srv = dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: r.instance, Class: class, TTL: addrTTL},
+		Body:   &dnsmessage.SRVResource{Port: r.port, Target: r.host},
+	}
+	txt = dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: r.instance, Class: class, TTL: ttl},
+		Body: &dnsmessage.TXTResource{TXT: []string{
+			"ni=" + r.nodeID,
+			"ts=" + strconv.FormatUint(uint64(r.peer.Self("").Ts), 10),
+		}},
+	}
+
+	addrs, _ := intf.Addrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		a := dnsmessage.AResource{}
+		copy(a.A[:], ipnet.IP.To4())
+		as = append(as, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: r.host, Class: class, TTL: addrTTL},
+			Body:   &a,
+		})
+	}
+	return
+}
+
+//answer returns the answers to questions, along with the additional records the querier will likely need
+func (r *Responder) answer(questions []dnsmessage.Question, intf *net.Interface, legacy bool) (answers, additionals []dnsmessage.Resource) {
+	ptr, srv, txt, as := r.records(intf, legacy)
+	want := func(q dnsmessage.Question, t dnsmessage.Type) bool {
+		return q.Type == t || q.Type == dnsmessage.TypeALL
+	}
+
+	for _, q := range questions {
+		switch name := q.Name.String(); {
+		case strings.EqualFold(name, servicesEnum) && want(q, dnsmessage.TypePTR):
+			answers = append(answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ptr.Header.TTL},
+				Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(Service)},
+			})
+		case strings.EqualFold(name, Service) && want(q, dnsmessage.TypePTR):
+			answers = append(answers, ptr)
+			additionals = append(append(additionals, srv, txt), as...)
+		case strings.EqualFold(name, r.instance.String()):
+			if want(q, dnsmessage.TypeSRV) {
+				answers = append(answers, srv)
+				additionals = append(additionals, as...)
+			}
+			if want(q, dnsmessage.TypeTXT) {
+				answers = append(answers, txt)
+			}
+		case strings.EqualFold(name, r.host.String()) && want(q, dnsmessage.TypeA):
+			answers = append(answers, as...)
+		}
+	}
+	return
+}
+
+func (r *Responder) serve() {
+	defer close(r.serveDone)
+	buff := make([]byte, 9000)
+	for {
+		nread, cm, src, err := r.conn.ReadFrom(buff)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.logger.Err("ReadFrom:%s", err.Error())
+			continue
+		}
+
+		var query dnsmessage.Message
+		if err := query.Unpack(buff[:nread]); err != nil {
+			r.logger.Trace("malformed packet from %s:%s", src.String(), err.Error())
+			continue
+		}
+		srcAddr, ok := src.(*net.UDPAddr)
+		if query.Header.Response || cm == nil || !ok {
+			continue
+		}
+		intf, err := net.InterfaceByIndex(cm.IfIndex)
+		if err != nil {
+			continue
+		}
+
+		//queries not sent from the mDNS port come from one-shot resolvers (RFC 6762 section 6.7)
+		legacy := srcAddr.Port != Group.Port
+		answers, additionals := r.answer(query.Questions, intf, legacy)
+		if len(answers) == 0 {
+			continue
+		}
+		r.logger.Trace("answering %d records to %s", len(answers), srcAddr.String())
+
+		resp := dnsmessage.Message{
+			Header:      dnsmessage.Header{Response: true, Authoritative: true},
+			Answers:     answers,
+			Additionals: additionals,
+		}
+		dst := Group
+		if legacy {
+			resp.Header.ID = query.Header.ID
+			resp.Questions = query.Questions
+			dst = srcAddr
+		} else if unicastOnly(query.Questions) {
+			dst = srcAddr
+		}
+		r.send(intf, resp, dst)
+	}
+}
+
+//unicastOnly reports whether all the questions ask for a unicast response
+func unicastOnly(questions []dnsmessage.Question) bool {
+	for _, q := range questions {
+		if q.Class&unicastResponse == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Responder) send(intf *net.Interface, msg dnsmessage.Message, dst *net.UDPAddr) {
+	buff, err := msg.Pack()
+	if err != nil {
+		r.logger.Err("Pack:%s", err.Error())
+		return
+	}
+	if _, err := r.conn.WriteTo(buff, &ipv4.ControlMessage{IfIndex: intf.Index}, dst); err != nil {
+		r.logger.Err("WriteTo:%s", err.Error())
+	}
+}
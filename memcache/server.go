@@ -0,0 +1,429 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+//Package memcache exposes the value held by a daemon node through the memcached ASCII protocol.
+package memcache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"nds/peer"
+	"nds/util"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Key is the only key available: it holds the value shared across the cluster
+const Key = "nds"
+
+//exptime values greater than this are absolute unix times, as in memcached
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+const (
+	//the longest command line accepted, as in memcached
+	maxLineLen = 2048
+
+	//the largest value accepted, the default item size limit of memcached
+	maxItemSize = 1024 * 1024
+
+	//times delete tries to drop a value replaced while it was deleting it
+	maxDeleteAttempts = 3
+)
+
+//Server serves the commands:
+//
+//	get|gets <key>*                                           the cas unique of the value is its TS
+//	set <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+//	delete <key> [noreply]
+//	stats, version, quit
+//
+//Flags are not retained: values are returned with flags 0. Command lines are at most 2048 bytes long
+//and values at most 1MB large.
+//The connections are secured with TLS if the node has a certificate (see peer.Peer.TLS); get, gets, set, cas, delete
+//and stats are checked against the ACL of the cluster.
+type Server struct {
+	peer     *peer.Peer
+	listener net.Listener
+	logger   util.Logger
+
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+
+	//counters
+	totalConns uint64
+	cmdGet     uint64
+	getHits    uint64
+	getMisses  uint64
+	cmdSet     uint64
+	casHits    uint64
+	casBadval  uint64
+	casMisses  uint64
+	deleteHits uint64
+	deleteMiss uint64
+}
+
+//Listen starts serving p at address (e.g. ":11211"); it returns once listening
+func Listen(address string, p *peer.Peer) (*Server, error) {
+	s := &Server{peer: p, conns: make(map[net.Conn]struct{})}
+	if err := s.logger.Init("memc.", &p.Cfg); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		s.logger.Err("listening on %s:%s", address, err.Error())
+		return nil, err
+	}
+	s.listener = p.TLS().Listener(l)
+	s.logger.Trace("listening on %s", s.listener.Addr().String())
+
+	go s.accept()
+	return s, nil
+}
+
+//Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+//Close stops the server and drops its connections
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mtx.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mtx.Unlock()
+	s.logger.Stop()
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Err("accepting connection:%s", err.Error())
+			}
+			return
+		}
+		atomic.AddUint64(&s.totalConns, 1)
+		s.mtx.Lock()
+		s.conns[conn] = struct{}{}
+		s.mtx.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+		conn.Close()
+	}()
+
+	//the memcached protocol has no authentication: its clients are anonymous to the ACL,
+	//unless they present a TLS client certificate
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			s.logger.Err("handshake with %s:%s", conn.RemoteAddr().String(), err.Error())
+			return
+		}
+	}
+	caller := peer.ConnCaller(conn, "")
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if errors.Is(err, errLineTooLong) {
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		} else if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Err("reading command from %s:%s", conn.RemoteAddr().String(), err.Error())
+			}
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else {
+			switch args[0] {
+			case "get", "gets":
+				s.get(w, caller, args[1:], args[0] == "gets")
+			case "set", "cas":
+				if !s.store(r, w, caller, args[0], args[1:]) {
+					w.Flush()
+					return
+				}
+			case "delete":
+				s.delete(w, caller, args[1:])
+			case "stats":
+				s.stats(w, caller)
+			case "version":
+				w.WriteString("VERSION nds\r\n")
+			case "quit":
+				w.Flush()
+				return
+			default:
+				w.WriteString("ERROR\r\n")
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+var errLineTooLong = errors.New("line too long")
+
+//readLine reads a command line of at most maxLineLen bytes
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineLen {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			return string(line), nil
+		} else if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+}
+
+func (s *Server) get(w *bufio.Writer, caller peer.Caller, keys []string, withCas bool) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	if err := s.peer.Authorize(caller, util.ReqOpGet); err != nil {
+		w.WriteString(errorReply(err) + "\r\n")
+		return
+	}
+	for _, key := range keys {
+		atomic.AddUint64(&s.cmdGet, 1)
+		e, err := s.peer.Get()
+		if key != Key || err != nil {
+			atomic.AddUint64(&s.getMisses, 1)
+			continue
+		}
+		atomic.AddUint64(&s.getHits, 1)
+		if withCas {
+			fmt.Fprintf(w, "VALUE %s 0 %d %d\r\n", key, len(e.Value), e.Ts)
+		} else {
+			fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, len(e.Value))
+		}
+		w.WriteString(e.Value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+//store serves set and cas; it returns false if the connection must be closed
+func (s *Server) store(r *bufio.Reader, w *bufio.Writer, caller peer.Caller, cmd string, args []string) bool {
+	nargs := 4
+	if cmd == "cas" {
+		nargs = 5
+	}
+	noreply := len(args) == nargs+1 && args[nargs] == "noreply"
+	if len(args) != nargs && !noreply {
+		w.WriteString("ERROR\r\n")
+		return true
+	}
+
+	exptime, err1 := strconv.ParseInt(args[2], 10, 64)
+	size, err2 := strconv.Atoi(args[3])
+	if _, err := strconv.ParseUint(args[1], 10, 32); err != nil || err1 != nil || err2 != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+
+	//the data block of a value refused is skipped, as memcached does, without holding it
+	if size > maxItemSize {
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		_, err := io.CopyN(io.Discard, r, int64(size)+2)
+		return err == nil
+	}
+	if err := s.peer.Authorize(caller, util.ReqOpSet); err != nil {
+		w.WriteString(errorReply(err) + "\r\n")
+		_, err := io.CopyN(io.Discard, r, int64(size)+2)
+		return err == nil
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return false
+	}
+	if string(data[size:]) != "\r\n" {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+
+	c := peer.Change{Value: string(data[:size]), Caller: caller}
+	if cmd == "cas" {
+		ts, err := strconv.ParseUint(args[4], 10, 32)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+		ifTS := uint32(ts)
+		c.IfTS = &ifTS
+	}
+	switch {
+	case exptime < 0:
+		//already expired
+		c.Delete = true
+	case exptime > maxRelativeExptime:
+		if c.TTL = time.Until(time.Unix(exptime, 0)); c.TTL <= 0 {
+			c.Delete = true
+		}
+	default:
+		c.TTL = time.Duration(exptime) * time.Second
+	}
+
+	reply := "STORED"
+	atomic.AddUint64(&s.cmdSet, 1)
+	if Key != args[0] {
+		reply = "SERVER_ERROR only key '" + Key + "' is available"
+	} else if _, err := s.peer.Apply(c); err != nil {
+		var ndsErr *util.NDSError
+		switch {
+		case errors.As(err, &ndsErr) && ndsErr.Code == util.RetCode_TSMISMT:
+			//the value changed since it was read, or there is no value anymore
+			if _, err := s.peer.Get(); err != nil {
+				atomic.AddUint64(&s.casMisses, 1)
+				reply = "NOT_FOUND"
+			} else {
+				atomic.AddUint64(&s.casBadval, 1)
+				reply = "EXISTS"
+			}
+		default:
+			reply = errorReply(err)
+		}
+	} else if cmd == "cas" {
+		atomic.AddUint64(&s.casHits, 1)
+	}
+
+	if !noreply {
+		w.WriteString(reply + "\r\n")
+	}
+	return true
+}
+
+//errorReply is the reply to a failed command
+func errorReply(err error) string {
+	var ndsErr *util.NDSError
+	if errors.As(err, &ndsErr) && ndsErr.Code == util.RetCode_DENIED {
+		return "CLIENT_ERROR permission denied"
+	}
+	return "SERVER_ERROR " + err.Error()
+}
+
+func (s *Server) delete(w *bufio.Writer, caller peer.Caller, args []string) {
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if len(args) != 1 && !noreply {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+
+	//the tombstone is conditioned on the TS of the value read: a value deleted meanwhile is not found,
+	//a value set meanwhile is read again before being dropped
+	reply := "DELETED"
+	for attempt := 1; ; attempt++ {
+		e, err := s.peer.Get()
+		if args[0] != Key || err != nil {
+			atomic.AddUint64(&s.deleteMiss, 1)
+			reply = "NOT_FOUND"
+			break
+		}
+		_, err = s.peer.Apply(peer.Change{Delete: true, IfTS: &e.Ts, Caller: caller})
+		if err == nil {
+			atomic.AddUint64(&s.deleteHits, 1)
+			break
+		} else if !errors.Is(err, &util.NDSError{Code: util.RetCode_TSMISMT}) || attempt == maxDeleteAttempts {
+			reply = errorReply(err)
+			break
+		}
+	}
+
+	if !noreply {
+		w.WriteString(reply + "\r\n")
+	}
+}
+
+func (s *Server) stats(w *bufio.Writer, caller peer.Caller) {
+	if err := s.peer.Authorize(caller, util.ReqOpMembers); err != nil {
+		w.WriteString(errorReply(err) + "\r\n")
+		return
+	}
+	ps := s.peer.Stats()
+	s.mtx.Lock()
+	currConns := len(s.conns)
+	s.mtx.Unlock()
+
+	stat := func(name string, value interface{}) {
+		fmt.Fprintf(w, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(time.Since(ps.Started).Seconds()))
+	stat("time", time.Now().Unix())
+	stat("version", "nds")
+	stat("curr_connections", currConns)
+	stat("total_connections", atomic.LoadUint64(&s.totalConns))
+	stat("cmd_get", atomic.LoadUint64(&s.cmdGet))
+	stat("cmd_set", atomic.LoadUint64(&s.cmdSet))
+	stat("get_hits", atomic.LoadUint64(&s.getHits))
+	stat("get_misses", atomic.LoadUint64(&s.getMisses))
+	stat("cas_hits", atomic.LoadUint64(&s.casHits))
+	stat("cas_badval", atomic.LoadUint64(&s.casBadval))
+	stat("cas_misses", atomic.LoadUint64(&s.casMisses))
+	stat("delete_hits", atomic.LoadUint64(&s.deleteHits))
+	stat("delete_misses", atomic.LoadUint64(&s.deleteMiss))
+	curr := 0
+	if _, err := s.peer.Get(); err == nil {
+		curr = 1
+	}
+	stat("curr_items", curr)
+	stat("nds_ts", ps.Ts)
+	stat("nds_desired_ts", ps.DesiredTs)
+	stat("nds_members", ps.Members)
+	stat("nds_watchers", ps.Watchers)
+	stat("nds_updates", ps.Updates)
+	stat("nds_alives_sent", ps.AlivesSent)
+	stat("nds_alives_received", ps.AlivesReceived)
+	stat("nds_pulls", ps.Pulls)
+	stat("nds_pulls_failed", ps.PullsFailed)
+	w.WriteString("END\r\n")
+}
@@ -0,0 +1,168 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+//Package metrics exposes the counters of a node in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"nds/peer"
+	"nds/util"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+//Path is where the metrics are served
+const Path = "/metrics"
+
+//contentType is the one of the Prometheus text exposition format, version 0.0.4
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//Handler returns the handler serving the metrics of p, to the callers the ACL of the cluster lets read the members
+func Handler(p *peer.Peer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := p.Authorize(peer.RequestCaller(r), util.ReqOpMembers); err != nil {
+			if errors.Is(err, &util.NDSError{Code: util.RetCode_DENIED}) {
+				http.Error(w, "permission denied", http.StatusForbidden)
+			} else {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		bw := bufio.NewWriter(w)
+		write(bw, p.NodeID, p.Stats())
+		bw.Flush()
+	})
+}
+
+//metric writes the HELP and TYPE lines of a metric, followed by its samples
+func metric(w *bufio.Writer, name, typ, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range samples {
+		if f, ok := s.value.(float64); ok {
+			fmt.Fprintf(w, "%s%s %s\n", name, s.suffix, strconv.FormatFloat(f, 'f', -1, 64))
+		} else {
+			fmt.Fprintf(w, "%s%s %v\n", name, s.suffix, s.value)
+		}
+	}
+}
+
+//sample is a value of a metric; suffix holds the name suffix and/or the labels (e.g. _sum, {transport="tcp"})
+type sample struct {
+	suffix string
+	value  interface{}
+}
+
+func value(v interface{}) sample {
+	return sample{value: v}
+}
+
+func write(w *bufio.Writer, nodeID string, s peer.Stats) {
+	metric(w, "nds_node_info", "gauge", "The identifier of the node.",
+		sample{fmt.Sprintf("{node_id=%q}", nodeID), 1})
+	metric(w, "nds_start_time_seconds", "gauge", "The time the node started, in seconds since the epoch.",
+		value(float64(s.Started.UnixNano())/1e9))
+	metric(w, "nds_listening_port", "gauge", "The TCP port the node listens on (it may have been auto-adjusted).",
+		value(s.Port))
+
+	metric(w, "nds_ts", "gauge", "The timestamp held by the node.", value(s.Ts))
+	metric(w, "nds_desired_ts", "gauge", "The timestamp the node is synching to.", value(s.DesiredTs))
+	metric(w, "nds_members", "gauge", "The daemon nodes known by the node, the node excluded.", value(s.Members))
+	metric(w, "nds_watchers", "gauge", "The sessions watching the value of the node.", value(s.Watchers))
+	metric(w, "nds_updates_total", "counter", "Values (or tombstones) taken by the node, set by it or pulled from other nodes.",
+		value(s.Updates))
+
+	metric(w, "nds_alives_sent_total", "counter", "Alive messages sent by the node.", value(s.AlivesSent))
+	metric(w, "nds_alives_received_total", "counter", "Alive messages received from other nodes.", value(s.AlivesReceived))
+	metric(w, "nds_multicast_packets_sent_total", "counter", "Packets sent to the multicast group.",
+		value(s.Network.PacketsSent))
+	metric(w, "nds_multicast_packets_received_total", "counter", "Packets received from the multicast group.",
+		value(s.Network.PacketsReceived))
+	metric(w, "nds_malformed_packets_total", "counter", "Packets that could not be decoded.",
+		sample{`{transport="multicast"}`, s.Network.Malformed},
+		sample{`{transport="tcp"}`, s.Malformed})
+	metric(w, "nds_dropped_packets_total", "counter", "Packets dropped because not authenticated (RetCode_DRPPKT).",
+		sample{`{transport="multicast"}`, s.Network.Dropped},
+		sample{`{transport="tcp"}`, s.Dropped})
+	metric(w, "nds_connections_accepted_total", "counter", "TCP connections accepted by the node.", value(s.Network.Accepted))
+
+	metric(w, "nds_sync_attempts_total", "counter", "Data requests sent to other nodes to synch with them.", value(s.Pulls))
+	metric(w, "nds_sync_successes_total", "counter", "Data requests that brought a value.", value(s.PullsSucceeded))
+	metric(w, "nds_sync_failures_total", "counter", "Data requests that failed.", value(s.PullsFailed))
+	metric(w, "nds_sync_bytes_total", "counter", "Bytes received by data requests.", value(s.PullBytes))
+	metric(w, "nds_sync_duration_seconds", "summary", "Time spent by data requests.",
+		sample{"_sum", s.PullTime.Seconds()},
+		sample{"_count", s.PullsSucceeded + s.PullsFailed})
+}
+
+//Server serves the metrics of a node on a dedicated address
+type Server struct {
+	server   http.Server
+	listener net.Listener
+	logger   util.Logger
+}
+
+//Listen starts serving the metrics of p at address (e.g. ":9100"); it returns once listening
+func Listen(address string, p *peer.Peer) (*Server, error) {
+	s := &Server{}
+	if err := s.logger.Init("mtrc.", &p.Cfg); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(Path, Handler(p))
+	s.server.Handler = mux
+
+	var err error
+	if s.listener, err = net.Listen("tcp", address); err != nil {
+		s.logger.Err("listening on %s:%s", address, err.Error())
+		return nil, err
+	}
+	s.logger.Trace("listening on %s", s.listener.Addr().String())
+
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Err("serving:%s", err.Error())
+		}
+	}()
+	return s, nil
+}
+
+//Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+//Close stops the server
+func (s *Server) Close() error {
+	err := s.server.Close()
+	s.logger.Stop()
+	return err
+}
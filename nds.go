@@ -21,24 +21,256 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"nds/dns"
+	"nds/gateway"
+	"nds/mdns"
+	"nds/memcache"
+	"nds/metrics"
 	"nds/peer"
+	"nds/resp"
+	"nds/rpc"
+	"nds/util"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-var pr peer.Peer
+//process exit codes (2 is used by flag for bad usage, so it is for a bad configuration)
+const (
+	exitOK         = 0
+	exitErr        = 1
+	exitBadCfg     = 2
+	exitTSMismatch = 3
+	exitDenied     = 4
+)
 
-func main() {
-	flag.BoolVar(&pr.Cfg.StartNode, "n", false, "spawn a new node")
-	flag.StringVar(&pr.Cfg.MulticastAddress, "j", "232.232.200.82", "join the cluster at specified multicast group")
-	flag.UintVar(&pr.Cfg.MulticastPort, "jp", 8745, "join the cluster at specified multicast group")
-	flag.UintVar(&pr.Cfg.ListeningPort, "p", 31582, "listen on the specified port")
+func exitCode(err error) int {
+	var ndsErr *util.NDSError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitBadCfg
+	case errors.As(err, &ndsErr) && ndsErr.Code == util.RetCode_TSMISMT:
+		return exitTSMismatch
+	case errors.As(err, &ndsErr) && ndsErr.Code == util.RetCode_DENIED:
+		return exitDenied
+	case errors.As(err, &ndsErr) && ndsErr.Code == util.RetCode_BADCFG:
+		return exitBadCfg
+	default:
+		return exitErr
+	}
+}
+
+var cfg util.Config
+
+//runDaemon runs pr as a daemon node, along with the front-ends configured, until it is interrupted
+func runDaemon(pr *peer.Peer) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	//SIGHUP reopens the log files, as logrotate expects, and reloads the configuration;
+	//SIGUSR1 turns trace logging on for every component, SIGUSR2 restores the configured levels
+	pr.SetReloader(rereadConfig)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				switch sig {
+				case syscall.SIGHUP:
+					if err := util.ReopenLogs(); err != nil {
+						util.DefLog().Err("reopening log files:%s", err.Error())
+					}
+					//the outcome is logged by the node
+					pr.Reload()
+				case syscall.SIGUSR1:
+					util.SetLogLevel(util.LogClassAll, util.TraceStr)
+				case syscall.SIGUSR2:
+					util.ResetLogLevels()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := pr.Start(ctx); err != nil {
+		return err
+	}
+	if cfg.HTTPAddress != "" {
+		gw, err := gateway.Listen(cfg.HTTPAddress, pr)
+		if err != nil {
+			pr.Close()
+			return err
+		}
+		defer gw.Close()
+	}
+	if cfg.GRPCAddress != "" {
+		srv, err := rpc.Listen(cfg.GRPCAddress, pr)
+		if err != nil {
+			pr.Close()
+			return err
+		}
+		defer srv.Close()
+	}
+	if cfg.MemcacheAddress != "" {
+		srv, err := memcache.Listen(cfg.MemcacheAddress, pr)
+		if err != nil {
+			pr.Close()
+			return err
+		}
+		defer srv.Close()
+	}
+	if cfg.RESPAddress != "" {
+		srv, err := resp.Listen(cfg.RESPAddress, pr)
+		if err != nil {
+			pr.Close()
+			return err
+		}
+		defer srv.Close()
+	}
+	if cfg.DNSAddress != "" {
+		srv, err := dns.Listen(cfg.DNSAddress, cfg.DNSCluster, pr)
+		if err != nil {
+			pr.Close()
+			return err
+		}
+		defer srv.Close()
+	}
+	if cfg.MetricsAddress != "" {
+		srv, err := metrics.Listen(cfg.MetricsAddress, pr)
+		if err != nil {
+			pr.Close()
+			return err
+		}
+		defer srv.Close()
+	}
+	if cfg.MDNS {
+		r, err := mdns.Advertise(pr)
+		if err != nil {
+			pr.Close()
+			return err
+		}
+		defer r.Close()
+	}
+	return pr.Wait()
+}
+
+//runPeer runs a node configured by cfg: a daemon node runs until interrupted, the other ones until their job is done
+func runPeer() error {
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "nds:", err.Error())
+		return err
+	}
 
-	flag.StringVar(&pr.Cfg.LogType, "l", "console", "specify logging type [console (default), file name]")
-	flag.StringVar(&pr.Cfg.LogLevel, "v", "info", "specify logging verbosity [off, trace, info (default), warn, err]")
+	pr, err := peer.New(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.StartNode {
+		return runDaemon(pr)
+	}
+	return pr.Run()
+}
+
+//legacyFlags defines on fs the single-dash options of the command line preceding the subcommands,
+//bound to c and, for the config file, to path
+func legacyFlags(fs *flag.FlagSet, c *util.Config, path *string) {
+	fs.BoolVar(&c.StartNode, "n", false, "spawn a new node")
+	fs.StringVar(&c.MulticastAddress, "j", util.DefaultMulticastAddress, "join the cluster at specified multicast group")
+	fs.UintVar(&c.MulticastPort, "jp", util.DefaultMulticastPort, "join the cluster at specified multicast group")
+	fs.UintVar(&c.ListeningPort, "p", 31582, "listen on the specified port")
+
+	fs.StringVar(&c.LogType, "l", "console", "specify logging type [console (default), file name]")
+	fs.BoolVar(&c.LogShared, "log-shared", false, "file logging: all the components log into the file, instead of <component>.<file>")
+	fs.UintVar(&c.LogMaxSize, "log-max-size", 0, "file logging: rotate a file once it would grow beyond the specified megabytes")
+	fs.DurationVar(&c.LogMaxAge, "log-max-age", 0, "file logging: rotate a file once written for the specified duration (e.g. 24h)")
+	fs.UintVar(&c.LogMaxBackups, "log-max-backups", 0, "file logging: number of rotated files retained, 0 retains all")
+	fs.BoolVar(&c.LogCompress, "log-compress", false, "file logging: gzip the rotated files")
+	fs.StringVar(&c.LogLevel, "v", "info", "specify logging verbosity [off, trace, info (default), warn, err]")
+	fs.StringVar(&c.LogFormat, "log-format", util.LogFormatText, "specify logging format [text (default), json, logfmt]")
+	fs.StringVar(&c.AuthKeyFile, "auth-key", "", "sign and verify every frame with the cluster keys in the specified file, one per line")
+	fs.BoolVar(&c.EncryptMulticast, "encrypt-multicast", false, "encrypt the alive messages sent with the cluster key of -auth-key, instead of just signing them")
+	fs.DurationVar(&c.AuthMaxSkew, "auth-max-skew", util.AuthReplayWindow, "how far apart the clocks of the nodes can be: the signed frames sent longer ago, or later, are refused")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", "", "secure the TCP connections with TLS, presenting the specified PEM certificate")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", "", "the PEM private key of -tls-cert")
+	fs.StringVar(&c.TLSCAFile, "tls-ca", "", "the PEM CA the certificates of the nodes connected must chain to, instead of the system roots")
+	fs.BoolVar(&c.TLSVerifyClients, "tls-verify-clients", false, "daemon: accept only the connections presenting a certificate that chains to -tls-ca (mutual TLS)")
+	fs.DurationVar(&c.AuthGrace, "auth-grace", util.DefaultAuthGrace, "daemon: time the replaced cluster keys remain accepted once the auth-key file is reloaded")
+	fs.StringVar(&c.ACLFile, "acl", "", "daemon: enforce the JSON access control list in the specified file, unless the cluster holds a newer one")
+	fs.StringVar(&c.DaemonKeyFile, "daemon-key", "", "daemon: prove to the other daemons, with the keys in the specified file, that this node is a daemon")
+	fs.StringVar(&c.Token, "token", "", "present the specified bearer token with the requests, checked against the ACL of the cluster")
 
-	flag.StringVar(&pr.Cfg.Val, "set", "", "set the value shared across the cluster")
-	flag.BoolVar(&pr.Cfg.GetVal, "get", false, "get the value shared across the cluster")
+	fs.StringVar(&c.Val, "set", "", "set the value shared across the cluster")
+	fs.UintVar(&c.IfTS, "if-ts", 0, "set, delete: accept the change only if the cluster is at the specified timestamp")
+	fs.DurationVar(&c.TTL, "ttl", 0, "set: the value expires after the specified duration")
+	fs.BoolVar(&c.Delete, "delete", false, "delete the value shared across the cluster")
+	fs.DurationVar(&c.TombstoneGrace, "tombstone-grace", peer.DefaultTombstoneGrace, "time a daemon retains a deleted value before collecting it")
+	fs.BoolVar(&c.GetVal, "get", false, "get the value shared across the cluster")
+	fs.BoolVar(&c.PrintTS, "ts", false, "get: print the timestamp before the value")
+	fs.UintVar(&c.GetAt, "at", 0, "get: the value the cluster held at the specified timestamp")
+	fs.BoolVar(&c.History, "history", false, "print the values retained by a daemon, oldest first")
+	fs.UintVar(&c.Restore, "restore", 0, "set again the value the cluster held at the specified timestamp")
+	fs.UintVar(&c.HistorySize, "history-size", peer.DefaultHistorySize, "number of values retained by a daemon")
+	fs.BoolVar(&c.Watch, "watch", false, "watch the value shared across the cluster, printing it at every change")
+	fs.UintVar(&c.WatchFrom, "from", 0, "watch: resume from the specified timestamp")
+	fs.StringVar(&c.DNSAddress, "dns", "", "daemon: answer DNS queries for <cluster>.nds. TXT at the specified address (e.g. :5300)")
+	fs.StringVar(&c.DNSCluster, "dns-cluster", dns.DefaultCluster, "dns: the cluster name served")
+	fs.BoolVar(&c.MDNS, "mdns", false, "daemon: advertise the node via mDNS/DNS-SD as "+mdns.Service)
+	fs.StringVar(&c.GRPCAddress, "grpc", "", "daemon: serve the gRPC service at the specified address (e.g. :9090)")
+	fs.StringVar(&c.MemcacheAddress, "memcache", "", "daemon: serve the memcached ASCII protocol at the specified address (e.g. :11211)")
+	fs.StringVar(&c.RESPAddress, "resp", "", "daemon: serve the Redis protocol (RESP2) at the specified address (e.g. :6379)")
+	fs.StringVar(&c.MetricsAddress, "metrics", "", "daemon: serve the Prometheus metrics at the specified address (e.g. :9100)")
+	fs.StringVar(&c.HTTPAddress, "http", "", "daemon: serve the HTTP/JSON gateway at the specified address (e.g. :8080)")
+
+	fs.StringVar(path, configOption, "", "read the settings not given on the command line from the specified YAML file")
+}
 
-	flag.Parse()
-	pr.Run()
+//runLegacy runs nds given the single-dash options, e.g. nds -n -set Jerico
+func runLegacy(args []string) error {
+	fs := flag.NewFlagSet("nds", flag.ContinueOnError)
+	legacyFlags(fs, &cfg, &configPath)
+	fs.Usage = func() {
+		printUsage(fs.Output(), commands(&cfg, &configPath))
+		fmt.Fprint(fs.Output(), "\nThe single-dash options below are accepted as well, without a command (e.g. nds -n -set Jerico):\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return nil
+	} else if err != nil {
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "nds: unexpected argument %q\n", fs.Arg(0))
+		return errUsage
+	}
+
+	if err := loadConfig(fs, settingName); err != nil {
+		fmt.Fprintln(os.Stderr, "nds:", err.Error())
+		return err
+	}
+	//an empty value is a value: it must be told apart from no -set at all
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "set" {
+			cfg.SetVal = true
+		}
+	})
+	return runPeer()
+}
+
+//main runs the command given as first argument (e.g. nds daemon --port 31582); without any, it reads the single-dash
+//options (e.g. nds -n -p 31582)
+func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(exitCode(runCommand(os.Args[1], os.Args[2:])))
+	}
+	os.Exit(exitCode(runLegacy(os.Args[1:])))
 }
@@ -21,9 +21,12 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package network
 
 import (
+	"errors"
 	"fmt"
 	"nds/util"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 type AcceptorStatus int
@@ -44,20 +47,32 @@ type Acceptor struct {
 	//channel used to serve incoming TCP connections
 	EnteringChan chan net.Conn
 
+	//secures the connections accepted, nil if they are plain
+	TLS *util.TLS
+
 	//logger
 	logger util.Logger
+
+	//connections counter (Accepted only)
+	Counters Counters
+
+	//closed by stop: a connection accepted meanwhile is no longer delivered
+	quit     chan struct{}
+	quitOnce sync.Once
 }
 
 func (a *Acceptor) Run() error {
 	if err := a.init(); err != nil {
 		return err
 	}
+	a.listen()
 	a.accept()
 	return a.stop()
 }
 
 func (a *Acceptor) init() error {
 	a.ListenPort = a.Cfg.ListeningPort
+	a.quit = make(chan struct{})
 
 	//logger init
 	err := a.logger.Init("acpt.", a.Cfg)
@@ -65,27 +80,46 @@ func (a *Acceptor) init() error {
 }
 
 func (a *Acceptor) stop() error {
+	a.quitOnce.Do(func() {
+		if a.quit != nil {
+			close(a.quit)
+		}
+	})
+	if a.Listener == nil {
+		return nil
+	}
 	return a.Listener.Close()
 }
 
-func (a *Acceptor) accept() {
+func (a *Acceptor) listen() {
 	for {
 		var err error
 		if a.Listener, err = net.Listen("tcp", fmt.Sprintf("%s%d", ":", a.ListenPort)); err == nil {
+			a.Listener = a.TLS.Listener(a.Listener)
 			break
 		} else {
 			a.ListenPort++
 			a.logger.Trace("err:%s, try auto-adjusting listening port to:%d ...", err.Error(), a.ListenPort)
 		}
 	}
+}
 
+func (a *Acceptor) accept() {
 	a.logger.Trace("accepting ...")
-	for /*@fixme*/ {
+	for {
 		if conn, err := a.Listener.Accept(); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
 			a.logger.Err("err:%s, accepting connection ...", err.Error())
 		} else {
-			a.logger.Trace("connection accepted")
-			a.EnteringChan <- conn
+			a.logger.Tracew("connection accepted", util.FieldPeer(conn.RemoteAddr().String(), 0))
+			atomic.AddUint64(&a.Counters.Accepted, 1)
+			select {
+			case a.EnteringChan <- conn:
+			case <-a.quit:
+				conn.Close()
+			}
 		}
 	}
 
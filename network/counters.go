@@ -0,0 +1,64 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package network
+
+import (
+	"sync/atomic"
+)
+
+//Counters are the packets and connections handled by a Stack, updated atomically
+type Counters struct {
+	//packets sent to and received from the multicast group
+	PacketsSent     uint64
+	PacketsReceived uint64
+
+	//multicast packets that could not be decoded
+	Malformed uint64
+
+	//multicast packets dropped because not authenticated (see util.Auth)
+	Dropped uint64
+
+	//TCP connections accepted
+	Accepted uint64
+}
+
+//Metered is implemented by the transports keeping Counters
+type Metered interface {
+	Counters() Counters
+}
+
+func (c *Counters) load() Counters {
+	return Counters{
+		PacketsSent:     atomic.LoadUint64(&c.PacketsSent),
+		PacketsReceived: atomic.LoadUint64(&c.PacketsReceived),
+		Malformed:       atomic.LoadUint64(&c.Malformed),
+		Dropped:         atomic.LoadUint64(&c.Dropped),
+		Accepted:        atomic.LoadUint64(&c.Accepted),
+	}
+}
+
+//Counters returns the counters of the multicast helper and of the acceptor
+func (s *Stack) Counters() Counters {
+	c := s.mcastHelper.Counters.load()
+	c.Accepted = atomic.LoadUint64(&s.acceptor.Counters.Accepted)
+	return c
+}
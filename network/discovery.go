@@ -0,0 +1,93 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package network
+
+import (
+	"context"
+	"nds/util"
+	"time"
+)
+
+//SolicitPeriod is the time between two alive messages sent by Discover
+const SolicitPeriod = 2 * time.Second
+
+//Discover joins the multicast group configured in cfg and solicits the nodes of the cluster
+//with alive messages carrying a zero timestamp, without joining the cluster as a node.
+//The alive messages are secured and verified by auth (nil if the cluster has no key).
+//The alive messages received are passed to found until it returns true or ctx is done.
+func Discover(ctx context.Context, cfg *util.Config, auth *util.Auth, found func(util.AliveMsg) bool) error {
+	m := MCastHelper{
+		Cfg:               cfg,
+		Auth:              auth,
+		AliveChanIncoming: make(chan util.AliveMsg),
+		AliveChanOutgoing: make(chan []byte, 1),
+	}
+
+	defer m.logger.Stop()
+	if err := m.open(); err != nil {
+		m.stop()
+		return err
+	}
+	result := make(chan error, 1)
+	go func() { result <- m.serve() }()
+	defer func() {
+		m.stop()
+		//the reading loop may be delivering an alive message
+		for {
+			select {
+			case <-m.AliveChanIncoming:
+			case <-result:
+				return
+			}
+		}
+	}()
+
+	solicit := util.AliveMsg{Pt: util.MsgPktTypeAlive}
+	buff, err := solicit.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	frame := util.NewFrame(buff)
+
+	ticker := time.NewTicker(SolicitPeriod)
+	defer ticker.Stop()
+	m.AliveChanOutgoing <- frame
+
+	for {
+		select {
+		case msg := <-m.AliveChanIncoming:
+			if found(msg) {
+				return nil
+			}
+		case <-ticker.C:
+			select {
+			case m.AliveChanOutgoing <- frame:
+			default:
+			}
+		case err := <-result:
+			result <- err
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
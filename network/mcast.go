@@ -24,15 +24,21 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"nds/util"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"golang.org/x/net/ipv4"
 )
 
+//MaxPacketSize is the size of the largest multicast packet read: an alive message, framed and secured, fits in an Ethernet MTU
+const MaxPacketSize = 1500
+
 type MCastHelper struct {
 	//config
 	Cfg *util.Config
@@ -56,9 +62,24 @@ type MCastHelper struct {
 	//channels used to send/receive alive messages (UDP multicast)
 	AliveChanIncoming chan util.AliveMsg
 	AliveChanOutgoing chan []byte
+
+	//signs (or encrypts) the alive messages sent and verifies the ones received, nil if the cluster has no key
+	Auth *util.Auth
+
+	//closed when the reading loop ends
+	done chan struct{}
+
+	//closed by stop: an alive message received meanwhile is no longer delivered
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	//packets counters (the accepted connections are counted by the Acceptor)
+	Counters Counters
 }
 
 func (m *MCastHelper) init() error {
+	m.quit = make(chan struct{})
+
 	//logger init
 	err := m.logger.Init("mcast.", m.Cfg)
 	if err != nil {
@@ -87,6 +108,11 @@ func (m *MCastHelper) init() error {
 }
 
 func (m *MCastHelper) stop() error {
+	m.quitOnce.Do(func() {
+		if m.quit != nil {
+			close(m.quit)
+		}
+	})
 	if m.iPktConn != nil {
 		m.iPktConn.Close()
 	}
@@ -136,42 +162,85 @@ func mcastIncoRawConnCfg(network, address string, conn syscall.RawConn) error {
 
 func (m *MCastHelper) mcastSender() {
 	for {
-		buff := <-m.AliveChanOutgoing
+		var buff []byte
+		select {
+		case buff = <-m.AliveChanOutgoing:
+		case <-m.done:
+			return
+		}
+		if len(buff) >= 4 {
+			buff = util.NewFrame(m.Auth.SealAlive(buff[4:]))
+		}
+		if len(buff) > MaxPacketSize {
+			m.logger.Errw("alive message too large, not sent", util.FieldAny("bytes", len(buff)))
+			continue
+		}
 		if nsent, err := m.iNPktConn.WriteTo(buff, nil, &m.outgPktUDPAddr); err != nil {
 			m.logger.Err("WriteTo:%s", err.Error())
 		} else {
+			atomic.AddUint64(&m.Counters.PacketsSent, 1)
 			m.logger.Trace("WriteTo:%s, %d bytes sent", m.outgPktUDPAddr.String(), nsent)
 		}
 	}
 }
 
 func (m *MCastHelper) Run() error {
-	if err := m.init(); err != nil {
+	if err := m.open(); err != nil {
 		return err
 	}
+	return m.serve()
+}
 
-	if err := m.establish_multicast(); err != nil {
+//open joins the multicast group
+func (m *MCastHelper) open() error {
+	if err := m.init(); err != nil {
 		return err
 	}
+	return m.establish_multicast()
+}
 
+//serve sends and receives alive messages until the multicast connection is closed
+func (m *MCastHelper) serve() error {
 	//start mcast sender
+	m.done = make(chan struct{})
+	defer close(m.done)
 	go m.mcastSender()
 
 	//reading loop from multicast connection
 	for {
-		buff := make([]byte, 1500)
+		buff := make([]byte, MaxPacketSize)
 		nread, cm, _, err := m.iNPktConn.ReadFrom(buff)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
 			m.logger.Err("ReadFrom:%s", err.Error())
 		} else {
-			m.logger.Trace("ReadFrom:%s, %d bytes read", cm.String(), nread)
+			m.logger.Tracew("packet received", util.FieldPeer(cm.Src.String(), 0), util.FieldAny("bytes", nread))
+			atomic.AddUint64(&m.Counters.PacketsReceived, 1)
+			if nread < 4 || 4+int(binary.LittleEndian.Uint32(buff[0:])) > nread {
+				m.logger.Errw("malformed packet", util.FieldPeer(cm.Src.String(), 0), util.FieldAny("bytes", nread))
+				atomic.AddUint64(&m.Counters.Malformed, 1)
+				continue
+			}
 			msgUB := 4 + binary.LittleEndian.Uint32(buff[0:])
+			body, err := m.Auth.Open(buff[4:msgUB])
+			if err != nil {
+				m.logger.Warnw("packet dropped", util.FieldPeer(cm.Src.String(), 0), util.FieldErr(err))
+				atomic.AddUint64(&m.Counters.Dropped, 1)
+				continue
+			}
 			msg := util.AliveMsg{}
-			if err := json.Unmarshal(buff[4:msgUB], &msg); err != nil {
-				m.logger.Err("Unmarshal:%s", err.Error())
+			if err := json.Unmarshal(body, &msg); err != nil {
+				m.logger.Errw("malformed packet", util.FieldPeer(cm.Src.String(), 0), util.FieldErr(err))
+				atomic.AddUint64(&m.Counters.Malformed, 1)
+				continue
 			}
 			msg.Si = cm.Src.String()
-			m.AliveChanIncoming <- msg
+			select {
+			case m.AliveChanIncoming <- msg:
+			case <-m.quit:
+			}
 		}
 	}
 
@@ -0,0 +1,143 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package network
+
+import (
+	"crypto/tls"
+	"nds/util"
+	"net"
+	"strconv"
+	"time"
+)
+
+//DialTimeout is the time allowed to establish a point 2 point connection with another node
+const DialTimeout = 2 * time.Second
+
+//Transport abstracts the network facilities a peer relies on:
+//a multicast group carrying alive messages and point 2 point connections carrying data.
+type Transport interface {
+	//Start brings the transport up: once it returns, the node can be reached by other nodes.
+	//Incoming connections and alive messages are delivered on enteringChan and aliveChanIncoming,
+	//outgoing alive messages (already framed) are read from aliveChanOutgoing.
+	Start(cfg *util.Config, enteringChan chan net.Conn, aliveChanIncoming chan util.AliveMsg, aliveChanOutgoing chan []byte) error
+
+	//Addr returns the address and the listening port other nodes can use to connect this node
+	Addr() (string, uint)
+
+	//Dial connects to the node listening at address:port
+	Dial(address string, port uint) (net.Conn, error)
+
+	//Stop shuts the transport down
+	Stop() error
+}
+
+//Stack is the default Transport: alive messages go over UDP multicast, data over TCP/IP.
+type Stack struct {
+	//network acceptor
+	acceptor Acceptor
+
+	//multicast manager
+	mcastHelper MCastHelper
+
+	//secures the point 2 point connections, nil if they are plain
+	tls *util.TLS
+}
+
+func (s *Stack) Start(cfg *util.Config, enteringChan chan net.Conn, aliveChanIncoming chan util.AliveMsg, aliveChanOutgoing chan []byte) error {
+	s.acceptor.Cfg = cfg
+	s.acceptor.EnteringChan = enteringChan
+
+	s.mcastHelper.Cfg = cfg
+	s.mcastHelper.AliveChanIncoming = aliveChanIncoming
+	s.mcastHelper.AliveChanOutgoing = aliveChanOutgoing
+
+	//the listening port must be known, and the multicast group joined, before this node announces itself
+	if err := s.acceptor.init(); err != nil {
+		return err
+	}
+	s.acceptor.listen()
+	if err := s.mcastHelper.open(); err != nil {
+		s.mcastHelper.stop()
+		s.acceptor.stop()
+		return err
+	}
+
+	go func() {
+		s.acceptor.accept()
+		s.acceptor.stop()
+	}()
+	go s.mcastHelper.serve()
+
+	return nil
+}
+
+//Authenticated is implemented by the transports securing the alive messages they send and verifying the ones they receive
+type Authenticated interface {
+	//SetAuth sets what secures and verifies the alive messages; it is called before Start
+	SetAuth(auth *util.Auth)
+}
+
+func (s *Stack) SetAuth(auth *util.Auth) {
+	s.mcastHelper.Auth = auth
+}
+
+//Secured is implemented by the transports securing their point 2 point connections with TLS
+type Secured interface {
+	//SetTLS sets what secures the connections, both accepted and dialed; it is called before Start
+	SetTLS(t *util.TLS)
+}
+
+func (s *Stack) SetTLS(t *util.TLS) {
+	s.tls = t
+	s.acceptor.TLS = t
+}
+
+func (s *Stack) Addr() (string, uint) {
+	if s.acceptor.Listener == nil {
+		return "", s.acceptor.ListenPort
+	}
+	return s.acceptor.Listener.Addr().String(), s.acceptor.ListenPort
+}
+
+func (s *Stack) Dial(address string, port uint) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(int(port))), DialTimeout)
+	if err != nil || !s.tls.Enabled() {
+		return conn, err
+	}
+
+	//the handshake is done here, so that a node refusing this one fails the dial
+	tc := tls.Client(conn, s.tls.ClientConfig(address))
+	tc.SetDeadline(time.Now().Add(DialTimeout))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+func (s *Stack) Stop() error {
+	s.mcastHelper.stop()
+	err := s.acceptor.stop()
+	s.mcastHelper.logger.Stop()
+	s.acceptor.logger.Stop()
+	return err
+}
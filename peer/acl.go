@@ -0,0 +1,310 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package peer
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"nds/util"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//the operations of the front-ends administering a daemon, requiring the admin permission (see Authorize)
+const (
+	OpReload   = "reload"
+	OpLogLevel = "loglevel"
+)
+
+//the largest version jump of an ACL pulled from a daemon not proven with the daemon key (see takesUnproven)
+const maxACLVersionStep = 1000
+
+//Caller is who asks this node for something, as told by the front-end serving it; the zero Caller is anonymous
+type Caller struct {
+	//the address the request comes from
+	Addr string
+
+	//the common name of the TLS client certificate, if verified
+	Cert string
+
+	//the bearer token presented, if any
+	Token string
+}
+
+//ConnCaller returns the Caller on the other side of conn, accepted by this node or by a front-end, presenting token;
+//the TLS client certificate is told only once the handshake of conn is complete.
+func ConnCaller(conn net.Conn, token string) Caller {
+	c := Caller{Addr: conn.RemoteAddr().String(), Token: token}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if cs := tc.ConnectionState(); len(cs.VerifiedChains) > 0 {
+			c.Cert = cs.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	return c
+}
+
+//RequestCaller returns the Caller sending the HTTP request r: the token is the bearer token of its Authorization header,
+//the certificate the one it presented, if verified, over TLS
+func RequestCaller(r *http.Request) Caller {
+	c := Caller{Addr: r.RemoteAddr}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		c.Token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		c.Cert = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return c
+}
+
+//dialedCaller returns the Caller on the other side of conn, dialed by this node, presenting token;
+//a TLS handshake completes only once the certificate of the other side is verified (see util.TLS.ClientConfig).
+func dialedCaller(conn net.Conn, token string) Caller {
+	c := Caller{Addr: conn.RemoteAddr().String(), Token: token}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if cs := tc.ConnectionState(); len(cs.PeerCertificates) > 0 {
+			c.Cert = cs.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	return c
+}
+
+//opPermission returns the permission op takes: reading the value, the history or the members takes read,
+//writing it takes write, anything else (the ACL, the administration of a daemon) takes admin
+func opPermission(op string) string {
+	switch op {
+	case util.ReqOpGet, util.ReqOpWatch, util.ReqOpHist, util.ReqOpMembers:
+		return util.PermRead
+	case util.ReqOpSet, util.ReqOpDel, util.ReqOpRestore:
+		return util.PermWrite
+	}
+	return util.PermAdmin
+}
+
+//authorize checks that the ACL held by this node lets c run op (see opPermission); without an ACL anything is allowed.
+//A request denied is logged by the audit log and returns an NDSError with code RetCode_DENIED.
+func (p *Peer) authorize(c Caller, op string) *util.NDSError {
+	var acl *util.ACL
+	if !p.exec(func() { acl = p.acl }) {
+		return &util.NDSError{Code: util.RetCode_UNVRSC}
+	}
+	return p.authorizeWith(acl, c, op)
+}
+
+//authorizeWith checks that acl lets c run op, as authorize does
+func (p *Peer) authorizeWith(acl *util.ACL, c Caller, op string) *util.NDSError {
+	if acl == nil {
+		return nil
+	}
+
+	id := acl.Lookup(c.Cert, c.Token)
+	fields := []util.Field{util.FieldAny("op", op), util.FieldAny("identity", id.Name), util.FieldAny("addr", c.Addr),
+		util.FieldAny("cert", c.Cert), util.FieldAny("token", c.Token != ""), util.FieldAny("permission", id.Permission),
+		util.FieldAny("acl", acl.String())}
+	if !util.PermAllows(id.Permission, opPermission(op)) {
+		p.audit.Warnw("request denied", fields...)
+		return &util.NDSError{Code: util.RetCode_DENIED}
+	}
+	p.audit.Tracew("request allowed", fields...)
+	return nil
+}
+
+//Authorize checks that the ACL of the cluster lets c run op: one of the read operations (util.ReqOpGet, ReqOpWatch,
+//ReqOpHist, ReqOpMembers), OpReload or OpLogLevel. The front-ends check the reads and the administration of the daemon
+//with it; the writes are checked by Apply.
+//If denied, an NDSError with code RetCode_DENIED is returned.
+func (p *Peer) Authorize(c Caller, op string) error {
+	if err := p.authorize(c, op); err != nil {
+		return err
+	}
+	return nil
+}
+
+//provenDaemon tells whether the request req comes from a daemon holding the daemon key (see util.DaemonKey):
+//the proof must cover the whole request, sent within the replay window, and its challenge must be new
+func (p *Peer) provenDaemon(req util.ReqMsg) bool {
+	unproven := req
+	unproven.Dp = ""
+	buff, err := unproven.MarshalJSON()
+	return err == nil && p.daemonKey.VerifyRequest(req.Nc, req.Tm, p.auth.ReplayWindow(), buff, req.Dp)
+}
+
+//daemonRequest returns a request for op challenging the node asked to prove itself a daemon;
+//this node proves itself too, if it holds the daemon key. A "pure" node presents its token.
+func (p *Peer) daemonRequest(op string) util.ReqMsg {
+	req := util.ReqMsg{Op: op, Pt: util.MsgPktTypeReq, Nc: util.NewNonce()}
+	if !p.Cfg.StartNode {
+		req.Tk = p.Cfg.Token
+	}
+	if p.daemonKey != nil {
+		req.Tm = time.Now().UnixNano()
+		p.prove(req.Nc, &req, &req.Dp)
+	}
+	return req
+}
+
+//takeACL makes this node hold acl, if it supersedes the one held (see util.ACL.Newer); from tells where it comes from.
+//It is called inside the events loop.
+func (p *Peer) takeACL(acl *util.ACL, from string) bool {
+	if acl == nil || !acl.Newer(p.acl) {
+		return false
+	}
+	p.audit.Infow("acl updated", util.FieldAny("old", p.acl.String()), util.FieldAny("new", acl.String()), util.FieldAny("from", from))
+	p.acl, p.aclHash, p.aclRefused = acl, acl.Hash(), ""
+	//the values denied by the former ACL can be pulled again
+	for _, m := range p.members {
+		m.denied = 0
+	}
+	if p.Cfg.StartNode && p.CurrentNodeTS != 0 {
+		p.sendAliveMessage()
+	}
+	return true
+}
+
+//processACL compares the ACL announced by the daemon that sent msg with the one held by this daemon:
+//a newer one is pulled, an older one is told the cluster about.
+func (p *Peer) processACL(msg util.AliveMsg) {
+	if !p.Cfg.StartNode || !msg.Dn {
+		return
+	}
+	var version uint64
+	if p.acl != nil {
+		version = p.acl.Version
+	}
+	switch {
+	case util.ACLNewer(msg.Av, msg.Ah, version, p.aclHash):
+		if aclPull(msg) != p.aclRefused {
+			p.requestACL(msg)
+		}
+	case util.ACLNewer(version, p.aclHash, msg.Av, msg.Ah) && p.CurrentNodeTS != 0:
+		p.sendAliveMessage()
+	}
+}
+
+//aclPull tells the ACL announced by msg apart from the same ACL announced by another daemon, and from another ACL
+func aclPull(msg util.AliveMsg) string {
+	return net.JoinHostPort(msg.Si, strconv.Itoa(int(msg.Lp))) + "/" + msg.Ah
+}
+
+//requestACL pulls the ACL from the daemon that sent msg, one pull at a time; it is called inside the events loop.
+//With the daemon key, the ACL is taken only if the daemon proves itself with it; without, only if the ACL held lets
+//the daemon administer the cluster and the version does not jump by more than maxACLVersionStep (see takesUnproven).
+func (p *Peer) requestACL(msg util.AliveMsg) {
+	if p.aclPulling {
+		return
+	}
+	p.aclPulling = true
+
+	go func() {
+		var acl *util.ACL
+		var refused bool
+		from := net.JoinHostPort(msg.Si, strconv.Itoa(int(msg.Lp)))
+		if conn, err := p.Transport.Dial(msg.Si, uint(msg.Lp)); err != nil {
+			p.logger.Errw("dialing", util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldErr(err))
+		} else {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second * DataTransferTimeout))
+			resp := util.ACLMsg{}
+			req := p.daemonRequest(util.ReqOpACL)
+			if err := p.sendRequest(conn, req); err != nil {
+				p.logger.Errw("sending request msg", util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldErr(err))
+			} else if buff, err := p.readFrame(conn); err != nil {
+				p.logger.Errw("receiving acl msg", util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldErr(err))
+			} else if err := json.Unmarshal(buff, &resp); err != nil {
+				p.logger.Err("Unmarshal:%s", err.Error())
+			} else if resp.Al != nil {
+				unproven := resp
+				unproven.Dp = ""
+				if err := resp.Al.Validate(); err != nil {
+					p.logger.Errw("invalid acl received", util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldErr(err))
+				} else if p.daemonKey != nil && !p.proven(req.Nc, resp.Dp, &unproven) {
+					p.logger.Warnw("acl refused: the daemon did not prove itself", util.FieldPeer(msg.Si, uint(msg.Lp)))
+					refused = true
+				} else if p.daemonKey == nil && !p.takesUnproven(resp.Al, dialedCaller(conn, "")) {
+					p.logger.Warnw("acl refused: the daemon may not administer the cluster, or the version jumps too far", util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldAny("version", resp.Al.Version))
+					refused = true
+				} else {
+					acl = resp.Al
+				}
+			}
+		}
+		p.exec(func() {
+			p.aclPulling = false
+			if refused {
+				p.aclRefused = aclPull(msg)
+			}
+			p.takeACL(acl, from)
+		})
+	}()
+}
+
+//takesUnproven tells whether acl, pulled from the daemon c that did not prove itself with the daemon key, can be taken:
+//the ACL held must let c administer the cluster, and acl must not be more than maxACLVersionStep versions ahead of it
+//(of 0 without an ACL), so that an ACL with a huge version cannot be slipped in to outrank every later one
+func (p *Peer) takesUnproven(acl *util.ACL, c Caller) bool {
+	var held *util.ACL
+	if !p.exec(func() { held = p.acl }) {
+		return false
+	}
+	var version uint64
+	if held != nil {
+		version = held.Version
+	}
+	return acl.Version-version <= maxACLVersionStep && p.authorizeWith(held, c, util.ReqOpACL) == nil
+}
+
+func (p *Peer) serveACL(conn net.Conn, req util.ReqMsg) {
+	resp := util.ACLMsg{Pt: util.MsgPktTypeACL}
+	if !p.exec(func() { resp.Al = p.acl }) {
+		return
+	}
+	if msg, err := p.prove(req.Nc, &resp, &resp.Dp); err != nil {
+		p.logger.Err("building acl msg:%s", err.Error())
+	} else {
+		p.sendDataMessage(conn, msg)
+	}
+}
+
+//prove marshals msg, setting its proof to the proof of the challenge nonce if this node holds the daemon key
+func (p *Peer) prove(nonce string, msg json.Marshaler, proof *string) ([]byte, error) {
+	buff, err := msg.MarshalJSON()
+	if err != nil || nonce == "" || p.daemonKey == nil {
+		return buff, err
+	}
+	*proof = p.daemonKey.Prove(nonce, buff)
+	return msg.MarshalJSON()
+}
+
+//proven tells whether proof proves that msg, marshaled without it, comes from a daemon holding the daemon key
+func (p *Peer) proven(nonce, proof string, msg json.Marshaler) bool {
+	buff, err := msg.MarshalJSON()
+	return err == nil && p.daemonKey.Verify(nonce, buff, proof)
+}
+
+//ACL returns the ACL held by this node, nil if none
+func (p *Peer) ACL() *util.ACL {
+	var acl *util.ACL
+	p.exec(func() { acl = p.acl })
+	return acl
+}
@@ -0,0 +1,272 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nds/util"
+	"net"
+	"strconv"
+	"time"
+)
+
+//isGetter tells whether this node is a "pure" getter node
+func (p *Peer) isGetter() bool {
+	return !p.Cfg.StartNode && !p.Cfg.SetVal && p.Cfg.Val == "" && !p.Cfg.Delete && p.clientMode() == nil
+}
+
+//printValue prints on stdout the value obtained by a "pure" getter node
+func (p *Peer) printValue() error {
+	if p.CurrentNodeTS == 0 || p.Tombstone {
+		p.logger.Warn("no value obtained from the cluster")
+		return &util.NDSError{Code: util.RetCode_NODATA}
+	}
+	if p.Cfg.PrintTS {
+		fmt.Printf("%d ", p.CurrentNodeTS)
+	}
+	fmt.Println(p.Data)
+	return nil
+}
+
+//findDaemon solicits alives until a daemon node holding a timestamp answers;
+//it gives up after timeout (0 waits forever).
+func (p *Peer) findDaemon(timeout time.Duration) (util.AliveMsg, bool) {
+	solicit := time.NewTicker(time.Second * NodeSynchDuration)
+	defer solicit.Stop()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		tm := time.NewTimer(timeout)
+		defer tm.Stop()
+		expired = tm.C
+	}
+
+	//this node holds no timestamp: daemons answer with an alive
+	p.sendAliveMessage()
+	for {
+		select {
+		case msg := <-p.AliveChanIncoming:
+			if msg.Dn && msg.Ts != 0 {
+				return msg, true
+			}
+		case <-solicit.C:
+			p.sendAliveMessage()
+		case <-expired:
+			return util.AliveMsg{}, false
+		}
+	}
+}
+
+//clientMode returns the function running this "pure" node as a client of a daemon, if any
+func (p *Peer) clientMode() func() error {
+	switch {
+	case p.Cfg.StartNode:
+		return nil
+	case p.Cfg.Watch:
+		return p.runWatch
+	case p.Cfg.IfTS > 0:
+		return p.runSetIf
+	case p.Cfg.History:
+		return p.runHistory
+	case p.Cfg.GetAt > 0:
+		return p.runGetAt
+	case p.Cfg.Restore > 0:
+		return p.runRestore
+	case p.Cfg.Members:
+		return p.runMembers
+	case p.Cfg.Status:
+		return p.runStatus
+	}
+	return nil
+}
+
+//request sends req to the first daemon answering the alive of this node and decodes its answer in resp
+func (p *Peer) request(req util.ReqMsg, resp interface{}) error {
+	daemon, ok := p.findDaemon(time.Second * NodeSynchDuration)
+	if !ok {
+		p.logger.Err("no daemon answered")
+		return &util.NDSError{Code: util.RetCode_UNVRSC}
+	}
+
+	conn, err := p.Transport.Dial(daemon.Si, uint(daemon.Lp))
+	if err != nil {
+		p.logger.Err("dialing %s:%d:%s", daemon.Si, daemon.Lp, err.Error())
+		return &util.NDSError{Code: util.RetCode_SCKERR}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * DataTransferTimeout))
+
+	var authErr *util.AuthError
+	if err := p.sendRequest(conn, req); err != nil {
+		p.logger.Err("sending request msg:%s", err.Error())
+		return &util.NDSError{Code: util.RetCode_SCKERR}
+	} else if buff, err := p.auth.ReadFrame(conn); errors.As(err, &authErr) {
+		p.logger.Err("receiving msg:%s", err.Error())
+		return &util.NDSError{Code: util.RetCode_DRPPKT}
+	} else if err != nil {
+		p.logger.Err("receiving msg:%s", err.Error())
+		return &util.NDSError{Code: util.RetCode_SCKERR}
+	} else if err := json.Unmarshal(buff, resp); err != nil {
+		p.logger.Err("Unmarshal:%s", err.Error())
+		return &util.NDSError{Code: util.RetCode_MALFORM}
+	}
+	return nil
+}
+
+//runSetIf runs this node as a "pure" setter asking a daemon to compare-and-set (or compare-and-delete) the value:
+//the timestamp the cluster holds afterwards is printed on stdout.
+func (p *Peer) runSetIf() error {
+	ct := uint64(p.Cfg.IfTS)
+	req := util.ReqMsg{Op: util.ReqOpSet, Dv: p.Cfg.Val, Ct: &ct, Tk: p.Cfg.Token, Tl: ttlMillis(p.Cfg.TTL)}
+	if p.Cfg.Delete {
+		req = util.ReqMsg{Op: util.ReqOpDel, Ct: &ct, Tk: p.Cfg.Token}
+	}
+	resp := util.RespMsg{}
+	if err := p.request(req, &resp); err != nil {
+		return err
+	}
+
+	if resp.Rc == util.RetCode_DENIED {
+		p.logger.Warn("set denied by the ACL of the cluster")
+		return &util.NDSError{Code: resp.Rc}
+	}
+	fmt.Println(resp.Ts)
+	if resp.Rc != util.RetCode_OK {
+		p.logger.Warn("set refused: expected ts:%d, cluster ts:%d", ct, resp.Ts)
+		return &util.NDSError{Code: resp.Rc}
+	}
+	return nil
+}
+
+//runHistory prints on stdout the values retained by a daemon, oldest first, one per line: "<ts> <origin> <value>";
+//a deletion is printed as "<ts> <origin>".
+func (p *Peer) runHistory() error {
+	resp := util.HistMsg{}
+	if err := p.request(util.ReqMsg{Op: util.ReqOpHist, Tk: p.Cfg.Token}, &resp); err != nil {
+		return err
+	}
+	for _, e := range resp.Hs {
+		if e.Tb {
+			fmt.Printf("%d %s\n", e.Ts, e.Og)
+		} else {
+			fmt.Printf("%d %s %s\n", e.Ts, e.Og, e.Dv)
+		}
+	}
+	return nil
+}
+
+//runGetAt prints on stdout the value the cluster held at timestamp GetAt, as retained by a daemon
+func (p *Peer) runGetAt() error {
+	resp := util.HistMsg{}
+	if err := p.request(util.ReqMsg{Op: util.ReqOpHist, Tk: p.Cfg.Token}, &resp); err != nil {
+		return err
+	}
+
+	entries := make([]HistoryEntry, 0, len(resp.Hs))
+	for _, e := range resp.Hs {
+		entries = append(entries, HistoryEntry{Ts: uint32(e.Ts), Value: e.Dv, Origin: e.Og, Tombstone: e.Tb})
+	}
+	e, ok := HistoryAt(entries, uint32(p.Cfg.GetAt))
+	if !ok {
+		p.logger.Warn("ts:%d is older than retained history", p.Cfg.GetAt)
+		return &util.NDSError{Code: util.RetCode_NOTFOUND}
+	}
+	if e.Tombstone {
+		p.logger.Warn("no value at ts:%d: deleted at ts:%d", p.Cfg.GetAt, e.Ts)
+		return &util.NDSError{Code: util.RetCode_NODATA}
+	}
+
+	if p.Cfg.PrintTS {
+		fmt.Printf("%d ", e.Ts)
+	}
+	fmt.Println(e.Value)
+	return nil
+}
+
+//runRestore asks a daemon to set again the value held at timestamp Restore:
+//the new timestamp is printed on stdout.
+func (p *Peer) runRestore() error {
+	resp := util.RespMsg{}
+	if err := p.request(util.ReqMsg{Op: util.ReqOpRestore, Tk: p.Cfg.Token, Ts: uint64(p.Cfg.Restore)}, &resp); err != nil {
+		return err
+	}
+
+	if resp.Rc == util.RetCode_DENIED {
+		p.logger.Warn("restore denied by the ACL of the cluster")
+		return &util.NDSError{Code: resp.Rc}
+	} else if resp.Rc != util.RetCode_OK {
+		p.logger.Warn("restore refused: ts:%d is older than retained history", p.Cfg.Restore)
+		return &util.NDSError{Code: resp.Rc}
+	}
+	fmt.Println(resp.Ts)
+	return nil
+}
+
+//requestMembers asks a daemon for the daemon nodes of the cluster: the daemon answering comes first
+func (p *Peer) requestMembers() ([]util.AliveMsg, error) {
+	resp := util.MembersMsg{}
+	if err := p.request(util.ReqMsg{Op: util.ReqOpMembers, Tk: p.Cfg.Token}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Mb) == 0 {
+		return nil, &util.NDSError{Code: util.RetCode_MALFORM}
+	}
+	return resp.Mb, nil
+}
+
+//runMembers prints on stdout the daemon nodes of the cluster, one per line: "<node id> <address>:<port> <ts>"
+func (p *Peer) runMembers() error {
+	members, err := p.requestMembers()
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		fmt.Printf("%s %s %d\n", m.Ni, net.JoinHostPort(m.Si, strconv.Itoa(int(m.Lp))), m.Ts)
+	}
+	return nil
+}
+
+//runStatus prints on stdout a summary of the cluster, as seen by a daemon:
+//the daemon answering, its timestamp, the number of daemons and whether they all hold that timestamp.
+func (p *Peer) runStatus() error {
+	members, err := p.requestMembers()
+	if err != nil {
+		return err
+	}
+	self, behind := members[0], 0
+	for _, m := range members[1:] {
+		if m.Ts != self.Ts {
+			behind++
+		}
+	}
+
+	fmt.Printf("node      %s %s\n", self.Ni, net.JoinHostPort(self.Si, strconv.Itoa(int(self.Lp))))
+	fmt.Printf("ts        %d\n", self.Ts)
+	fmt.Printf("daemons   %d\n", len(members))
+	if behind == 0 {
+		fmt.Println("converged yes")
+	} else {
+		fmt.Printf("converged no, %d daemons at another ts\n", behind)
+	}
+	return nil
+}
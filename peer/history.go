@@ -0,0 +1,142 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package peer
+
+import (
+	"nds/util"
+	"time"
+)
+
+//number of values retained by a node when not configured
+const DefaultHistorySize = 16
+
+//HistoryEntry is a value held by a node
+type HistoryEntry struct {
+	Ts        uint32
+	Value     string
+	Origin    string
+	Tombstone bool
+	TTL       time.Duration
+}
+
+//history is a bounded ring of the values held by a node
+type history struct {
+	entries []HistoryEntry
+	next    int
+	full    bool
+}
+
+func (h *history) init(size uint) {
+	if size == 0 {
+		size = DefaultHistorySize
+	}
+	h.entries = make([]HistoryEntry, size)
+	h.next = 0
+	h.full = false
+}
+
+func (h *history) add(e HistoryEntry) {
+	h.entries[h.next] = e
+	if h.next++; h.next == len(h.entries) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+//resize changes the number of entries retained, dropping the oldest ones that no longer fit
+func (h *history) resize(size uint) {
+	entries := h.list()
+	h.init(size)
+	if len(entries) > len(h.entries) {
+		entries = entries[len(entries)-len(h.entries):]
+	}
+	for _, e := range entries {
+		h.add(e)
+	}
+}
+
+//list returns the retained entries, oldest first
+func (h *history) list() []HistoryEntry {
+	if !h.full {
+		return append([]HistoryEntry{}, h.entries[:h.next]...)
+	}
+	return append(append([]HistoryEntry{}, h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+//purge drops the entries with a timestamp not after ts
+func (h *history) purge(ts uint32) {
+	entries := h.list()
+	h.init(uint(len(h.entries)))
+	for _, e := range entries {
+		if e.Ts > ts {
+			h.add(e)
+		}
+	}
+}
+
+//HistoryAt returns the entry in force at timestamp ts: the one with the greatest timestamp not after ts.
+//entries must be sorted oldest first.
+func HistoryAt(entries []HistoryEntry, ts uint32) (HistoryEntry, bool) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Ts <= ts {
+			return entries[i], true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+//History returns the values held by this node, oldest first
+func (p *Peer) History() []HistoryEntry {
+	var entries []HistoryEntry
+	p.exec(func() { entries = p.history.list() })
+	return entries
+}
+
+//ValueAt returns the value this node held at timestamp ts
+func (p *Peer) ValueAt(ts uint32) (HistoryEntry, bool) {
+	return HistoryAt(p.History(), ts)
+}
+
+//Restore sets again, with a fresh timestamp and its original time to live, the value this node held at timestamp ts;
+//it returns the new timestamp. The write is anonymous, as for Set.
+func (p *Peer) Restore(ts uint32) (uint32, error) {
+	return p.Apply(Change{Restore: &ts})
+}
+
+func (p *Peer) restore(ts uint32) (uint32, *util.NDSError) {
+	var newTS uint32
+	var err *util.NDSError
+	if !p.exec(func() {
+		e, ok := HistoryAt(p.history.list(), ts)
+		if !ok {
+			p.logger.Trace("restore refused: ts:%d is older than retained history", ts)
+			newTS, err = p.CurrentNodeTS, &util.NDSError{Code: util.RetCode_NOTFOUND}
+			return
+		}
+		p.updateValue(p.newValue(e.Value, e.Tombstone, ttlMillis(e.TTL)))
+		p.logger.Trace("value of ts:%d restored with timestamp: %d", e.Ts, p.CurrentNodeTS)
+		p.sendAliveMessage()
+		newTS = p.CurrentNodeTS
+	}) {
+		return 0, &util.NDSError{Code: util.RetCode_UNVRSC}
+	}
+	return newTS, err
+}
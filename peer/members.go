@@ -0,0 +1,110 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package peer
+
+import (
+	"nds/util"
+	"sort"
+	"time"
+)
+
+//seconds after which a daemon node not heard anymore is no longer considered a member of the cluster
+const MemberTimeout = 3 * NodeAlivePeriod
+
+//Member is a daemon node known by this node through its alive messages
+type Member struct {
+	//the identifier of the node
+	NodeID string
+
+	//the address and the listening port of the node
+	Address string
+	Port    uint
+
+	//the latest timestamp announced by the node
+	Ts uint32
+
+	//the time point at which the latest alive of the node was received
+	LastSeen time.Time
+
+	//the timestamp of the value of the node denied by the ACL, not pulled again
+	denied uint32
+}
+
+//trackMember records the daemon node that sent msg
+func (p *Peer) trackMember(msg util.AliveMsg) {
+	if !msg.Dn || msg.Ni == "" || msg.Ni == p.NodeID {
+		return
+	}
+	m, ok := p.members[msg.Ni]
+	if !ok {
+		m = &Member{NodeID: msg.Ni}
+		p.members[msg.Ni] = m
+		p.logger.Trace("new member: %s at %s:%d", msg.Ni, msg.Si, msg.Lp)
+	}
+	m.Address, m.Port = msg.Si, uint(msg.Lp)
+	m.LastSeen = time.Now()
+	//a timestamp never goes back: an older one is a late alive
+	if m.Ts < uint32(msg.Ts) {
+		m.Ts = uint32(msg.Ts)
+	}
+}
+
+//expireMembers forgets the daemon nodes not heard for MemberTimeout
+func (p *Peer) expireMembers(now time.Time) {
+	for id, m := range p.members {
+		if now.Sub(m.LastSeen) > time.Second*MemberTimeout {
+			p.logger.Trace("member gone: %s", id)
+			delete(p.members, id)
+		}
+	}
+}
+
+//membersAt tells whether all the known members announced timestamp ts or a newer one
+func (p *Peer) membersAt(ts uint32) bool {
+	for _, m := range p.members {
+		if m.Ts < ts {
+			return false
+		}
+	}
+	return true
+}
+
+//Self describes this node as a member of the cluster reachable at address
+func (p *Peer) Self(address string) Member {
+	_, port := p.Transport.Addr()
+	m := Member{NodeID: p.NodeID, Address: address, Port: port, LastSeen: time.Now()}
+	p.exec(func() { m.Ts = p.CurrentNodeTS })
+	return m
+}
+
+//Members returns the daemon nodes this node currently knows, sorted by identifier;
+//this node is not included.
+func (p *Peer) Members() []Member {
+	var members []Member
+	p.exec(func() {
+		for _, m := range p.members {
+			members = append(members, *m)
+		}
+	})
+	sort.Slice(members, func(i, j int) bool { return members[i].NodeID < members[j].NodeID })
+	return members
+}
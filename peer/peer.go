@@ -21,15 +21,26 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package peer
 
 import (
-	"encoding/binary"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"nds/network"
 	"nds/util"
 	"net"
+	"sync"
 	"time"
 )
 
 const NodeSynchDuration = 2
 
+//seconds between two alive messages spontaneously sent by a synched daemon node;
+//they let nodes that failed to pull a value catch up with the cluster.
+const NodeAlivePeriod = 6
+
+//seconds allowed for a data transfer between two nodes
+const DataTransferTimeout = 5
+
 type Peer struct {
 	//configuration
 	Cfg util.Config
@@ -49,14 +60,44 @@ type Peer struct {
 	//the value shared across the cluster
 	Data string
 
+	//the node that set the value held by this node
+	Origin string
+
+	//the value held by this node has been deleted
+	Tombstone bool
+
+	//the time point at which this node took the tombstone it holds
+	tombSince time.Time
+
+	//the tombstone held by this node has been collected
+	tombCollected bool
+
+	//the time point at which the value held by this node expires (zero if it does not)
+	expiresAt time.Time
+
+	//fires when the value held by this node expires
+	expiry *time.Timer
+
+	//the daemon nodes known by this node, by identifier
+	members map[string]*Member
+
+	//the identifier of this node
+	NodeID string
+
+	//the values previously held by this node
+	history history
+
 	//exit required
 	ExitRequired bool
 
-	//network acceptor
-	acceptor network.Acceptor
+	//the time point at which this node will send the next periodic alive
+	tpNextAlive time.Time
 
-	//multicast manager
-	mcastHelper network.MCastHelper
+	//number of data requests sent to other nodes and still waiting for an answer
+	pendingPulls int
+
+	//network transport, defaults to network.Stack (UDP multicast + TCP)
+	Transport network.Transport
 
 	//channel used to serve incoming TCP connections
 	EnteringChan chan net.Conn
@@ -65,31 +106,333 @@ type Peer struct {
 	AliveChanIncoming chan util.AliveMsg
 	AliveChanOutgoing chan []byte
 
+	//channel used to receive data messages pulled from other nodes (TCP)
+	DataChanIncoming chan util.DataMsg
+
+	//channel used to run functions inside the events loop (see exec)
+	ctrlChan chan func()
+
+	//closed when the events loop ends
+	quitChan chan struct{}
+
+	//closed to ask the events loop to end (see Close)
+	closeChan chan struct{}
+	closeOnce sync.Once
+
+	//closed once the node is stopped, err tells why
+	doneChan chan struct{}
+	err      error
+
+	//sessions watching the value of this node
+	watchers map[*watcher]struct{}
+
+	//counters, updated inside the events loop
+	stats Stats
+
+	//signs the frames sent and verifies the frames received with the key of the cluster, if any
+	auth *util.Auth
+
+	//secures the point 2 point connections, if configured
+	tls *util.TLS
+
+	//proves that this node is a daemon, and tells the other daemons apart from the clients; nil without daemon-key
+	daemonKey *util.DaemonKey
+
+	//the clients allowed to write, nil if anyone is (see authorize); aclPulling tells a pull is in flight,
+	//aclRefused the last ACL pulled and refused (see aclPull), not pulled again
+	acl        *util.ACL
+	aclHash    string
+	aclPulling bool
+	aclRefused string
+
+	//reads the configuration again (see Reload); reloadMtx serializes reloads
+	reloader  Reloader
+	reloadMtx sync.Mutex
+
 	//logger
 	logger util.Logger
+
+	//logs the writes denied and the ACL changes
+	audit util.Logger
+}
+
+func (p *Peer) genTS() uint32 {
+	ts := uint32(time.Now().Unix())
+	//a value set by this node must win over any value this node knows about, even within the same second
+	if ts <= p.DesiredClusterTS {
+		ts = p.DesiredClusterTS + 1
+	}
+	return ts
 }
 
-func (p *Peer) genTS() {
-	p.DesiredClusterTS = uint32(time.Now().Unix())
-	p.CurrentNodeTS = p.DesiredClusterTS
+func genNodeID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-func (p *Peer) Run() error {
+//updateValue makes this node hold the value (or the tombstone) carried by msg
+func (p *Peer) updateValue(msg util.DataMsg) {
+	ts := uint32(msg.Ts)
+	p.Data = msg.Dv
+	p.Tombstone = msg.Tb
+	p.CurrentNodeTS = ts
+	p.Origin = msg.Og
+	if p.DesiredClusterTS < ts {
+		p.DesiredClusterTS = ts
+	}
+	if msg.Tb {
+		p.tombSince = time.Now()
+		p.tombCollected = false
+	}
+	p.armExpiry(msg)
+	p.stats.Updates++
+	p.history.add(HistoryEntry{Ts: ts, Value: msg.Dv, Origin: msg.Og, Tombstone: msg.Tb, TTL: time.Duration(msg.Tl) * time.Millisecond})
+	p.notifyWatchers()
+}
+
+//newValue returns val (living ttl milliseconds, if not 0), or a tombstone if tomb, set by this node with a fresh timestamp
+func (p *Peer) newValue(val string, tomb bool, ttl uint64) util.DataMsg {
+	return util.DataMsg{Dv: val, Og: p.NodeID, Pt: util.MsgPktTypeData, Tb: tomb, Tl: ttl, Ts: uint64(p.genTS())}
+}
+
+//Change is a write to the value shared across the cluster
+type Change struct {
+	//the new value, ignored when Delete
+	Value string
+
+	//drop the value instead
+	Delete bool
+
+	//the new value expires after TTL, if not 0
+	TTL time.Duration
+
+	//if not nil, the change is accepted only if this node is synched at this timestamp (see CompareAndSet)
+	IfTS *uint32
+
+	//if not nil, the value held at this timestamp is set again instead (see Restore); Value, Delete, TTL and IfTS
+	//are ignored
+	Restore *uint32
+
+	//who asks for the change, checked against the ACL of the cluster
+	Caller Caller
+}
 
+//Apply makes the cluster take c; it returns the new timestamp. Every write goes through it.
+//If the ACL of the cluster does not let c.Caller write, an NDSError with code RetCode_DENIED is returned.
+func (p *Peer) Apply(c Change) (uint32, error) {
+	op := util.ReqOpSet
+	switch {
+	case c.Restore != nil:
+		op = util.ReqOpRestore
+	case c.Delete:
+		op = util.ReqOpDel
+	}
+	if err := p.authorize(c.Caller, op); err != nil {
+		return 0, err
+	}
+
+	var ts uint32
+	var err *util.NDSError
+	if c.Restore != nil {
+		ts, err = p.restore(*c.Restore)
+	} else {
+		ts, err = p.set(util.DataMsg{Dv: c.Value, Tb: c.Delete, Tl: ttlMillis(c.TTL)}, c.IfTS)
+	}
+	if err != nil {
+		return ts, err
+	}
+	return ts, nil
+}
+
+//Get returns the value held by this node; TTL is the time it still has to live, if it expires.
+//An NDSError with code RetCode_NODATA is returned if there is no value (or it was deleted),
+//along with the timestamp of the deletion.
+func (p *Peer) Get() (HistoryEntry, error) {
+	var e HistoryEntry
+	if !p.exec(func() {
+		e = HistoryEntry{Ts: p.CurrentNodeTS, Value: p.Data, Origin: p.Origin, Tombstone: p.Tombstone,
+			TTL: time.Duration(p.remainingTTL()) * time.Millisecond}
+	}) {
+		return e, &util.NDSError{Code: util.RetCode_UNVRSC}
+	}
+	if e.Ts == 0 || e.Tombstone {
+		return e, &util.NDSError{Code: util.RetCode_NODATA}
+	}
+	return e, nil
+}
+
+//Set makes the cluster share val: this node takes it with a fresh timestamp and announces it.
+//It returns the new timestamp. The write is anonymous: it is checked against the ACL of the cluster (see Apply).
+func (p *Peer) Set(val string) (uint32, error) {
+	return p.Apply(Change{Value: val})
+}
+
+//CompareAndSet is like Set, but val is accepted only if this node is synched at timestamp ifTS.
+//Otherwise an NDSError with code RetCode_TSMISMT is returned, along with the timestamp this node
+//holds or is synching to.
+func (p *Peer) CompareAndSet(val string, ifTS uint32) (uint32, error) {
+	return p.Apply(Change{Value: val, IfTS: &ifTS})
+}
+
+//set makes this node take the value (or the tombstone) carried by msg with a fresh timestamp
+func (p *Peer) set(msg util.DataMsg, ifTS *uint32) (uint32, *util.NDSError) {
+	var ts uint32
+	var err *util.NDSError
+	if !p.exec(func() {
+		if ifTS != nil && (*ifTS != p.CurrentNodeTS || p.CurrentNodeTS != p.DesiredClusterTS) {
+			p.logger.Tracew("compare-and-set refused", util.FieldTS(uint64(p.CurrentNodeTS)),
+				util.FieldAny("desired_ts", p.DesiredClusterTS), util.FieldAny("expected_ts", *ifTS))
+			ts, err = p.DesiredClusterTS, &util.NDSError{Code: util.RetCode_TSMISMT}
+			return
+		}
+		p.updateValue(p.newValue(msg.Dv, msg.Tb, msg.Tl))
+		p.logger.Tracew("value set", util.FieldTS(uint64(p.CurrentNodeTS)), util.FieldAny("tombstone", p.Tombstone))
+		p.sendAliveMessage()
+		ts = p.CurrentNodeTS
+	}) {
+		return 0, &util.NDSError{Code: util.RetCode_UNVRSC}
+	}
+	return ts, err
+}
+
+//exec runs f inside the events loop and waits for its completion;
+//it returns false if the events loop is not running.
+func (p *Peer) exec(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case p.ctrlChan <- func() { f(); close(done) }:
+	case <-p.quitChan:
+		return false
+	}
+	<-done
+	return true
+}
+
+//New returns a node configured with cfg; the node joins the cluster with Start.
+//A different Transport can be set before Start.
+func New(cfg util.Config) (*Peer, error) {
+	p := &Peer{Cfg: cfg}
 	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//Run runs this node as configured until it stops:
+//a daemon node runs forever, a "pure" node runs until its job is done.
+func (p *Peer) Run() error {
+	if run := p.clientMode(); run != nil {
+		if err := p.initOnce(); err != nil {
+			return err
+		}
+		defer p.stop()
+		if err := p.start(); err != nil {
+			return err
+		}
+		return run()
+	}
+
+	if err := p.Start(context.Background()); err != nil {
+		return err
+	}
+	if err := p.Wait(); err != nil {
 		return err
 	}
 
+	if p.isGetter() {
+		return p.printValue()
+	}
+	return nil
+}
+
+//Start brings this node up: once it returns, the node is reachable by other nodes and it is joining the cluster.
+//The node stops when ctx is done, when Close is called or, for a "pure" node, when its job is done.
+func (p *Peer) Start(ctx context.Context) error {
+	if p.doneChan != nil {
+		return &util.NDSError{Code: util.RetCode_BADSTTS}
+	}
+	if err := p.initOnce(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err := p.start(); err != nil {
+		p.stop()
 		return err
 	}
 
-	if p.Cfg.Val != "" {
-		p.Data = p.Cfg.Val
-		p.genTS()
+	//the value of the configuration is a write like any other: the events loop is not running yet
+	if p.Cfg.Delete || p.Cfg.SetVal || p.Cfg.Val != "" {
+		op := util.ReqOpSet
+		if p.Cfg.Delete {
+			op = util.ReqOpDel
+		}
+		if err := p.authorizeWith(p.acl, Caller{Addr: "local", Token: p.Cfg.Token}, op); err != nil {
+			p.stop()
+			return err
+		}
+	}
+	if p.Cfg.Delete {
+		p.updateValue(p.newValue("", true, 0))
+	} else if p.Cfg.SetVal || p.Cfg.Val != "" {
+		p.updateValue(p.newValue(p.Cfg.Val, false, ttlMillis(p.Cfg.TTL)))
 	}
 
-	return p.processEvents()
+	p.doneChan = make(chan struct{})
+	go func() {
+		p.err = p.processEvents()
+		p.stop()
+		close(p.doneChan)
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Close()
+		case <-p.doneChan:
+		}
+	}()
+
+	return nil
+}
+
+//Wait blocks until this node stops and returns the error that stopped it, if any
+func (p *Peer) Wait() error {
+	if p.doneChan == nil {
+		return &util.NDSError{Code: util.RetCode_BADSTTS}
+	}
+	<-p.doneChan
+	return p.err
+}
+
+//Done returns a channel closed once this node is stopped
+func (p *Peer) Done() <-chan struct{} {
+	return p.doneChan
+}
+
+//Close stops this node and waits until it is stopped
+func (p *Peer) Close() error {
+	if p.doneChan == nil {
+		return nil
+	}
+	p.closeOnce.Do(func() { close(p.closeChan) })
+	return p.Wait()
+}
+
+//TLS returns the certificates securing the connections of this node, for the front-ends to secure theirs;
+//nil if the node is not initialized
+func (p *Peer) TLS() *util.TLS {
+	return p.tls
+}
+
+//initOnce initializes this node, unless New already did
+func (p *Peer) initOnce() error {
+	if p.ctrlChan != nil {
+		return nil
+	}
+	return p.init()
 }
 
 func (p *Peer) init() error {
@@ -97,40 +440,77 @@ func (p *Peer) init() error {
 	if err := p.logger.Init("peer.", &p.Cfg); err != nil {
 		return err
 	}
+	if err := p.audit.Init("audit.", &p.Cfg); err != nil {
+		return err
+	}
 
 	p.EnteringChan = make(chan net.Conn)
 	p.AliveChanIncoming = make(chan util.AliveMsg)
-	p.AliveChanOutgoing = make(chan []byte)
-
-	//seconds before this node will auto generate the timestamp
-	p.TpInitialSynchWindow = time.Now().Add(time.Second * NodeSynchDuration)
+	p.AliveChanOutgoing = make(chan []byte, 16)
+	p.DataChanIncoming = make(chan util.DataMsg)
+	p.ctrlChan = make(chan func())
+	p.quitChan = make(chan struct{})
+	p.closeChan = make(chan struct{})
+	p.watchers = make(map[*watcher]struct{})
+	p.members = make(map[string]*Member)
+	p.stats = Stats{Started: time.Now()}
+	p.history.init(p.Cfg.HistorySize)
+
+	keys, err := util.ReadAuthKeys(p.Cfg.AuthKeyFile)
+	if err != nil {
+		p.logger.Err("reading auth keys:%s", err.Error())
+		return &util.NDSError{Code: util.RetCode_BADCFG}
+	}
+	p.auth = util.NewAuth(keys)
+	p.auth.SetEncryption(p.Cfg.EncryptMulticast)
+	p.auth.SetReplayWindow(p.Cfg.AuthMaxSkew)
+	if p.tls, err = util.LoadTLS(&p.Cfg); err != nil {
+		p.logger.Err("loading certificates:%s", err.Error())
+		return err
+	}
+	if keys, err = util.ReadAuthKeys(p.Cfg.DaemonKeyFile); err != nil {
+		p.logger.Err("reading daemon keys:%s", err.Error())
+		return &util.NDSError{Code: util.RetCode_BADCFG}
+	}
+	p.daemonKey = util.NewDaemonKey(keys)
 
-	p.acceptor.Cfg = &p.Cfg
-	p.acceptor.EnteringChan = p.EnteringChan
+	if p.acl, err = util.ReadACL(p.Cfg.ACLFile); err != nil {
+		p.logger.Err("reading acl:%s", err.Error())
+		return &util.NDSError{Code: util.RetCode_BADCFG}
+	}
+	p.aclHash = p.acl.Hash()
 
-	p.mcastHelper.Cfg = &p.Cfg
-	p.mcastHelper.AliveChanIncoming = p.AliveChanIncoming
-	p.mcastHelper.AliveChanOutgoing = p.AliveChanOutgoing
+	if p.NodeID = p.Cfg.NodeID; p.NodeID == "" {
+		p.NodeID = genNodeID()
+	}
+	p.logger = p.logger.With(util.FieldNodeID(p.NodeID))
+	p.audit = p.audit.With(util.FieldNodeID(p.NodeID))
 
 	return nil
 }
 
 func (p *Peer) start() error {
+	if p.Transport == nil {
+		p.Transport = &network.Stack{}
+	}
+	if t, ok := p.Transport.(network.Authenticated); ok {
+		t.SetAuth(p.auth)
+	}
+	if t, ok := p.Transport.(network.Secured); ok {
+		t.SetTLS(p.tls)
+	}
 
-	p.logger.Trace("starting acceptor ...")
-	go p.acceptor.Run()
-	//@fixme wait
-
-	p.logger.Trace("starting multicast ...")
-	go p.mcastHelper.Run()
-	//@fixme wait
-
-	return nil
+	p.logger.Trace("starting transport ...")
+	//seconds before this node will auto generate the timestamp
+	p.TpInitialSynchWindow = time.Now().Add(time.Second * NodeSynchDuration)
+	return p.Transport.Start(&p.Cfg, p.EnteringChan, p.AliveChanIncoming, p.AliveChanOutgoing)
 }
 
 func (p *Peer) stop() error {
+	err := p.Transport.Stop()
+	p.audit.Stop()
 	p.logger.Stop()
-	return nil
+	return err
 }
 
 func (p *Peer) processEvents() error {
@@ -138,6 +518,10 @@ func (p *Peer) processEvents() error {
 
 	interrupter := time.NewTicker(time.Second * 2)
 	defer interrupter.Stop()
+	defer close(p.quitChan)
+
+	//let the cluster know this node is up: a node still synching announces a zero timestamp
+	p.sendAliveMessage()
 
 out:
 	for {
@@ -147,12 +531,25 @@ out:
 				break out
 			}
 		case conn := <-p.EnteringChan:
-			p.sendDataMessage(conn)
+			go p.serveConn(conn)
 		case msg := <-p.AliveChanIncoming:
-			p.logger.Trace("msg:%v", msg)
+			p.logger.Tracew("alive received", util.FieldPktType(msg.Pt), util.FieldPeer(msg.Si, uint(msg.Lp)),
+				util.FieldTS(msg.Ts), util.FieldAny("peer_node_id", msg.Ni), util.FieldAny("daemon", msg.Dn))
 			if err := p.processAliveMsg(msg); err != nil && err.Code == util.RetCode_EXIT {
 				break out
 			}
+		case msg := <-p.DataChanIncoming:
+			p.logger.Tracew("data received", util.FieldPktType(msg.Pt), util.FieldTS(msg.Ts),
+				util.FieldAny("origin", msg.Og), util.FieldAny("tombstone", msg.Tb))
+			if err := p.processDataMsg(msg); err != nil && err.Code == util.RetCode_EXIT {
+				break out
+			}
+		case f := <-p.ctrlChan:
+			f()
+		case <-p.expiryChan():
+			p.expireValue()
+		case <-p.closeChan:
+			break out
 		}
 	}
 
@@ -172,10 +569,19 @@ func (p *Peer) processNodeStatus() *util.NDSError {
 		return &util.NDSError{Code: util.RetCode_EXIT}
 	}
 
-	//if no other node has still responded to initial alive, the node generates itself the timestamp
+	//if no other node has still responded to initial alive, the node generates itself the timestamp:
+	//the cluster holds no value yet.
 	if p.CurrentNodeTS == 0 && p.DesiredClusterTS == 0 && now.After(p.TpInitialSynchWindow) {
-		p.genTS()
-		p.logger.Trace("auto generated timestamp: %d", p.CurrentNodeTS)
+		p.updateValue(p.newValue("", true, 0))
+		p.logger.Tracew("auto generated timestamp", util.FieldTS(uint64(p.CurrentNodeTS)))
+		p.sendAliveMessage()
+	}
+
+	p.expireMembers(now)
+	p.collectTombstone(now)
+
+	//a synched daemon node periodically reminds the cluster of its timestamp
+	if p.Cfg.StartNode && p.CurrentNodeTS != 0 && p.CurrentNodeTS == p.DesiredClusterTS && now.After(p.tpNextAlive) {
 		p.sendAliveMessage()
 	}
 
@@ -183,6 +589,9 @@ func (p *Peer) processNodeStatus() *util.NDSError {
 }
 
 func (p *Peer) processAliveMsg(msg util.AliveMsg) *util.NDSError {
+	p.stats.AlivesReceived++
+	p.trackMember(msg)
+	p.processACL(msg)
 
 	if p.CurrentNodeTS == 0 && msg.Ts == 0 {
 		p.logger.Trace("discarding alive evt from other newly spawned node: this node is still synching")
@@ -191,17 +600,22 @@ func (p *Peer) processAliveMsg(msg util.AliveMsg) *util.NDSError {
 
 	if p.CurrentNodeTS > uint32(msg.Ts) {
 		if p.CurrentNodeTS == p.DesiredClusterTS {
-			p.logger.Trace("other node is not updated: [this_ts > other_ts], notifying it ...")
+			p.logger.Tracew("other node is not updated: [this_ts > other_ts], notifying it ...",
+				util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldTS(msg.Ts))
 			p.sendAliveMessage()
 		}
 		// else {
 		//   this node is already synching with the cluster; do not send potentially useless alive.
 		// }
 	} else if p.CurrentNodeTS < uint32(msg.Ts) {
-		if p.DesiredClusterTS < uint32(msg.Ts) {
+		if m, ok := p.members[msg.Ni]; ok && m.denied == uint32(msg.Ts) {
+			p.logger.Tracew("value of other node denied by the ACL, not requested again",
+				util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldTS(msg.Ts))
+		} else if p.DesiredClusterTS < uint32(msg.Ts) {
 			p.DesiredClusterTS = uint32(msg.Ts)
-			p.logger.Trace("this node is not updated: [this_ts < other_ts], requesting updated data ...")
-			//@todo
+			p.logger.Tracew("this node is not updated: [this_ts < other_ts], requesting updated data ...",
+				util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldTS(msg.Ts))
+			p.requestData(msg)
 		}
 		// else {
 		//   already requested to someone else, do nothing
@@ -214,8 +628,100 @@ func (p *Peer) processAliveMsg(msg util.AliveMsg) *util.NDSError {
 	return nil
 }
 
+func (p *Peer) processDataMsg(msg util.DataMsg) *util.NDSError {
+	p.pendingPulls--
+	if msg.Ts == 0 {
+		p.stats.PullsFailed++
+	} else {
+		p.stats.PullsSucceeded++
+	}
+
+	if p.CurrentNodeTS < uint32(msg.Ts) {
+		p.logger.Tracew("updating value: [this_ts < data_ts]", util.FieldAny("this_ts", p.CurrentNodeTS), util.FieldTS(msg.Ts))
+		p.updateValue(msg)
+	}
+
+	if p.DesiredClusterTS < p.CurrentNodeTS {
+		p.DesiredClusterTS = p.CurrentNodeTS
+	}
+
+	//a "pure" getter node is done as soon as it is synched
+	if p.isGetter() && p.CurrentNodeTS != 0 && p.CurrentNodeTS == p.DesiredClusterTS && p.pendingPulls == 0 {
+		return &util.NDSError{Code: util.RetCode_EXIT}
+	}
+
+	//no more requests in flight but desired timestamp not reached (the foreign node died or failed):
+	//give up, the desired timestamp will be requested again upon next alive
+	if p.pendingPulls == 0 && p.CurrentNodeTS != p.DesiredClusterTS {
+		p.logger.Trace("could not reach desired timestamp: %d, still at: %d", p.DesiredClusterTS, p.CurrentNodeTS)
+		p.DesiredClusterTS = p.CurrentNodeTS
+	}
+
+	return nil
+}
+
+//requestData pulls the value from the node that sent msg;
+//the outcome is delivered back to the events loop through DataChanIncoming,
+//on failure an empty data message is delivered.
+func (p *Peer) requestData(msg util.AliveMsg) {
+	p.pendingPulls++
+	p.stats.Pulls++
+
+	go func() {
+		start := time.Now()
+		var nread int
+		var denied bool
+		data := util.DataMsg{Pt: util.MsgPktTypeData}
+		if conn, err := p.Transport.Dial(msg.Si, uint(msg.Lp)); err != nil {
+			p.logger.Errw("dialing", util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldErr(err))
+		} else {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second * DataTransferTimeout))
+			req := p.daemonRequest(util.ReqOpGet)
+			if err := p.sendRequest(conn, req); err != nil {
+				p.logger.Errw("sending request msg", util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldErr(err))
+			} else if buff, err := p.readFrame(conn); err != nil {
+				p.logger.Errw("receiving data msg", util.FieldPeer(msg.Si, uint(msg.Lp)), util.FieldErr(err))
+			} else if err := json.Unmarshal(buff, &data); err != nil {
+				p.logger.Err("Unmarshal:%s", err.Error())
+				data = util.DataMsg{Pt: util.MsgPktTypeData}
+			} else {
+				nread = 4 + len(buff)
+				//a value pulled from a node that does not prove itself a daemon, as a "pure" setter node,
+				//is a write of its user
+				unproven := data
+				unproven.Dp = ""
+				if p.Cfg.StartNode && !p.proven(req.Nc, data.Dp, &unproven) {
+					op := util.ReqOpSet
+					if data.Tb {
+						op = util.ReqOpDel
+					}
+					if p.authorize(dialedCaller(conn, data.Tk), op) != nil {
+						data, denied = util.DataMsg{Pt: util.MsgPktTypeData}, true
+					}
+				}
+			}
+		}
+		p.exec(func() {
+			p.stats.PullBytes += uint64(nread)
+			p.stats.PullTime += time.Since(start)
+			if m, ok := p.members[msg.Ni]; ok && denied {
+				m.denied = uint32(msg.Ts)
+			}
+		})
+		select {
+		case p.DataChanIncoming <- data:
+		case <-p.quitChan:
+		}
+	}()
+}
+
 func (p *Peer) buildAliveMessage() ([]byte, error) {
-	msg := util.AliveMsg{Lp: uint16(p.acceptor.ListenPort), Pt: util.MsgPktTypeAlive, Si: p.acceptor.Listener.Addr().String(), Ts: uint64(p.CurrentNodeTS)}
+	si, lp := p.Transport.Addr()
+	msg := util.AliveMsg{Dn: p.Cfg.StartNode, Lp: uint16(lp), Ni: p.NodeID, Pt: util.MsgPktTypeAlive, Si: si, Ts: uint64(p.CurrentNodeTS)}
+	if p.Cfg.StartNode && p.acl != nil {
+		msg.Av, msg.Ah = p.acl.Version, p.aclHash
+	}
 	return msg.MarshalJSON()
 }
 
@@ -224,31 +730,22 @@ func (p *Peer) sendAliveMessage() error {
 		p.logger.Err("building alive msg:%s", err.Error())
 		return err
 	} else {
-		outgBuff := make([]byte, len(msg)+4)
-		binary.LittleEndian.PutUint32(outgBuff[0:4], uint32(len(msg)))
-		copy(outgBuff[4:], msg)
-		p.AliveChanOutgoing <- outgBuff
+		p.AliveChanOutgoing <- util.NewFrame(msg)
+		p.stats.AlivesSent++
 	}
+	p.tpNextAlive = time.Now().Add(time.Second * NodeAlivePeriod)
 	return nil
 }
 
-func (p *Peer) buildDataMessage() ([]byte, error) {
-	msg := util.DataMsg{Dv: p.Data, Pt: util.MsgPktTypeData, Ts: uint64(p.CurrentNodeTS)}
-	return msg.MarshalJSON()
+func (p *Peer) currentDataMsg() util.DataMsg {
+	return util.DataMsg{Dv: p.Data, Og: p.Origin, Pt: util.MsgPktTypeData, Tb: p.Tombstone, Tl: p.remainingTTL(), Ts: uint64(p.CurrentNodeTS)}
 }
 
-func (p *Peer) sendDataMessage(conn net.Conn) error {
-
-	if msg, err := p.buildDataMessage(); err != nil {
-		p.logger.Err("building data msg:%s", err.Error())
-		return err
-	} else {
-		sent, err := conn.Write(msg)
-		if err != nil {
-			p.logger.Err("sending data msg:%s", err.Error())
-		}
-		p.logger.Trace("sent %d bytes to: %s", sent, conn.RemoteAddr().String())
+//buildDataMessage returns the Data message answering a get request carrying the challenge nonce
+func (p *Peer) buildDataMessage(nonce string) ([]byte, error) {
+	msg := p.currentDataMsg()
+	if !p.Cfg.StartNode {
+		msg.Tk = p.Cfg.Token
 	}
-
-	return nil
+	return p.prove(nonce, &msg, &msg.Dp)
 }
@@ -0,0 +1,151 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package peer
+
+import (
+	"nds/util"
+	"sort"
+	"strings"
+)
+
+//Reloader returns the configuration of a daemon node as read at startup, e.g. from the command line and the config file
+type Reloader func() (util.Config, error)
+
+//SetReloader sets the function Reload reads the configuration with
+func (p *Peer) SetReloader(r Reloader) {
+	p.reloadMtx.Lock()
+	defer p.reloadMtx.Unlock()
+	p.reloader = r
+}
+
+/**
+ * Reload reads the configuration again and applies the settings that can change while this node runs:
+ * logging (destination, verbosity, format, rotation), history-size, tombstone-grace, auth-grace, auth-max-skew,
+ * encrypt-multicast, the keys of the auth-key file, which are rotated (see util.Auth.Rotate), and the TLS certificates, which are used
+ * by the connections established afterwards; turning TLS on or off takes a restart. The ACL of the acl file is
+ * taken if it supersedes the one held, and then replicated across the cluster; an older one is ignored.
+ * The other settings changed are returned along with them, but they take a restart.
+ * If the configuration cannot be read, or a log, key, certificate or ACL file cannot be opened, nothing changes.
+ * The outcome is logged.
+ */
+func (p *Peer) Reload() ([]util.SettingChange, error) {
+	p.reloadMtx.Lock()
+	defer p.reloadMtx.Unlock()
+	if p.reloader == nil {
+		p.logger.Warn("reload: no configuration to read")
+		return nil, &util.NDSError{Code: util.RetCode_UNSP}
+	}
+
+	next, err := p.reloader()
+	if err != nil {
+		p.logger.Errw("reload failed, configuration unchanged", util.FieldErr(err))
+		return nil, err
+	}
+	var current util.Config
+	var currentACL *util.ACL
+	if !p.exec(func() { current, currentACL = p.Cfg, p.acl }) {
+		return nil, &util.NDSError{Code: util.RetCode_BADSTTS}
+	}
+
+	changes := current.Changes(&next)
+	keys, err := util.ReadAuthKeys(next.AuthKeyFile)
+	if err != nil {
+		p.logger.Errw("reload failed, configuration unchanged", util.FieldErr(err))
+		return nil, &util.ConfigError{Setting: "auth-key", Reason: err.Error()}
+	}
+	nextTLS, err := util.LoadTLS(&next)
+	if err != nil {
+		p.logger.Errw("reload failed, configuration unchanged", util.FieldErr(err))
+		return nil, err
+	}
+	acl, err := util.ReadACL(next.ACLFile)
+	if err != nil {
+		p.logger.Errw("reload failed, configuration unchanged", util.FieldErr(err))
+		return nil, &util.ConfigError{Setting: "acl", Reason: err.Error()}
+	}
+	aclReload := acl.Newer(currentACL)
+	if aclReload {
+		changes = append(changes, util.SettingChange{Setting: "acl", Old: currentACL.String(), New: acl.String(), Reloadable: true})
+	} else if acl != nil && acl.Hash() != currentACL.Hash() {
+		p.logger.Warnw("acl file ignored, the cluster holds a newer acl", util.FieldAny("file", acl.String()), util.FieldAny("held", currentACL.String()))
+	}
+	oldIDs, newIDs := p.auth.KeyIDs(), util.NewAuth(keys).KeyIDs()
+	if oldIDs != newIDs {
+		changes = append(changes, util.SettingChange{Setting: "auth-key", Old: oldIDs, New: newIDs, Reloadable: true})
+	}
+	tlsReload := p.tls.Enabled() == nextTLS.Enabled()
+	changes = append(changes, p.tls.Changes(nextTLS)...)
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Reloadable && !changes[j].Reloadable })
+	for _, c := range changes {
+		if c.Reloadable && (c.Setting == "log" || c.Setting == "verbosity" || strings.HasPrefix(c.Setting, "log-")) {
+			if err := util.ReconfigureLogs(&next); err != nil {
+				p.logger.Errw("reload failed, configuration unchanged", util.FieldErr(err))
+				return nil, err
+			}
+			break
+		}
+	}
+
+	p.exec(func() {
+		p.Cfg.LogType, p.Cfg.LogLevel, p.Cfg.LogFormat, p.Cfg.LogShared = next.LogType, next.LogLevel, next.LogFormat, next.LogShared
+		p.Cfg.LogMaxSize, p.Cfg.LogMaxAge, p.Cfg.LogMaxBackups, p.Cfg.LogCompress = next.LogMaxSize, next.LogMaxAge, next.LogMaxBackups, next.LogCompress
+		if p.Cfg.HistorySize != next.HistorySize {
+			p.history.resize(next.HistorySize)
+		}
+		p.Cfg.HistorySize = next.HistorySize
+		p.Cfg.TombstoneGrace = next.TombstoneGrace
+		p.Cfg.AuthKeyFile, p.Cfg.AuthGrace, p.Cfg.EncryptMulticast = next.AuthKeyFile, next.AuthGrace, next.EncryptMulticast
+		p.Cfg.AuthMaxSkew = next.AuthMaxSkew
+		p.Cfg.ACLFile = next.ACLFile
+		if aclReload {
+			p.takeACL(acl, next.ACLFile)
+		}
+		if tlsReload {
+			p.Cfg.TLSCertFile, p.Cfg.TLSKeyFile, p.Cfg.TLSCAFile, p.Cfg.TLSVerifyClients = next.TLSCertFile, next.TLSKeyFile, next.TLSCAFile, next.TLSVerifyClients
+		}
+	})
+	if tlsReload {
+		p.tls.Update(nextTLS)
+	}
+	if oldIDs != newIDs {
+		grace := next.AuthGrace
+		if grace == 0 {
+			grace = util.DefaultAuthGrace
+		}
+		p.auth.Rotate(keys, grace)
+	}
+	p.auth.SetEncryption(next.EncryptMulticast)
+	p.auth.SetReplayWindow(next.AuthMaxSkew)
+
+	applied := 0
+	for _, c := range changes {
+		fields := []util.Field{util.FieldAny("setting", c.Setting), util.FieldAny("old", c.Old), util.FieldAny("new", c.New)}
+		if c.Reloadable {
+			applied++
+			p.logger.Infow("setting reloaded", fields...)
+		} else {
+			p.logger.Warnw("setting changed, it takes a restart", fields...)
+		}
+	}
+	p.logger.Infow("configuration reloaded", util.FieldAny("applied", applied), util.FieldAny("restart_required", len(changes)-applied))
+	return changes, nil
+}
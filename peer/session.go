@@ -0,0 +1,231 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"nds/util"
+	"net"
+	"time"
+)
+
+//serveConn serves a point 2 point connection accepted by this node;
+//the first packet sent by the remote side is a request telling what it wants.
+func (p *Peer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * DataTransferTimeout))
+	req := util.ReqMsg{}
+	if buff, err := p.readFrame(conn); err != nil {
+		p.logger.Err("receiving request msg:%s", err.Error())
+		return
+	} else if err := json.Unmarshal(buff, &req); err != nil {
+		p.logger.Err("Unmarshal:%s", err.Error())
+		p.exec(func() { p.stats.Malformed++ })
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	p.logger.Tracew("request received", util.FieldPktType(req.Pt), util.FieldPeer(conn.RemoteAddr().String(), 0),
+		util.FieldAny("op", req.Op), util.FieldTS(req.Ts))
+
+	//the reads are denied by closing the connection, the writes are answered (see serveSet)
+	switch req.Op {
+	case util.ReqOpGet, util.ReqOpWatch, util.ReqOpHist, util.ReqOpMembers, util.ReqOpACL:
+		if !p.provenDaemon(req) && p.authorize(ConnCaller(conn, req.Tk), req.Op) != nil {
+			return
+		}
+	}
+
+	switch req.Op {
+	case util.ReqOpGet:
+		p.serveGet(conn, req)
+	case util.ReqOpWatch:
+		p.serveWatch(conn, req)
+	case util.ReqOpSet, util.ReqOpDel:
+		p.serveSet(conn, req)
+	case util.ReqOpHist:
+		p.serveHist(conn)
+	case util.ReqOpRestore:
+		p.serveRestore(conn, req)
+	case util.ReqOpMembers:
+		p.serveMembers(conn)
+	case util.ReqOpACL:
+		p.serveACL(conn, req)
+	default:
+		p.logger.Err("unsupported request:%s from: %s", req.Op, conn.RemoteAddr().String())
+	}
+}
+
+func (p *Peer) serveGet(conn net.Conn, req util.ReqMsg) {
+	var msg []byte
+	var err error
+	if !p.exec(func() { msg, err = p.buildDataMessage(req.Nc) }) {
+		return
+	}
+	if err != nil {
+		p.logger.Err("building data msg:%s", err.Error())
+		return
+	}
+	p.sendDataMessage(conn, msg)
+}
+
+func (p *Peer) serveWatch(conn net.Conn, req util.ReqMsg) {
+	w, ok := p.watch(uint32(req.Ts))
+	if !ok {
+		return
+	}
+	defer p.unwatch(w)
+
+	//the watcher is not expected to send anything else: a read returns once it goes away
+	gone := make(chan struct{})
+	go func() {
+		var b [1]byte
+		conn.Read(b[:])
+		close(gone)
+	}()
+
+	for {
+		select {
+		case msg, ok := <-w.ch:
+			if !ok {
+				//the watcher resumes from the last value it got
+				p.logger.Trace("watcher fell behind: %s", conn.RemoteAddr().String())
+				return
+			}
+			buff, err := msg.MarshalJSON()
+			if err != nil {
+				p.logger.Err("building data msg:%s", err.Error())
+				return
+			}
+			if !p.sendDataMessage(conn, buff) {
+				return
+			}
+		case <-gone:
+			p.logger.Trace("watcher gone: %s", conn.RemoteAddr().String())
+			return
+		case <-p.quitChan:
+			return
+		}
+	}
+}
+
+func (p *Peer) serveSet(conn net.Conn, req util.ReqMsg) {
+	var ifTS *uint32
+	if req.Ct != nil {
+		ts := uint32(*req.Ct)
+		ifTS = &ts
+	}
+	if err := p.authorize(ConnCaller(conn, req.Tk), req.Op); err != nil {
+		p.sendRespMessage(conn, 0, err)
+		return
+	}
+
+	ts, err := p.set(util.DataMsg{Dv: req.Dv, Tb: req.Op == util.ReqOpDel, Tl: req.Tl}, ifTS)
+	p.sendRespMessage(conn, ts, err)
+}
+
+func (p *Peer) serveRestore(conn net.Conn, req util.ReqMsg) {
+	if err := p.authorize(ConnCaller(conn, req.Tk), req.Op); err != nil {
+		p.sendRespMessage(conn, 0, err)
+		return
+	}
+	ts, err := p.restore(uint32(req.Ts))
+	p.sendRespMessage(conn, ts, err)
+}
+
+func (p *Peer) serveHist(conn net.Conn) {
+	resp := util.HistMsg{Pt: util.MsgPktTypeHist, Hs: []util.DataMsg{}}
+	for _, e := range p.History() {
+		resp.Hs = append(resp.Hs, util.DataMsg{Dv: e.Value, Og: e.Origin, Pt: util.MsgPktTypeData, Tb: e.Tombstone, Ts: uint64(e.Ts)})
+	}
+
+	if msg, err := resp.MarshalJSON(); err != nil {
+		p.logger.Err("building hist msg:%s", err.Error())
+	} else {
+		p.sendDataMessage(conn, msg)
+	}
+}
+
+func (p *Peer) serveMembers(conn net.Conn) {
+	//this node is reached at the address the remote side connected to
+	si, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	self := p.Self(si)
+	resp := util.MembersMsg{Pt: util.MsgPktTypeMemb, Mb: []util.AliveMsg{
+		{Dn: p.Cfg.StartNode, Lp: uint16(self.Port), Ni: self.NodeID, Pt: util.MsgPktTypeAlive, Si: si, Ts: uint64(self.Ts)},
+	}}
+	for _, m := range p.Members() {
+		resp.Mb = append(resp.Mb, util.AliveMsg{Dn: true, Lp: uint16(m.Port), Ni: m.NodeID, Pt: util.MsgPktTypeAlive, Si: m.Address, Ts: uint64(m.Ts)})
+	}
+
+	if msg, err := resp.MarshalJSON(); err != nil {
+		p.logger.Err("building members msg:%s", err.Error())
+	} else {
+		p.sendDataMessage(conn, msg)
+	}
+}
+
+func (p *Peer) sendRespMessage(conn net.Conn, ts uint32, err *util.NDSError) {
+	resp := util.RespMsg{Pt: util.MsgPktTypeResp, Rc: util.RetCode_OK, Ts: uint64(ts)}
+	if err != nil {
+		resp.Rc = err.Code
+	}
+
+	if msg, err := resp.MarshalJSON(); err != nil {
+		p.logger.Err("building resp msg:%s", err.Error())
+	} else {
+		p.sendDataMessage(conn, msg)
+	}
+}
+
+func (p *Peer) sendDataMessage(conn net.Conn, msg []byte) bool {
+	conn.SetWriteDeadline(time.Now().Add(time.Second * DataTransferTimeout))
+	if sent, err := conn.Write(p.auth.NewFrame(msg)); err != nil {
+		p.logger.Err("sending data msg:%s", err.Error())
+		return false
+	} else {
+		p.logger.Trace("sent %d bytes to: %s", sent, conn.RemoteAddr().String())
+	}
+	return true
+}
+
+func (p *Peer) sendRequest(conn net.Conn, req util.ReqMsg) error {
+	req.Pt = util.MsgPktTypeReq
+	buff, err := req.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(p.auth.NewFrame(buff))
+	return err
+}
+
+//readFrame reads a frame from conn and returns its body once verified;
+//a frame failing verification is counted as dropped, when the events loop runs.
+func (p *Peer) readFrame(conn net.Conn) ([]byte, error) {
+	buff, err := p.auth.ReadFrame(conn)
+	var authErr *util.AuthError
+	if errors.As(err, &authErr) {
+		p.logger.Warnw("packet dropped", util.FieldPeer(conn.RemoteAddr().String(), 0), util.FieldErr(err))
+		p.exec(func() { p.stats.Dropped++ })
+	}
+	return buff, err
+}
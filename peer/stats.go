@@ -0,0 +1,89 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package peer
+
+import (
+	"nds/network"
+	"time"
+)
+
+//Stats are the counters of a node
+type Stats struct {
+	//the time point at which the node started
+	Started time.Time
+
+	//the timestamp held by the node and the one it is synching to
+	Ts        uint32
+	DesiredTs uint32
+
+	//the daemon nodes known by the node, the node excluded
+	Members int
+
+	//the sessions watching the value of the node
+	Watchers int
+
+	//values (or tombstones) taken by the node, either set by it or pulled from other nodes
+	Updates uint64
+
+	//alive messages sent and received
+	AlivesSent     uint64
+	AlivesReceived uint64
+
+	//data requests sent to other nodes (some may still be in flight), the ones that succeeded and the ones that failed
+	Pulls          uint64
+	PullsSucceeded uint64
+	PullsFailed    uint64
+
+	//bytes received and time spent by the data requests completed
+	PullBytes uint64
+	PullTime  time.Duration
+
+	//requests received by the node that could not be decoded
+	Malformed uint64
+
+	//frames received by the node dropped because not authenticated (RetCode_DRPPKT)
+	Dropped uint64
+
+	//the port the node listens on
+	Port uint
+
+	//the counters of the transport, if it keeps them (see network.Metered)
+	Network network.Counters
+}
+
+//Stats returns the counters of this node
+func (p *Peer) Stats() Stats {
+	var s Stats
+	p.exec(func() {
+		s = p.stats
+		s.Ts, s.DesiredTs = p.CurrentNodeTS, p.DesiredClusterTS
+		s.Members = len(p.members)
+		s.Watchers = len(p.watchers)
+	})
+	if p.Transport != nil {
+		_, s.Port = p.Transport.Addr()
+		if m, ok := p.Transport.(network.Metered); ok {
+			s.Network = m.Counters()
+		}
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package peer
+
+import (
+	"time"
+)
+
+//time a tombstone is retained, when not configured, before it can be collected
+const DefaultTombstoneGrace = 10 * time.Minute
+
+//Delete makes the cluster drop the value: this node takes a tombstone with a fresh timestamp and announces it.
+//It returns the timestamp of the tombstone. The write is anonymous, as for Set.
+func (p *Peer) Delete() (uint32, error) {
+	return p.Apply(Change{Delete: true})
+}
+
+//CompareAndDelete is like Delete, but the value is dropped only if this node is synched at timestamp ifTS
+//(see CompareAndSet).
+func (p *Peer) CompareAndDelete(ifTS uint32) (uint32, error) {
+	return p.Apply(Change{Delete: true, IfTS: &ifTS})
+}
+
+func (p *Peer) tombstoneGrace() time.Duration {
+	if p.Cfg.TombstoneGrace == 0 {
+		return DefaultTombstoneGrace
+	}
+	return p.Cfg.TombstoneGrace
+}
+
+//collectTombstone drops the deleted values, and the entry of the tombstone, from the history of this node;
+//this happens once the grace period elapsed and all the known members acknowledged the tombstone,
+//that is, they announced its timestamp or a newer one.
+//The tombstone stays the value held by this node (it is what the node announces and serves) until the next write:
+//dropping it would let an older value held by a lagging node come back.
+func (p *Peer) collectTombstone(now time.Time) {
+	if !p.Tombstone || p.tombCollected || p.CurrentNodeTS != p.DesiredClusterTS {
+		return
+	}
+	if now.Sub(p.tombSince) < p.tombstoneGrace() || !p.membersAt(p.CurrentNodeTS) {
+		return
+	}
+	//an expired value is followed by the entry of its expiry, newer than the timestamp held
+	ts := p.CurrentNodeTS
+	if entries := p.history.list(); len(entries) > 0 && entries[len(entries)-1].Tombstone && entries[len(entries)-1].Ts > ts {
+		ts = entries[len(entries)-1].Ts
+	}
+	p.history.purge(ts)
+	p.tombCollected = true
+	p.logger.Trace("tombstone collected: %d", p.CurrentNodeTS)
+}
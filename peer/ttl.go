@@ -0,0 +1,94 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package peer
+
+import (
+	"nds/util"
+	"time"
+)
+
+//SetWithTTL is like Set, but val expires after ttl: every node then reads it as absent.
+func (p *Peer) SetWithTTL(val string, ttl time.Duration) (uint32, error) {
+	return p.Apply(Change{Value: val, TTL: ttl})
+}
+
+//ttlMillis converts ttl to the milliseconds carried by a Data packet; a positive ttl is never rounded to 0
+func ttlMillis(ttl time.Duration) uint64 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ms := uint64(ttl / time.Millisecond); ms > 0 {
+		return ms
+	}
+	return 1
+}
+
+//armExpiry makes the value held by this node expire after the time to live carried by msg, if any;
+//the countdown relies on the monotonic clock of this node only.
+func (p *Peer) armExpiry(msg util.DataMsg) {
+	if p.expiry != nil {
+		p.expiry.Stop()
+		p.expiry = nil
+	}
+	p.expiresAt = time.Time{}
+	if msg.Tb || msg.Tl == 0 {
+		return
+	}
+	ttl := time.Duration(msg.Tl) * time.Millisecond
+	p.expiresAt = time.Now().Add(ttl)
+	p.expiry = time.NewTimer(ttl)
+}
+
+//expiryChan returns the channel signaling the expiry of the value held by this node, nil if it does not expire
+func (p *Peer) expiryChan() <-chan time.Time {
+	if p.expiry == nil {
+		return nil
+	}
+	return p.expiry.C
+}
+
+//expireValue replaces the expired value held by this node with a tombstone;
+//the timestamp is kept: every node holding the value expires it the same way, so no synch is needed.
+//The history records the tombstone at the time the value expired, so that the value is not in force afterwards.
+func (p *Peer) expireValue() {
+	p.logger.Trace("value expired: %d", p.CurrentNodeTS)
+	p.expiry = nil
+	p.expiresAt = time.Time{}
+	p.Data = ""
+	p.Tombstone = true
+	p.tombSince = time.Now()
+	p.tombCollected = false
+	expiredTS := uint32(p.tombSince.Unix())
+	if expiredTS <= p.CurrentNodeTS {
+		expiredTS = p.CurrentNodeTS + 1
+	}
+	p.history.add(HistoryEntry{Ts: expiredTS, Origin: p.Origin, Tombstone: true})
+	p.notifyWatchers()
+}
+
+//remainingTTL returns the milliseconds the value held by this node still has to live, 0 if it does not expire
+func (p *Peer) remainingTTL() uint64 {
+	if p.expiresAt.IsZero() {
+		return 0
+	}
+	return ttlMillis(time.Until(p.expiresAt))
+}
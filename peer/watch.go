@@ -0,0 +1,181 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"nds/util"
+	"net"
+	"time"
+)
+
+const (
+	//values a watcher can fall behind before its channel is closed
+	watchBacklog = 64
+
+	//bounds of the delay before a watcher dials a daemon again, doubled at every failure
+	watchRetryMin = 100 * time.Millisecond
+	watchRetryMax = 5 * time.Second
+)
+
+type watcher struct {
+	ch chan util.DataMsg
+
+	//set once ch is closed, owned by the events loop
+	closed bool
+}
+
+//notify is called inside the events loop; no value is dropped: a watcher falling watchBacklog values behind
+//has its channel closed instead, and must watch again from the last timestamp it got (see watch).
+func (w *watcher) notify(msg util.DataMsg) {
+	if w.closed {
+		return
+	}
+	select {
+	case w.ch <- msg:
+	default:
+		close(w.ch)
+		w.closed = true
+	}
+}
+
+func (p *Peer) notifyWatchers() {
+	if len(p.watchers) == 0 {
+		return
+	}
+	msg := p.currentDataMsg()
+	for w := range p.watchers {
+		w.notify(msg)
+	}
+}
+
+//watch registers a watcher of the values newer than from: those still retained by the history are delivered
+//at once, oldest first, ending with the value held
+func (p *Peer) watch(from uint32) (*watcher, bool) {
+	w := &watcher{ch: make(chan util.DataMsg, watchBacklog)}
+	ok := p.exec(func() {
+		p.watchers[w] = struct{}{}
+		if p.CurrentNodeTS <= from {
+			return
+		}
+		for _, e := range p.history.list() {
+			if e.Ts > from && e.Ts < p.CurrentNodeTS {
+				w.notify(util.DataMsg{Dv: e.Value, Og: e.Origin, Pt: util.MsgPktTypeData, Tb: e.Tombstone, Ts: uint64(e.Ts)})
+			}
+		}
+		w.notify(p.currentDataMsg())
+	})
+	return w, ok
+}
+
+func (p *Peer) unwatch(w *watcher) {
+	p.exec(func() { delete(p.watchers, w) })
+}
+
+//Watch returns a channel delivering the value held by this node every time its timestamp advances;
+//if this node already holds a timestamp newer than from, the values retained since from are delivered immediately.
+//The channel is closed if its reader falls too far behind: no value is skipped otherwise, and watching again
+//from the last timestamp read delivers those missed that are still retained.
+//The returned function ends the watch. An NDSError with code RetCode_UNVRSC is returned if this node is stopped.
+func (p *Peer) Watch(from uint32) (<-chan util.DataMsg, func(), error) {
+	w, ok := p.watch(from)
+	if !ok {
+		return nil, nil, &util.NDSError{Code: util.RetCode_UNVRSC}
+	}
+	return w.ch, func() { p.unwatch(w) }, nil
+}
+
+//runWatch runs this node as a watcher: the value is printed on stdout, preceded by its timestamp,
+//every time it changes in the cluster; a deletion is printed as the timestamp alone.
+//The watch session is opened with the first daemon answering the alive of this node;
+//when the session drops, it is resumed with another daemon from the last timestamp seen.
+//A daemon failing to be dialed is dialed again after a delay, growing up to watchRetryMax.
+func (p *Peer) runWatch() error {
+	from := uint32(p.Cfg.WatchFrom)
+	retry := watchRetryMin
+
+	for {
+		msg, _ := p.findDaemon(0)
+
+		conn, err := p.Transport.Dial(msg.Si, uint(msg.Lp))
+		if err != nil {
+			p.logger.Err("dialing %s:%d:%s", msg.Si, msg.Lp, err.Error())
+			time.Sleep(retry)
+			if retry *= 2; retry > watchRetryMax {
+				retry = watchRetryMax
+			}
+			continue
+		}
+		retry = watchRetryMin
+
+		p.logger.Trace("watching from ts:%d on: %s:%d", from, msg.Si, msg.Lp)
+		if err := p.sendRequest(conn, util.ReqMsg{Op: util.ReqOpWatch, Tk: p.Cfg.Token, Ts: uint64(from)}); err != nil {
+			p.logger.Err("sending request msg:%s", err.Error())
+		} else {
+			from = p.consumeWatch(conn, from)
+		}
+		conn.Close()
+	}
+}
+
+//consumeWatch prints the values streamed over conn until the session drops;
+//it returns the last timestamp seen.
+func (p *Peer) consumeWatch(conn net.Conn, from uint32) uint32 {
+	msgs := make(chan util.DataMsg)
+	go func() {
+		defer close(msgs)
+		for {
+			buff, err := p.auth.ReadFrame(conn)
+			if err != nil {
+				p.logger.Trace("watch session dropped:%s", err.Error())
+				return
+			}
+			msg := util.DataMsg{}
+			if err := json.Unmarshal(buff, &msg); err != nil {
+				p.logger.Err("Unmarshal:%s", err.Error())
+				return
+			}
+			msgs <- msg
+		}
+	}()
+
+	//an expired value turns into a tombstone keeping its timestamp
+	expired := false
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return from
+			}
+			if uint32(msg.Ts) > from || (uint32(msg.Ts) == from && msg.Tb && !expired) {
+				from, expired = uint32(msg.Ts), msg.Tb
+				if msg.Tb {
+					fmt.Printf("%d\n", msg.Ts)
+				} else {
+					fmt.Printf("%d %s\n", msg.Ts, msg.Dv)
+				}
+			}
+		case <-p.AliveChanIncoming:
+			//not interested while a session is open
+		}
+	}
+}
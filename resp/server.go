@@ -0,0 +1,502 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+//Package resp exposes the value held by a daemon node through a subset of the Redis protocol (RESP2),
+//so that redis-cli and Redis client libraries can read and write it.
+package resp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"nds/peer"
+	"nds/util"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Key is the only key available: it holds the value shared across the cluster
+const Key = "nds"
+
+//limits of a command read from a client: no command takes more than a handful of arguments,
+//and the arguments of a command, the value included, must fit a frame
+const (
+	maxCommandArgs  = 8
+	maxCommandBytes = util.MaxFrameLen
+	maxInlineLen    = 64 * 1024
+)
+
+//times DEL tries to drop a value replaced while it was deleting it
+const maxDeleteAttempts = 3
+
+//Server serves the commands:
+//
+//	PING [message]
+//	GET nds
+//	SET nds value [EX seconds | PX milliseconds]
+//	DEL nds
+//	INFO [section]
+//	SUBSCRIBE nds      publishes "<ts> <value>" at every change, "<ts>" when the value is deleted
+//	UNSUBSCRIBE, QUIT, COMMAND
+//
+//The connections are secured with TLS if the node has a certificate (see peer.Peer.TLS); the commands but PING, AUTH,
+//QUIT and COMMAND are checked against the ACL of the cluster.
+type Server struct {
+	peer     *peer.Peer
+	listener net.Listener
+	logger   util.Logger
+
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+//Listen starts serving p at address (e.g. ":6379"); it returns once listening
+func Listen(address string, p *peer.Peer) (*Server, error) {
+	s := &Server{peer: p, conns: make(map[net.Conn]struct{})}
+	if err := s.logger.Init("resp.", &p.Cfg); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		s.logger.Err("listening on %s:%s", address, err.Error())
+		return nil, err
+	}
+	s.listener = p.TLS().Listener(l)
+	s.logger.Trace("listening on %s", s.listener.Addr().String())
+
+	go s.accept()
+	return s, nil
+}
+
+//Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+//Close stops the server and drops its connections
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mtx.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mtx.Unlock()
+	s.logger.Stop()
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Err("accepting connection:%s", err.Error())
+			}
+			return
+		}
+		s.mtx.Lock()
+		s.conns[conn] = struct{}{}
+		s.mtx.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+//session is a client connection
+type session struct {
+	r *bufio.Reader
+	w *bufio.Writer
+
+	//serializes the writes of the commands and of the published messages
+	mtx sync.Mutex
+
+	//who runs the commands, checked against the ACL of the cluster: the token is given by AUTH
+	caller peer.Caller
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+		conn.Close()
+	}()
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			s.logger.Err("handshake with %s:%s", conn.RemoteAddr().String(), err.Error())
+			return
+		}
+	}
+	ss := &session{r: bufio.NewReader(conn), w: bufio.NewWriter(conn), caller: peer.ConnCaller(conn, "")}
+	var unsubscribe func()
+	defer func() {
+		if unsubscribe != nil {
+			unsubscribe()
+		}
+	}()
+
+	for {
+		args, err := readCommand(ss.r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Err("reading command from %s:%s", conn.RemoteAddr().String(), err.Error())
+				ss.reply(func(w *bufio.Writer) { writeError(w, "ERR Protocol error: "+err.Error()) })
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		cmd := strings.ToUpper(args[0])
+		if unsubscribe != nil && cmd != "SUBSCRIBE" && cmd != "UNSUBSCRIBE" && cmd != "PING" && cmd != "QUIT" {
+			ss.reply(func(w *bufio.Writer) {
+				writeError(w, "ERR only (UN)SUBSCRIBE / PING / QUIT allowed in this context")
+			})
+			continue
+		}
+
+		switch cmd {
+		case "QUIT":
+			ss.reply(func(w *bufio.Writer) { writeSimple(w, "OK") })
+			return
+		case "AUTH":
+			//AUTH <token>, or AUTH <username> <token>: the token is checked by the commands
+			if len(args) != 2 && len(args) != 3 {
+				ss.reply(func(w *bufio.Writer) { writeArity(w, cmd) })
+				continue
+			}
+			ss.caller.Token = args[len(args)-1]
+			ss.reply(func(w *bufio.Writer) { writeSimple(w, "OK") })
+		case "SUBSCRIBE":
+			if len(args) != 2 || args[1] != Key {
+				ss.reply(func(w *bufio.Writer) { writeError(w, "ERR only channel '"+Key+"' is available") })
+				continue
+			}
+			if unsubscribe == nil {
+				if err := s.peer.Authorize(ss.caller, util.ReqOpWatch); err != nil {
+					ss.reply(func(w *bufio.Writer) { writeCmdError(w, "subscribe", err) })
+					continue
+				}
+				if unsubscribe, err = s.subscribe(ss); err != nil {
+					ss.reply(func(w *bufio.Writer) { writeError(w, "ERR "+err.Error()) })
+					continue
+				}
+			}
+			ss.reply(func(w *bufio.Writer) {
+				writeArrayLen(w, 3)
+				writeBulk(w, "subscribe")
+				writeBulk(w, Key)
+				writeInt(w, 1)
+			})
+		case "UNSUBSCRIBE":
+			if unsubscribe != nil {
+				unsubscribe()
+				unsubscribe = nil
+			}
+			ss.reply(func(w *bufio.Writer) {
+				writeArrayLen(w, 3)
+				writeBulk(w, "unsubscribe")
+				writeBulk(w, Key)
+				writeInt(w, 0)
+			})
+		default:
+			ss.reply(func(w *bufio.Writer) { s.execute(w, ss.caller, cmd, args[1:]) })
+		}
+	}
+}
+
+//reply writes a reply on the session
+func (ss *session) reply(f func(w *bufio.Writer)) error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	f(ss.w)
+	return ss.w.Flush()
+}
+
+//subscribe publishes on ss every change of the value; it returns the function ending the subscription
+func (s *Server) subscribe(ss *session) (func(), error) {
+	//only the changes to come are published
+	e, _ := s.peer.Get()
+	ch, unwatch, err := s.peer.Watch(e.Ts)
+	if err != nil {
+		return nil, err
+	}
+	quit := make(chan struct{})
+
+	go func() {
+		defer func() { unwatch() }()
+		last := e.Ts
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					//the subscriber fell behind: the values missed still retained are published again
+					unwatch()
+					if ch, unwatch, err = s.peer.Watch(last); err != nil {
+						unwatch = func() {}
+						return
+					}
+					continue
+				}
+				last = uint32(msg.Ts)
+				payload := strconv.FormatUint(msg.Ts, 10)
+				if !msg.Tb {
+					payload += " " + msg.Dv
+				}
+				if err := ss.reply(func(w *bufio.Writer) {
+					writeArrayLen(w, 3)
+					writeBulk(w, "message")
+					writeBulk(w, Key)
+					writeBulk(w, payload)
+				}); err != nil {
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return func() { close(quit) }, nil
+}
+
+func (s *Server) execute(w *bufio.Writer, caller peer.Caller, cmd string, args []string) {
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			writeBulk(w, args[0])
+		} else {
+			writeSimple(w, "PONG")
+		}
+	case "COMMAND":
+		writeArrayLen(w, 0)
+	case "GET":
+		if len(args) != 1 {
+			writeArity(w, cmd)
+		} else if err := s.peer.Authorize(caller, util.ReqOpGet); err != nil {
+			writeCmdError(w, "get", err)
+		} else if e, err := s.peer.Get(); args[0] != Key || err != nil {
+			writeNil(w)
+		} else {
+			writeBulk(w, e.Value)
+		}
+	case "SET":
+		s.set(w, caller, args)
+	case "DEL":
+		s.del(w, caller, args)
+	case "INFO":
+		if err := s.peer.Authorize(caller, util.ReqOpMembers); err != nil {
+			writeCmdError(w, "info", err)
+		} else {
+			writeBulk(w, s.info())
+		}
+	default:
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", cmd))
+	}
+}
+
+func (s *Server) set(w *bufio.Writer, caller peer.Caller, args []string) {
+	if len(args) != 2 && len(args) != 4 {
+		writeArity(w, "SET")
+		return
+	}
+	if args[0] != Key {
+		writeError(w, "ERR only key '"+Key+"' is available")
+		return
+	}
+
+	c := peer.Change{Value: args[1], Caller: caller}
+	if len(args) == 4 {
+		n, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, "ERR invalid expire time in 'set' command")
+			return
+		}
+		switch strings.ToUpper(args[2]) {
+		case "EX":
+			c.TTL = time.Duration(n) * time.Second
+		case "PX":
+			c.TTL = time.Duration(n) * time.Millisecond
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	if _, err := s.peer.Apply(c); err != nil {
+		writeCmdError(w, "set", err)
+		return
+	}
+	writeSimple(w, "OK")
+}
+
+func (s *Server) del(w *bufio.Writer, caller peer.Caller, args []string) {
+	if len(args) == 0 {
+		writeArity(w, "DEL")
+		return
+	}
+	deleted := 0
+	for _, key := range args {
+		if key != Key || deleted == 1 {
+			continue
+		}
+		//the tombstone is conditioned on the TS of the value read: a value deleted meanwhile is not counted,
+		//a value set meanwhile is read again before being dropped
+		for attempt := 1; ; attempt++ {
+			e, err := s.peer.Get()
+			if err != nil {
+				//nothing to delete
+				break
+			}
+			_, err = s.peer.Apply(peer.Change{Delete: true, IfTS: &e.Ts, Caller: caller})
+			if err == nil {
+				deleted = 1
+				break
+			} else if !errors.Is(err, &util.NDSError{Code: util.RetCode_TSMISMT}) || attempt == maxDeleteAttempts {
+				writeCmdError(w, "del", err)
+				return
+			}
+		}
+	}
+	writeInt(w, int64(deleted))
+}
+
+//writeCmdError writes the error of a command: a command denied by the ACL is told as Redis tells it
+func writeCmdError(w *bufio.Writer, cmd string, err error) {
+	if errors.Is(err, &util.NDSError{Code: util.RetCode_DENIED}) {
+		writeError(w, "NOPERM this client has no permissions to run the '"+cmd+"' command")
+		return
+	}
+	writeError(w, "ERR "+err.Error())
+}
+
+func (s *Server) info() string {
+	self := s.peer.Self("")
+	e, err := s.peer.Get()
+
+	var b strings.Builder
+	b.WriteString("# Server\r\n")
+	fmt.Fprintf(&b, "nds_node_id:%s\r\n", self.NodeID)
+	fmt.Fprintf(&b, "tcp_port:%d\r\n", self.Port)
+	b.WriteString("\r\n# Cluster\r\n")
+	fmt.Fprintf(&b, "nds_ts:%d\r\n", self.Ts)
+	fmt.Fprintf(&b, "nds_members:%d\r\n", len(s.peer.Members())+1)
+	b.WriteString("\r\n# Keyspace\r\n")
+	if err == nil {
+		expires := 0
+		if e.TTL > 0 {
+			expires = 1
+		}
+		fmt.Fprintf(&b, "db0:keys=1,expires=%d,avg_ttl=%d\r\n", expires, e.TTL.Milliseconds())
+	}
+	return b.String()
+}
+
+//readCommand reads a command, either as an array of bulk strings or inline
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxCommandArgs {
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got '%.1s'", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxCommandBytes-total {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+		total += size
+		buff := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buff); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buff[:size]))
+	}
+	return args, nil
+}
+
+//readLine reads a line of at most maxInlineLen bytes
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLen {
+			return "", fmt.Errorf("too big inline request")
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		} else if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func writeArity(w *bufio.Writer, cmd string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func writeNil(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeArrayLen(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,253 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: nds.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// NDSClient is the client API for NDS service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type NDSClient interface {
+	//Get returns the value held by the node; a deleted value is returned with deleted set.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Value, error)
+	//Set sets (or deletes) the value; with if_ts, the change is accepted only if the node is at that TS,
+	//otherwise FAILED_PRECONDITION is returned and the TS of the node travels in the "nds-ts" trailer.
+	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
+	//Watch streams the value every time it changes, starting with those retained since from (the current one last);
+	//a stream falling too far behind ends with ABORTED, to be watched again from the last ts received.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (NDS_WatchClient, error)
+	//ClusterStatus returns the status of the node and the daemon nodes it knows.
+	ClusterStatus(ctx context.Context, in *ClusterStatusRequest, opts ...grpc.CallOption) (*ClusterStatusResponse, error)
+}
+
+type nDSClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewNDSClient(cc grpc.ClientConnInterface) NDSClient {
+	return &nDSClient{cc}
+}
+
+func (c *nDSClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, "/nds.NDS/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nDSClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error) {
+	out := new(SetResponse)
+	err := c.cc.Invoke(ctx, "/nds.NDS/Set", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nDSClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (NDS_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &NDS_ServiceDesc.Streams[0], "/nds.NDS/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &nDSWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type NDS_WatchClient interface {
+	Recv() (*Value, error)
+	grpc.ClientStream
+}
+
+type nDSWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *nDSWatchClient) Recv() (*Value, error) {
+	m := new(Value)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *nDSClient) ClusterStatus(ctx context.Context, in *ClusterStatusRequest, opts ...grpc.CallOption) (*ClusterStatusResponse, error) {
+	out := new(ClusterStatusResponse)
+	err := c.cc.Invoke(ctx, "/nds.NDS/ClusterStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// NDSServer is the server API for NDS service.
+// All implementations must embed UnimplementedNDSServer
+// for forward compatibility
+type NDSServer interface {
+	//Get returns the value held by the node; a deleted value is returned with deleted set.
+	Get(context.Context, *GetRequest) (*Value, error)
+	//Set sets (or deletes) the value; with if_ts, the change is accepted only if the node is at that TS,
+	//otherwise FAILED_PRECONDITION is returned and the TS of the node travels in the "nds-ts" trailer.
+	Set(context.Context, *SetRequest) (*SetResponse, error)
+	//Watch streams the value every time it changes, starting with those retained since from (the current one last);
+	//a stream falling too far behind ends with ABORTED, to be watched again from the last ts received.
+	Watch(*WatchRequest, NDS_WatchServer) error
+	//ClusterStatus returns the status of the node and the daemon nodes it knows.
+	ClusterStatus(context.Context, *ClusterStatusRequest) (*ClusterStatusResponse, error)
+	mustEmbedUnimplementedNDSServer()
+}
+
+// UnimplementedNDSServer must be embedded to have forward compatible implementations.
+type UnimplementedNDSServer struct {
+}
+
+func (UnimplementedNDSServer) Get(context.Context, *GetRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedNDSServer) Set(context.Context, *SetRequest) (*SetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Set not implemented")
+}
+func (UnimplementedNDSServer) Watch(*WatchRequest, NDS_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedNDSServer) ClusterStatus(context.Context, *ClusterStatusRequest) (*ClusterStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClusterStatus not implemented")
+}
+func (UnimplementedNDSServer) mustEmbedUnimplementedNDSServer() {}
+
+// UnsafeNDSServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to NDSServer will
+// result in compilation errors.
+type UnsafeNDSServer interface {
+	mustEmbedUnimplementedNDSServer()
+}
+
+func RegisterNDSServer(s grpc.ServiceRegistrar, srv NDSServer) {
+	s.RegisterService(&NDS_ServiceDesc, srv)
+}
+
+func _NDS_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NDSServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nds.NDS/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NDSServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NDS_Set_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NDSServer).Set(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nds.NDS/Set",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NDSServer).Set(ctx, req.(*SetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NDS_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NDSServer).Watch(m, &nDSWatchServer{stream})
+}
+
+type NDS_WatchServer interface {
+	Send(*Value) error
+	grpc.ServerStream
+}
+
+type nDSWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *nDSWatchServer) Send(m *Value) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _NDS_ClusterStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClusterStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NDSServer).ClusterStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nds.NDS/ClusterStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NDSServer).ClusterStatus(ctx, req.(*ClusterStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// NDS_ServiceDesc is the grpc.ServiceDesc for NDS service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var NDS_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "nds.NDS",
+	HandlerType: (*NDSServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _NDS_Get_Handler,
+		},
+		{
+			MethodName: "Set",
+			Handler:    _NDS_Set_Handler,
+		},
+		{
+			MethodName: "ClusterStatus",
+			Handler:    _NDS_ClusterStatus_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _NDS_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "nds.proto",
+}
@@ -0,0 +1,247 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+//Package rpc exposes the value held by a daemon node as a gRPC service (see nds.proto).
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative nds.proto
+
+import (
+	"context"
+	"errors"
+	"nds/peer"
+	"nds/util"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+//TSTrailer is the trailer carrying the TS of the node when a conditional Set is refused
+const TSTrailer = "nds-ts"
+
+//service implements NDSServer on top of a node
+type service struct {
+	UnimplementedNDSServer
+	peer *peer.Peer
+}
+
+//NewService returns the NDS service of p, to be registered on a grpc.Server
+func NewService(p *peer.Peer) NDSServer {
+	return &service{peer: p}
+}
+
+func toValue(e peer.HistoryEntry) *Value {
+	return &Value{Ts: e.Ts, Value: e.Value, Origin: e.Origin, Deleted: e.Tombstone, TtlMs: e.TTL.Milliseconds()}
+}
+
+func toMember(m peer.Member) *Member {
+	return &Member{NodeId: m.NodeID, Address: m.Address, Port: uint32(m.Port), Ts: m.Ts}
+}
+
+//toStatus maps err on a gRPC status
+func toStatus(err error) error {
+	var ndsErr *util.NDSError
+	if !errors.As(err, &ndsErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	switch ndsErr.Code {
+	case util.RetCode_TSMISMT:
+		return status.Error(codes.FailedPrecondition, "timestamp mismatch")
+	case util.RetCode_NODATA:
+		return status.Error(codes.NotFound, "no value")
+	case util.RetCode_UNVRSC:
+		return status.Error(codes.Unavailable, "node stopped")
+	case util.RetCode_DENIED:
+		return status.Error(codes.PermissionDenied, "permission denied")
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+//caller returns who sent the request of ctx: the bearer token of the authorization metadata, the verified TLS client certificate
+func caller(ctx context.Context) peer.Caller {
+	var c peer.Caller
+	if p, ok := grpcpeer.FromContext(ctx); ok {
+		c.Addr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			c.Cert = info.State.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, auth := range md.Get("authorization") {
+			if strings.HasPrefix(auth, "Bearer ") {
+				c.Token = strings.TrimPrefix(auth, "Bearer ")
+			}
+		}
+	}
+	return c
+}
+
+func (s *service) Get(ctx context.Context, req *GetRequest) (*Value, error) {
+	if err := s.peer.Authorize(caller(ctx), util.ReqOpGet); err != nil {
+		return nil, toStatus(err)
+	}
+	e, err := s.peer.Get()
+	var ndsErr *util.NDSError
+	if err != nil && (!errors.As(err, &ndsErr) || ndsErr.Code != util.RetCode_NODATA) {
+		return nil, toStatus(err)
+	}
+	return toValue(e), nil
+}
+
+func (s *service) Set(ctx context.Context, req *SetRequest) (*SetResponse, error) {
+	if req.TtlMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "negative ttl")
+	}
+	c := peer.Change{Value: req.Value, Delete: req.Delete, TTL: time.Duration(req.TtlMs) * time.Millisecond, Caller: caller(ctx)}
+	if req.IfTs != 0 {
+		c.IfTS = &req.IfTs
+	}
+
+	ts, err := s.peer.Apply(c)
+	if err != nil {
+		grpc.SetTrailer(ctx, metadata.Pairs(TSTrailer, strconv.FormatUint(uint64(ts), 10)))
+		return nil, toStatus(err)
+	}
+	return &SetResponse{Ts: ts}, nil
+}
+
+func (s *service) Watch(req *WatchRequest, stream NDS_WatchServer) error {
+	if err := s.peer.Authorize(caller(stream.Context()), util.ReqOpWatch); err != nil {
+		return toStatus(err)
+	}
+	ch, unwatch, err := s.peer.Watch(req.From)
+	if err != nil {
+		return status.Error(codes.Unavailable, "node stopped")
+	}
+	defer unwatch()
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return status.Error(codes.Aborted, "watcher fell behind, watch again from the last ts received")
+			}
+			v := &Value{Ts: uint32(msg.Ts), Value: msg.Dv, Origin: msg.Og, Deleted: msg.Tb, TtlMs: int64(msg.Tl)}
+			if err := stream.Send(v); err != nil {
+				return err
+			}
+		case <-s.peer.Done():
+			return status.Error(codes.Unavailable, "node stopped")
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (s *service) ClusterStatus(ctx context.Context, req *ClusterStatusRequest) (*ClusterStatusResponse, error) {
+	if err := s.peer.Authorize(caller(ctx), util.ReqOpMembers); err != nil {
+		return nil, toStatus(err)
+	}
+	var address string
+	if addr, ok := ctx.Value(localAddrKey{}).(net.Addr); ok {
+		address, _, _ = net.SplitHostPort(addr.String())
+	}
+
+	resp := &ClusterStatusResponse{Self: toMember(s.peer.Self(address))}
+	for _, m := range s.peer.Members() {
+		resp.Members = append(resp.Members, toMember(m))
+	}
+	return resp, nil
+}
+
+type localAddrKey struct{}
+
+//localAddrHandler records in the context of every connection the address it was accepted at:
+//this node is reached at that address.
+type localAddrHandler struct{}
+
+func (localAddrHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, localAddrKey{}, info.LocalAddr)
+}
+
+func (localAddrHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (localAddrHandler) HandleRPC(context.Context, stats.RPCStats)   {}
+func (localAddrHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+//Server serves the NDS service of a node
+type Server struct {
+	server   *grpc.Server
+	listener net.Listener
+	logger   util.Logger
+}
+
+//Listen starts serving the NDS service of p at address (e.g. ":9090"); it returns once listening
+func Listen(address string, p *peer.Peer) (*Server, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Serve(l, p)
+	if err != nil {
+		l.Close()
+	}
+	return s, err
+}
+
+//Serve starts serving the NDS service of p on l, secured with TLS if p has a certificate (see peer.Peer.TLS)
+func Serve(l net.Listener, p *peer.Peer) (*Server, error) {
+	opts := []grpc.ServerOption{grpc.StatsHandler(localAddrHandler{})}
+	if p.TLS().Serving() {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(p.TLS().ServerConfig())))
+	}
+	s := &Server{listener: l, server: grpc.NewServer(opts...)}
+	if err := s.logger.Init("grpc.", &p.Cfg); err != nil {
+		return nil, err
+	}
+	RegisterNDSServer(s.server, NewService(p))
+	s.logger.Trace("listening on %s", l.Addr().String())
+
+	go func() {
+		if err := s.server.Serve(l); err != nil {
+			s.logger.Err("serving:%s", err.Error())
+		}
+	}()
+	return s, nil
+}
+
+//Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+//Close stops the server
+func (s *Server) Close() error {
+	s.server.Stop()
+	s.logger.Stop()
+	return nil
+}
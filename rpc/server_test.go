@@ -0,0 +1,443 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"nds/peer"
+	"nds/sim"
+	"nds/util"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+//startNode starts a daemon node alone on an in-memory network and waits until it holds a timestamp
+func startNode(t *testing.T) *peer.Peer {
+	t.Helper()
+	return startNodeWith(t, util.Config{})
+}
+
+//startNodeWith is like startNode, the daemon taking the settings of cfg
+func startNodeWith(t *testing.T, cfg util.Config) *peer.Peer {
+	t.Helper()
+	return startNodeOn(t, sim.NewBus(), "n0", cfg)
+}
+
+//startNodeOn is like startNodeWith, the daemon joining bus at addr
+func startNodeOn(t *testing.T, bus *sim.Bus, addr string, cfg util.Config) *peer.Peer {
+	t.Helper()
+	cfg.StartNode, cfg.LogType, cfg.LogLevel = true, "console", util.OffStr
+	p, err := peer.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Transport = bus.Endpoint(addr)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	deadline := time.Now().Add(time.Second * (peer.NodeSynchDuration + 5))
+	for p.Self("").Ts == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the node did not generate a timestamp")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return p
+}
+
+//dial serves the NDS service of p over an in-process connection and returns a client of it
+func dial(t *testing.T, p *peer.Peer) NDSClient {
+	t.Helper()
+	l := bufconn.Listen(1 << 20)
+	s, err := Serve(l, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := grpc.DialContext(context.Background(), "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewNDSClient(conn)
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestGet(t *testing.T) {
+	p := startNode(t)
+	c := dial(t, p)
+	ctx := testContext(t)
+
+	//an empty cluster starts with a tombstone
+	v, err := c.Get(ctx, &GetRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Deleted || v.Ts != p.Self("").Ts {
+		t.Fatalf("got %v, want a tombstone at ts:%d", v, p.Self("").Ts)
+	}
+
+	ts, err := p.Set("Jerico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err = c.Get(ctx, &GetRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if v.Ts != ts || v.Value != "Jerico" || v.Deleted || v.Origin != p.NodeID {
+		t.Fatalf("got %v, want Jerico at ts:%d from %s", v, ts, p.NodeID)
+	}
+}
+
+func TestSetCompareAndSet(t *testing.T) {
+	p := startNode(t)
+	c := dial(t, p)
+	ctx := testContext(t)
+
+	resp, err := c.Set(ctx, &SetRequest{Value: "Jerico"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := resp.Ts
+
+	//a stale timestamp is refused, the trailer tells the one held
+	var trailer metadata.MD
+	_, err = c.Set(ctx, &SetRequest{Value: "Tom", IfTs: ts - 1}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("got %v, want FailedPrecondition", err)
+	}
+	if got := trailer.Get(TSTrailer); len(got) != 1 || got[0] != strconv.FormatUint(uint64(ts), 10) {
+		t.Fatalf("got trailer %v, want ts:%d", got, ts)
+	}
+
+	resp, err = c.Set(ctx, &SetRequest{Value: "Jerry", IfTs: ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Ts <= ts {
+		t.Fatalf("got ts:%d, want a ts newer than %d", resp.Ts, ts)
+	}
+	v, err := c.Get(ctx, &GetRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "Jerry" || v.Ts != resp.Ts {
+		t.Fatalf("got %v, want Jerry at ts:%d", v, resp.Ts)
+	}
+
+	if _, err := c.Set(ctx, &SetRequest{Value: "Tom", TtlMs: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	p := startNode(t)
+	c := dial(t, p)
+	ctx := testContext(t)
+
+	from := p.Self("").Ts
+	stream, err := c.Watch(ctx, &WatchRequest{From: from})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the value is set once the watch is in place: the first message must be the new value
+	set := make(chan uint32, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		ts, _ := p.Set("Jerico")
+		set <- ts
+	}()
+	v, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := <-set; v.Ts != ts || v.Value != "Jerico" {
+		t.Fatalf("got %v, want Jerico at ts:%d", v, ts)
+	}
+
+	//a watch from an older timestamp gets the current value immediately
+	stream, err = c.Watch(ctx, &WatchRequest{From: from})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err = stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "Jerico" {
+		t.Fatalf("got %v, want Jerico", v)
+	}
+}
+
+func TestWatchReplay(t *testing.T) {
+	p := startNode(t)
+	c := dial(t, p)
+	ctx := testContext(t)
+
+	//a watch resumed from an older timestamp gets every value retained since, oldest first
+	from := p.Self("").Ts
+	var want []uint32
+	for _, v := range []string{"Tom", "Jerry", "Spike"} {
+		ts, err := p.Set(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, ts)
+	}
+	stream, err := c.Watch(ctx, &WatchRequest{From: from})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []string{"Tom", "Jerry", "Spike"} {
+		got, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Value != v || got.Ts != want[i] {
+			t.Fatalf("got %v, want %s at ts:%d", got, v, want[i])
+		}
+	}
+}
+
+func TestClusterStatus(t *testing.T) {
+	p := startNode(t)
+	c := dial(t, p)
+	ctx := testContext(t)
+
+	resp, err := c.ClusterStatus(ctx, &ClusterStatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := p.Self("")
+	if resp.Self.GetNodeId() != p.NodeID || resp.Self.GetTs() != self.Ts {
+		t.Fatalf("got %v, want node %s at ts:%d", resp.Self, p.NodeID, self.Ts)
+	}
+	if len(resp.Members) != 0 {
+		t.Fatalf("got members %v, want none", resp.Members)
+	}
+}
+
+func TestStoppedNode(t *testing.T) {
+	p := startNode(t)
+	c := dial(t, p)
+	ctx := testContext(t)
+
+	p.Close()
+	if _, err := c.Set(ctx, &SetRequest{Value: "Jerico"}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+	stream, err := c.Watch(ctx, &WatchRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want Unavailable", err)
+	}
+}
+
+func TestACL(t *testing.T) {
+	//reader and writer tokens, anyone else is denied everything
+	acl := `{"version":1,"default":"none","identities":[
+	{"name":"reader","token_sha256":"%s","permission":"read"},
+	{"name":"writer","token_sha256":"%s","permission":"write"}]}`
+	path := filepath.Join(t.TempDir(), "acl.json")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(acl, tokenHash("r"), tokenHash("w"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := startNodeWith(t, util.Config{ACLFile: path})
+	c := dial(t, p)
+	ctx := testContext(t)
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	if _, err := c.Get(ctx, &GetRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want PermissionDenied", err)
+	}
+	if _, err := c.ClusterStatus(ctx, &ClusterStatusRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want PermissionDenied", err)
+	}
+	stream, err := c.Watch(ctx, &WatchRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want PermissionDenied", err)
+	}
+	if _, err := c.Set(withToken("r"), &SetRequest{Value: "Jerico"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got %v, want PermissionDenied", err)
+	}
+
+	//the exported writes of the node are checked as well
+	if _, err := p.Set("Jerico"); !errors.Is(err, &util.NDSError{Code: util.RetCode_DENIED}) {
+		t.Fatalf("got %v, want RetCode_DENIED", err)
+	}
+
+	resp, err := c.Set(withToken("w"), &SetRequest{Value: "Jerico"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Get(withToken("r"), &GetRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "Jerico" || v.Ts != resp.Ts {
+		t.Fatalf("got %v, want Jerico at ts:%d", v, resp.Ts)
+	}
+}
+
+func TestDaemonProofReplay(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, aclFile := filepath.Join(dir, "daemon.key"), filepath.Join(dir, "acl.json")
+	if err := os.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(aclFile, []byte(`{"version":1,"default":"none"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bus := sim.NewBus()
+	startNodeOn(t, bus, "n0", util.Config{DaemonKeyFile: keyFile, ACLFile: aclFile})
+	keys, err := util.ReadAuthKeys(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := util.NewDaemonKey(keys)
+
+	//a denied read is answered by closing the connection
+	ask := func(req util.ReqMsg) error {
+		conn, err := bus.Dial("n0")
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buff, err := req.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(util.NewFrame(buff)); err != nil {
+			return err
+		}
+		_, err = util.ReadFrame(conn)
+		return err
+	}
+	proven := func(sent time.Time) util.ReqMsg {
+		req := util.ReqMsg{Op: util.ReqOpGet, Pt: util.MsgPktTypeReq, Nc: util.NewNonce(), Tm: sent.UnixNano()}
+		buff, err := req.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Dp = key.Prove(req.Nc, buff)
+		return req
+	}
+
+	req := proven(time.Now())
+	if err := ask(req); err != nil {
+		t.Fatalf("a proven request was denied: %v", err)
+	}
+	if err := ask(req); err == nil {
+		t.Fatal("a replayed request was served")
+	}
+	if err := ask(proven(time.Now().Add(-time.Hour))); err == nil {
+		t.Fatal("a request sent before the replay window was served")
+	}
+	//the proof covers the whole request
+	req = proven(time.Now())
+	req.Op = util.ReqOpMembers
+	if err := ask(req); err == nil {
+		t.Fatal("a request altered after being proven was served")
+	}
+}
+
+func TestACLPull(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	acl := func(name string, version int) string {
+		return file(name, fmt.Sprintf(`{"version":%d,"default":"admin"}`, version))
+	}
+	waitVersion := func(p *peer.Peer, version uint64) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second * (2*peer.NodeAlivePeriod + 5))
+		for p.ACL().Version != version {
+			if time.Now().After(deadline) {
+				t.Fatalf("holding the acl version %d, want %d", p.ACL().Version, version)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	//without the daemon key, an ACL is taken if the one held lets its daemon administer the cluster,
+	//but not when its version jumps too far
+	bus := sim.NewBus()
+	p := startNodeOn(t, bus, "n0", util.Config{ACLFile: acl("n0.json", 1)})
+	startNodeOn(t, bus, "n1", util.Config{ACLFile: acl("n1.json", 5000)})
+	startNodeOn(t, bus, "n2", util.Config{ACLFile: acl("n2.json", 3)})
+	waitVersion(p, 3)
+	time.Sleep(time.Second)
+	waitVersion(p, 3)
+
+	//with the daemon key, an ACL is taken from a daemon proving itself only, whatever its version
+	key := file("daemon.key", "0123456789abcdef0123456789abcdef\n")
+	bus = sim.NewBus()
+	p = startNodeOn(t, bus, "n0", util.Config{DaemonKeyFile: key, ACLFile: acl("n0.json", 1)})
+	startNodeOn(t, bus, "n1", util.Config{DaemonKeyFile: key, ACLFile: acl("n1.json", 5000)})
+	waitVersion(p, 5000)
+	startNodeOn(t, bus, "n2", util.Config{ACLFile: acl("n2.json", 5001)})
+	time.Sleep(time.Second)
+	waitVersion(p, 5000)
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
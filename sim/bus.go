@@ -0,0 +1,173 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package sim
+
+import (
+	"encoding/json"
+	"nds/network"
+	"nds/util"
+	"net"
+	"sync"
+	"time"
+)
+
+//Bus is an in-memory network connecting the nodes of a simulated cluster.
+//Alive messages sent by a node are delivered to every attached node (sender included, as multicast loopback does);
+//point 2 point connections are net.Pipe pairs.
+type Bus struct {
+	mtx   sync.Mutex
+	nodes map[string]*Endpoint
+}
+
+func NewBus() *Bus {
+	return &Bus{nodes: make(map[string]*Endpoint)}
+}
+
+//Endpoint is the network.Transport of a simulated node attached to a Bus
+type Endpoint struct {
+	bus  *Bus
+	addr string
+
+	enteringChan      chan net.Conn
+	aliveChanIncoming chan util.AliveMsg
+	aliveChanOutgoing chan []byte
+
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+//Endpoint creates the transport for the node reachable at addr;
+//the node joins the bus once its peer starts the transport.
+func (b *Bus) Endpoint(addr string) *Endpoint {
+	return &Endpoint{bus: b, addr: addr, quit: make(chan struct{})}
+}
+
+func (b *Bus) attach(e *Endpoint) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.nodes[e.addr] = e
+}
+
+func (b *Bus) detach(e *Endpoint) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.nodes[e.addr] == e {
+		delete(b.nodes, e.addr)
+	}
+}
+
+func (b *Bus) lookup(addr string) *Endpoint {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.nodes[addr]
+}
+
+func (b *Bus) deliver(msg util.AliveMsg) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, e := range b.nodes {
+		//like UDP, delivery order is not guaranteed and must not block the sender
+		go func(e *Endpoint) {
+			select {
+			case e.aliveChanIncoming <- msg:
+			case <-e.quit:
+			}
+		}(e)
+	}
+}
+
+func (e *Endpoint) Start(cfg *util.Config, enteringChan chan net.Conn, aliveChanIncoming chan util.AliveMsg, aliveChanOutgoing chan []byte) error {
+	e.enteringChan = enteringChan
+	e.aliveChanIncoming = aliveChanIncoming
+	e.aliveChanOutgoing = aliveChanOutgoing
+	e.bus.attach(e)
+	go e.mcastSender()
+	return nil
+}
+
+func (e *Endpoint) mcastSender() {
+	for {
+		select {
+		case buff := <-e.aliveChanOutgoing:
+			msg := util.AliveMsg{}
+			if err := json.Unmarshal(buff[4:], &msg); err != nil {
+				continue
+			}
+			select {
+			case <-e.quit:
+				//a crashed node does not reach the network anymore
+			default:
+				msg.Si = e.addr
+				e.bus.deliver(msg)
+			}
+		case <-e.quit:
+			//keep draining: the peer of a crashed node must not block
+			go func() {
+				for range e.aliveChanOutgoing {
+				}
+			}()
+			return
+		}
+	}
+}
+
+func (e *Endpoint) Addr() (string, uint) {
+	return e.addr, 0
+}
+
+func (e *Endpoint) Dial(address string, port uint) (net.Conn, error) {
+	select {
+	case <-e.quit:
+		return nil, &util.NDSError{Code: util.RetCode_SCKCLO}
+	default:
+	}
+
+	target := e.bus.lookup(address)
+	if target == nil {
+		return nil, &util.NDSError{Code: util.RetCode_UNVRSC}
+	}
+
+	local, remote := net.Pipe()
+	select {
+	case target.enteringChan <- remote:
+		return local, nil
+	case <-target.quit:
+	case <-time.After(network.DialTimeout):
+	}
+	local.Close()
+	remote.Close()
+	return nil, &util.NDSError{Code: util.RetCode_TIMEOUT}
+}
+
+//Stop detaches the node from the bus; for the rest of the cluster the node has crashed.
+func (e *Endpoint) Stop() error {
+	e.stopOnce.Do(func() {
+		e.bus.detach(e)
+		close(e.quit)
+	})
+	return nil
+}
+
+//Dial connects to the node at addr from outside the cluster
+func (b *Bus) Dial(addr string) (net.Conn, error) {
+	probe := Endpoint{bus: b, quit: make(chan struct{})}
+	return probe.Dial(addr, 0)
+}
@@ -0,0 +1,107 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package sim
+
+import (
+	"fmt"
+)
+
+/**
+ * Check validates a history against a last-writer-wins register model:
+ *
+ *  - every observed (TS, value) pair was written by a set, or is an empty value
+ *    with a timestamp auto generated by a daemon spawned in an empty cluster;
+ *  - a timestamp always denotes the same value;
+ *  - a node incarnation never moves back to an older timestamp;
+ *  - once the workload is over, all live daemons converge on the same (TS, value);
+ *    being monotonic, the converged TS is not older than anything ever held by them;
+ *  - no acknowledged set is lost: the converged TS is not older than a set followed by no kill.
+ *
+ * Writes known only by nodes that later died may be lost: that is allowed by the model.
+ */
+func Check(history []Event) []string {
+	var viols []string
+
+	written := make(map[uint32]map[string]bool)
+	for _, ev := range history {
+		if ev.Kind == OpSet && ev.Err == "" {
+			if written[ev.Ts] == nil {
+				written[ev.Ts] = make(map[string]bool)
+			}
+			written[ev.Ts][ev.Value] = true
+		}
+	}
+
+	lastTs := make(map[string]uint32)
+	var final *Event
+	for i := range history {
+		ev := &history[i]
+		if ev.Err != "" || (ev.Kind != OpGet && ev.Kind != OpFinal) {
+			continue
+		}
+
+		if vals, ok := written[ev.Ts]; ok {
+			if !vals[ev.Value] {
+				viols = append(viols, fmt.Sprintf("%s: value %q observed with ts:%d, written value is another", ev.Node, ev.Value, ev.Ts))
+			}
+		} else if ev.Value != "" {
+			viols = append(viols, fmt.Sprintf("%s: value %q observed with ts:%d was never written", ev.Node, ev.Value, ev.Ts))
+		}
+
+		if ev.Ts < lastTs[ev.Node] {
+			viols = append(viols, fmt.Sprintf("%s: moved back from ts:%d to ts:%d", ev.Node, lastTs[ev.Node], ev.Ts))
+		} else {
+			lastTs[ev.Node] = ev.Ts
+		}
+
+		if ev.Kind == OpFinal {
+			if final == nil {
+				final = ev
+			} else if final.Ts != ev.Ts || final.Value != ev.Value {
+				viols = append(viols, fmt.Sprintf("not converged: %s holds ts:%d val:%q, %s holds ts:%d val:%q",
+					final.Node, final.Ts, final.Value, ev.Node, ev.Ts, ev.Value))
+			}
+		}
+	}
+
+	for _, ev := range history {
+		if ev.Kind == OpFinal && ev.Err != "" {
+			viols = append(viols, fmt.Sprintf("%s: unreachable at the end of the run: %s", ev.Node, ev.Err))
+		}
+	}
+
+	//a set is acknowledged once its setter tells the TS it generated; only a kill may lose it afterwards
+	if final != nil {
+		killed := false
+		for i := len(history) - 1; i >= 0; i-- {
+			ev := history[i]
+			switch {
+			case ev.Kind == OpKill:
+				killed = true
+			case ev.Kind == OpSet && ev.Err == "" && !killed && ev.Ts > final.Ts:
+				viols = append(viols, fmt.Sprintf("%s: write lost: value %q set with ts:%d, the cluster converged on ts:%d",
+					ev.Node, ev.Value, ev.Ts, final.Ts))
+			}
+		}
+	}
+
+	return viols
+}
@@ -0,0 +1,492 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package sim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"nds/peer"
+	"nds/util"
+	"strings"
+	"time"
+)
+
+type OpKind int
+
+const (
+	OpSet OpKind = iota
+	OpGet
+	OpKill
+	OpRestart
+	OpFinal
+)
+
+var opKind2Str = map[OpKind]string{OpSet: "set", OpGet: "get", OpKill: "kill", OpRestart: "restart", OpFinal: "final"}
+
+func (k OpKind) String() string {
+	return opKind2Str[k]
+}
+
+//Op is a single step of a workload
+type Op struct {
+	Kind OpKind
+
+	//daemon node the op targets (set ops are performed by a "pure" setter node)
+	Node int
+
+	//value written by a set op
+	Value string
+
+	//time waited before running the op
+	Pause time.Duration
+}
+
+func (o Op) String() string {
+	switch o.Kind {
+	case OpSet:
+		return fmt.Sprintf("+%v set %q", o.Pause, o.Value)
+	default:
+		return fmt.Sprintf("+%v %s n%d", o.Pause, o.Kind, o.Node)
+	}
+}
+
+//Event is an entry of the history recorded while executing a workload
+type Event struct {
+	//elapsed time since the beginning of the run
+	At time.Duration
+
+	Kind OpKind
+
+	//the node incarnation the event refers to (e.g. n2.1 is the second incarnation of daemon n2)
+	Node string
+
+	//the timestamp and the value written (set) or observed (get, final)
+	Ts    uint32
+	Value string
+
+	Err string
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%8.3fs %-7s %-6s", e.At.Seconds(), e.Kind, e.Node)
+	if e.Err != "" {
+		return s + " err:" + e.Err
+	}
+	if e.Kind == OpSet || e.Kind == OpGet || e.Kind == OpFinal {
+		s += fmt.Sprintf(" ts:%d val:%q", e.Ts, e.Value)
+	}
+	return s
+}
+
+type Options struct {
+	//number of daemon nodes
+	Nodes int
+
+	//number of ops in a generated workload
+	Ops int
+
+	//random seed of the generated workload
+	Seed int64
+
+	//upper bound of the pause before each op
+	MaxPause time.Duration
+
+	//time given to the cluster to converge once the workload is over
+	Settle time.Duration
+
+	//allow two sets within the same second: timestamps have a one second resolution,
+	//such writes are not ordered by the protocol.
+	AllowTies bool
+
+	//max number of workload executions spent minimizing a failing workload
+	MaxShrinkRuns int
+
+	//logging verbosity of the simulated peers
+	LogLevel string
+}
+
+func (o *Options) defaults() {
+	if o.Nodes <= 0 {
+		o.Nodes = 4
+	}
+	if o.Ops <= 0 {
+		o.Ops = 20
+	}
+	if o.MaxPause <= 0 {
+		o.MaxPause = 500 * time.Millisecond
+	}
+	if o.Settle <= 0 {
+		o.Settle = time.Second * (3*peer.NodeAlivePeriod + peer.DataTransferTimeout)
+	}
+	if o.LogLevel == "" {
+		o.LogLevel = util.OffStr
+	}
+}
+
+//Report is the outcome of a harness run
+type Report struct {
+	Seed       int64
+	Ops        []Op
+	History    []Event
+	Violations []string
+
+	//the harness could not execute the workload (e.g. a daemon did not start): the history is incomplete
+	Err error
+
+	//smallest failing workload found, with the history and violations of its last failing execution
+	Minimized        []Op
+	MinimizedHistory []Event
+	MinimizedViols   []string
+}
+
+func (r *Report) Failed() bool {
+	return len(r.Violations) > 0 || r.Err != nil
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "seed:%d ops:%d\n", r.Seed, len(r.Ops))
+	if r.Err != nil {
+		fmt.Fprintf(&b, "ERROR: the workload could not be executed: %s\n", r.Err.Error())
+		writeTrace(&b, "workload", r.Ops, r.History, r.Violations)
+		return b.String()
+	}
+	if !r.Failed() {
+		b.WriteString("OK: cluster converged, no violation found\n")
+		return b.String()
+	}
+	writeTrace(&b, "workload", r.Ops, r.History, r.Violations)
+	if r.Minimized != nil {
+		writeTrace(&b, "minimized workload", r.Minimized, r.MinimizedHistory, r.MinimizedViols)
+	}
+	return b.String()
+}
+
+func writeTrace(b *strings.Builder, title string, ops []Op, history []Event, viols []string) {
+	fmt.Fprintf(b, "-- %s (%d ops):\n", title, len(ops))
+	for _, op := range ops {
+		fmt.Fprintf(b, "   %s\n", op)
+	}
+	fmt.Fprintf(b, "-- history:\n")
+	for _, ev := range history {
+		fmt.Fprintf(b, "   %s\n", ev)
+	}
+	fmt.Fprintf(b, "-- violations:\n")
+	for _, v := range viols {
+		fmt.Fprintf(b, "   %s\n", v)
+	}
+}
+
+//Run generates a randomized workload, executes it against an in-process cluster and checks the recorded history;
+//a failing workload is then minimized.
+func Run(opts Options) *Report {
+	opts.defaults()
+	r := &Report{Seed: opts.Seed, Ops: Generate(opts)}
+	if r.History, r.Err = Execute(opts, r.Ops); r.Err != nil {
+		return r
+	}
+	r.Violations = Check(r.History)
+	if r.Failed() && opts.MaxShrinkRuns > 0 {
+		r.Minimized, r.MinimizedHistory, r.MinimizedViols = minimize(opts, r.Ops, r.History, r.Violations)
+	}
+	return r
+}
+
+//Generate builds a random workload of sets, gets, kills and restarts
+func Generate(opts Options) []Op {
+	opts.defaults()
+	rnd := rand.New(rand.NewSource(opts.Seed))
+	alive := make([]bool, opts.Nodes)
+	for i := range alive {
+		alive[i] = true
+	}
+	pick := func(want bool) int {
+		var idx []int
+		for i, a := range alive {
+			if a == want {
+				idx = append(idx, i)
+			}
+		}
+		if len(idx) == 0 {
+			return -1
+		}
+		return idx[rnd.Intn(len(idx))]
+	}
+
+	ops := make([]Op, 0, opts.Ops)
+	for len(ops) < opts.Ops {
+		op := Op{Pause: time.Duration(rnd.Int63n(int64(opts.MaxPause)))}
+		switch c := rnd.Intn(100); {
+		case c < 35:
+			op.Kind = OpSet
+			op.Value = fmt.Sprintf("v%d", len(ops))
+		case c < 70:
+			op.Kind, op.Node = OpGet, pick(true)
+		case c < 85:
+			//never kill the last daemon: the value would be lost by design
+			if op.Node = pick(true); op.Node < 0 || len(alive)-countFalse(alive) < 2 {
+				continue
+			}
+			op.Kind = OpKill
+			alive[op.Node] = false
+		default:
+			if op.Node = pick(false); op.Node < 0 {
+				continue
+			}
+			op.Kind = OpRestart
+			alive[op.Node] = true
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func countFalse(v []bool) int {
+	n := 0
+	for _, b := range v {
+		if !b {
+			n++
+		}
+	}
+	return n
+}
+
+type node struct {
+	p           *peer.Peer
+	ep          *Endpoint
+	incarnation int
+}
+
+func (n *node) name(idx int) string {
+	return fmt.Sprintf("n%d.%d", idx, n.incarnation)
+}
+
+type cluster struct {
+	opts    Options
+	bus     *Bus
+	nodes   []*node
+	begin   time.Time
+	lastSet time.Time
+	setters int
+	history []Event
+}
+
+func (c *cluster) record(ev Event) {
+	ev.At = time.Since(c.begin)
+	c.history = append(c.history, ev)
+}
+
+//spawn starts a node reachable at addr; a "pure" node stops by itself
+func (c *cluster) spawn(addr string, cfg util.Config) (*peer.Peer, *Endpoint, error) {
+	cfg.LogType = "console"
+	cfg.LogLevel = c.opts.LogLevel
+	p, err := peer.New(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	ep := c.bus.Endpoint(addr)
+	p.Transport = ep
+	if err := p.Start(context.Background()); err != nil {
+		return nil, nil, err
+	}
+	return p, ep, nil
+}
+
+func (c *cluster) startDaemon(idx int, incarnation int) error {
+	n := &node{incarnation: incarnation}
+	var err error
+	if n.p, n.ep, err = c.spawn(fmt.Sprintf("n%d", idx), util.Config{StartNode: true}); err != nil {
+		return fmt.Errorf("starting n%d.%d: %w", idx, incarnation, err)
+	}
+	c.nodes[idx] = n
+	return nil
+}
+
+//kill detaches a daemon from the bus, as a crash would, then releases it
+func (n *node) kill() {
+	n.ep.Stop()
+	n.p.Close()
+	n.p, n.ep = nil, nil
+}
+
+//Execute runs ops against a fresh in-process cluster and returns the recorded history;
+//ops not applicable to the current state of the cluster (e.g. killing a dead node) are skipped.
+//An error is returned, along with the history recorded so far, if a daemon cannot be started.
+func Execute(opts Options, ops []Op) ([]Event, error) {
+	opts.defaults()
+	c := &cluster{opts: opts, bus: NewBus(), nodes: make([]*node, opts.Nodes)}
+	for i := range c.nodes {
+		if err := c.startDaemon(i, 0); err != nil {
+			c.killAll()
+			return nil, err
+		}
+	}
+	//let daemons agree on an initial timestamp
+	time.Sleep(time.Second * (peer.NodeSynchDuration + 2))
+	c.begin = time.Now()
+
+	for _, op := range ops {
+		time.Sleep(op.Pause)
+		if err := c.execute(op); err != nil {
+			c.killAll()
+			return c.history, err
+		}
+	}
+
+	time.Sleep(opts.Settle)
+	for i, n := range c.nodes {
+		if n.ep != nil {
+			ts, val, err := c.read(fmt.Sprintf("n%d", i))
+			c.record(Event{Kind: OpFinal, Node: n.name(i), Ts: ts, Value: val, Err: errString(err)})
+		}
+	}
+	c.killAll()
+	return c.history, nil
+}
+
+//killAll kills the daemons still running
+func (c *cluster) killAll() {
+	for _, n := range c.nodes {
+		if n != nil && n.ep != nil {
+			n.kill()
+		}
+	}
+}
+
+func (c *cluster) execute(op Op) error {
+	if op.Kind != OpSet && (op.Node < 0 || op.Node >= len(c.nodes)) {
+		return nil
+	}
+	switch op.Kind {
+	case OpSet:
+		if !c.opts.AllowTies {
+			time.Sleep(time.Until(c.lastSet.Add(time.Second)))
+		}
+		c.lastSet = time.Now()
+		c.setters++
+		addr := fmt.Sprintf("s%d", c.setters)
+		_, _, err := c.spawn(addr, util.Config{Val: op.Value})
+		//ask the setter the timestamp it generated
+		for try := 0; try < 10; try++ {
+			var ts uint32
+			var val string
+			if ts, val, err = c.read(addr); err == nil {
+				c.record(Event{Kind: OpSet, Node: addr, Ts: ts, Value: val})
+				return nil
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.record(Event{Kind: OpSet, Node: addr, Value: op.Value, Err: errString(err)})
+	case OpGet:
+		if n := c.nodes[op.Node]; n.ep != nil {
+			ts, val, err := c.read(fmt.Sprintf("n%d", op.Node))
+			c.record(Event{Kind: OpGet, Node: n.name(op.Node), Ts: ts, Value: val, Err: errString(err)})
+		}
+	case OpKill:
+		if n := c.nodes[op.Node]; n.ep != nil {
+			n.kill()
+			c.record(Event{Kind: OpKill, Node: n.name(op.Node)})
+		}
+	case OpRestart:
+		if n := c.nodes[op.Node]; n.ep == nil {
+			if err := c.startDaemon(op.Node, n.incarnation+1); err != nil {
+				return err
+			}
+			c.record(Event{Kind: OpRestart, Node: c.nodes[op.Node].name(op.Node)})
+		}
+	}
+	return nil
+}
+
+//read fetches the timestamp and the value held by the node at addr, the same way nodes pull data
+func (c *cluster) read(addr string) (uint32, string, error) {
+	conn, err := c.bus.Dial(addr)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * peer.DataTransferTimeout))
+	req := util.ReqMsg{Op: util.ReqOpGet, Pt: util.MsgPktTypeReq}
+	if buff, err := req.MarshalJSON(); err != nil {
+		return 0, "", err
+	} else if _, err := conn.Write(util.NewFrame(buff)); err != nil {
+		return 0, "", err
+	}
+	buff, err := util.ReadFrame(conn)
+	if err != nil {
+		return 0, "", err
+	}
+	msg := util.DataMsg{}
+	if err := json.Unmarshal(buff, &msg); err != nil {
+		return 0, "", err
+	}
+	return uint32(msg.Ts), msg.Dv, nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+//minimize shrinks a failing workload (delta debugging): chunks of ops are removed
+//as long as the reduced workload still fails, within opts.MaxShrinkRuns executions.
+func minimize(opts Options, ops []Op, history []Event, viols []string) ([]Op, []Event, []string) {
+	budget := opts.MaxShrinkRuns
+	n := 2
+	for len(ops) >= 2 && budget > 0 {
+		chunk := (len(ops) + n - 1) / n
+		reduced := false
+		for i := 0; i < len(ops) && budget > 0; i += chunk {
+			end := i + chunk
+			if end > len(ops) {
+				end = len(ops)
+			}
+			cand := append(append([]Op{}, ops[:i]...), ops[end:]...)
+			budget--
+			candHistory, err := Execute(opts, cand)
+			if err != nil {
+				//not a violation: the candidate tells nothing
+				continue
+			}
+			if candViols := Check(candHistory); len(candViols) > 0 {
+				ops, history, viols = cand, candHistory, candViols
+				if n > 2 {
+					n--
+				}
+				reduced = true
+				break
+			}
+		}
+		if !reduced {
+			if n >= len(ops) {
+				break
+			}
+			if n *= 2; n > len(ops) {
+				n = len(ops)
+			}
+		}
+	}
+	return ops, history, viols
+}
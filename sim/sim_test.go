@@ -0,0 +1,79 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package sim
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+//TestConvergence runs short fixed workloads: the cluster must converge on the last value written.
+func TestConvergence(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the workloads take tens of seconds")
+	}
+	runs := []Options{
+		{Nodes: 3, Ops: 8, Seed: 7},
+		{Nodes: 3, Ops: 12, Seed: 19},
+		{Nodes: 4, Ops: 12, Seed: 42},
+		{Nodes: 4, Ops: 16, Seed: 1021},
+		{Nodes: 5, Ops: 12, Seed: 31337},
+	}
+	//each cluster lives on its own bus and mostly waits: the workloads run side by side
+	reports := make([]*Report, len(runs))
+	var wg sync.WaitGroup
+	for i := range runs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reports[i] = Run(runs[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, r := range reports {
+		if r.Failed() {
+			t.Error(r.String())
+		}
+	}
+}
+
+func TestCheckLostWrite(t *testing.T) {
+	history := []Event{
+		{Kind: OpSet, Node: "s1", Ts: 100, Value: "v0"},
+		{Kind: OpGet, Node: "n0.0", Ts: 100, Value: "v0"},
+		{Kind: OpSet, Node: "s2", Ts: 101, Value: "v1"},
+		{Kind: OpFinal, Node: "n0.0", Ts: 100, Value: "v0"},
+		{Kind: OpFinal, Node: "n1.0", Ts: 100, Value: "v0"},
+	}
+	viols := Check(history)
+	if len(viols) != 1 || !strings.Contains(viols[0], "write lost") {
+		t.Fatalf("got violations %q, want the write at ts:101 lost", viols)
+	}
+
+	//a kill after the set may lose it
+	killed := append(append([]Event{}, history[:3]...), Event{Kind: OpKill, Node: "n1.0"})
+	killed = append(killed, history[3])
+	if viols := Check(killed); len(viols) != 0 {
+		t.Fatalf("got violations %q, want none", viols)
+	}
+}
@@ -0,0 +1,291 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//ACL permissions, each one granting the ones before it as well: none denies even the reads,
+//admin grants the administration of the daemons (see PermAllows)
+const (
+	PermNone  = "none"
+	PermRead  = "read"
+	PermWrite = "write"
+	PermAdmin = "admin"
+)
+
+var permRanks = map[string]int{PermNone: 0, PermRead: 1, PermWrite: 2, PermAdmin: 3}
+
+//PermAllows tells whether the permission have grants need
+func PermAllows(have, need string) bool {
+	h, ok := permRanks[have]
+	return ok && h >= permRanks[need]
+}
+
+func validPerm(perm string) bool {
+	_, ok := permRanks[perm]
+	return ok
+}
+
+//ACLIdentity is a client of the cluster, told by the certificate or the token it presents
+type ACLIdentity struct {
+	//the name the audit log tells the client by
+	Name string `json:"name"`
+
+	//the common name of the TLS client certificate, verified against the cluster CA (see TLS)
+	Cert string `json:"cert,omitempty"`
+
+	//the SHA-256, in hex, of the bearer token: the token itself is not kept
+	TokenSHA256 string `json:"token_sha256,omitempty"`
+
+	Permission string `json:"permission"`
+}
+
+/**
+ * ACL maps the clients of the cluster to their permissions:
+ *
+ *      {
+ *       "version" : 3,
+ *       "default" : "read",
+ *       "identities" : [
+ *                       {"name" : "ops", "cert" : "ops.example.com", "permission" : "admin"},
+ *                       {"name" : "ci", "token_sha256" : "9f86d081...", "permission" : "write"}
+ *                      ]
+ *      }
+ *
+ * The daemons of the cluster converge on the ACL with the greatest version (see Newer), so an ACL is changed
+ * by giving it a greater version. Clients matching no identity get the default permission, read if empty.
+ */
+type ACL struct {
+	Version    uint64        `json:"version"`
+	Default    string        `json:"default,omitempty"`
+	Identities []ACLIdentity `json:"identities"`
+}
+
+//ReadACL reads and validates the ACL in the Json file at path; an empty path means no ACL
+func ReadACL(path string) (*ACL, error) {
+	if path == "" {
+		return nil, nil
+	}
+	buff, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	acl := &ACL{}
+	if err := json.Unmarshal(buff, acl); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := acl.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return acl, nil
+}
+
+//Validate checks the version, the permissions and the identities of acl
+func (acl *ACL) Validate() error {
+	if acl.Version == 0 {
+		return fmt.Errorf("version must be greater than 0")
+	}
+	if acl.Default != "" && !validPerm(acl.Default) {
+		return fmt.Errorf("default: unknown permission %q, expected none, read, write or admin", acl.Default)
+	}
+	for i, id := range acl.Identities {
+		switch {
+		case id.Name == "":
+			return fmt.Errorf("identity %d: no name", i)
+		case id.Cert == "" && id.TokenSHA256 == "":
+			return fmt.Errorf("identity %s: neither cert nor token_sha256", id.Name)
+		case !validPerm(id.Permission):
+			return fmt.Errorf("identity %s: unknown permission %q, expected none, read, write or admin", id.Name, id.Permission)
+		}
+		if id.TokenSHA256 != "" {
+			if b, err := hex.DecodeString(id.TokenSHA256); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("identity %s: token_sha256 is not a hex SHA-256", id.Name)
+			}
+		}
+	}
+	return nil
+}
+
+//Hash returns a digest of acl, telling apart two ACLs with the same version; "" for a nil ACL
+func (acl *ACL) Hash() string {
+	if acl == nil {
+		return ""
+	}
+	buff, _ := json.Marshal(acl)
+	sum := sha256.Sum256(buff)
+	return hex.EncodeToString(sum[:8])
+}
+
+//String tells acl by its version and hash
+func (acl *ACL) String() string {
+	if acl == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", acl.Version, acl.Hash())
+}
+
+//ACLNewer tells whether the ACL with version and hash supersedes the one with curVersion and curHash:
+//the greatest version wins, the greatest hash if the versions are the same
+func ACLNewer(version uint64, hash string, curVersion uint64, curHash string) bool {
+	return version > curVersion || (version == curVersion && hash > curHash)
+}
+
+//Newer tells whether acl supersedes cur (see ACLNewer); any ACL supersedes none
+func (acl *ACL) Newer(cur *ACL) bool {
+	if cur == nil {
+		return acl != nil
+	}
+	return ACLNewer(acl.Version, acl.Hash(), cur.Version, cur.Hash())
+}
+
+//Lookup returns the identity presenting the certificate with common name cert or the bearer token
+//(both may be empty), the token winning; a client matching no identity gets a nameless one with the default permission.
+func (acl *ACL) Lookup(cert, token string) ACLIdentity {
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		hash := hex.EncodeToString(sum[:])
+		for _, id := range acl.Identities {
+			if id.TokenSHA256 == hash {
+				return id
+			}
+		}
+	}
+	if cert != "" {
+		for _, id := range acl.Identities {
+			if id.Cert == cert {
+				return id
+			}
+		}
+	}
+	def := acl.Default
+	if def == "" {
+		def = PermRead
+	}
+	return ACLIdentity{Permission: def}
+}
+
+//NewNonce returns a random challenge, in hex, for a daemon to prove itself with (see DaemonKey)
+func NewNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/**
+ * DaemonKey holds the keys of the daemon-key file, known to the daemons of the cluster only: unlike the cluster keys
+ * (see Auth), which every node holds, clients included, they tell a daemon apart from a client claiming to be one.
+ * A node asking another one for something sends a random challenge (see NewNonce) along with its request; a daemon
+ * answers with a proof, the HMAC-SHA256 of the challenge and of the answer:
+ *
+ *      proof = hex(HMAC-SHA256(key, challenge | Json body without the proof))
+ *
+ * A daemon asking another one for something proves itself the same way, for the challenge it sends: its proof covers
+ * the whole request, including the time it was sent, and is accepted once only, within the replay window (see
+ * VerifyRequest), so that a request captured cannot be sent again by someone else.
+ *
+ * The first key proves, all of them are accepted. A nil DaemonKey proves nothing and accepts nothing.
+ */
+type DaemonKey struct {
+	keys       [][]byte
+	mtx        sync.Mutex
+	seen       map[string]time.Time //the challenges of the requests accepted, until they leave the replay window
+	nextForget time.Time
+}
+
+//NewDaemonKey returns the DaemonKey with keys, nil if there are none
+func NewDaemonKey(keys [][]byte) *DaemonKey {
+	if len(keys) == 0 {
+		return nil
+	}
+	return &DaemonKey{keys: keys, seen: make(map[string]time.Time)}
+}
+
+func daemonProof(key []byte, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(nonce))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+//Prove returns the proof of body for the challenge nonce, "" if k is nil
+func (k *DaemonKey) Prove(nonce string, body []byte) string {
+	if k == nil {
+		return ""
+	}
+	return hex.EncodeToString(daemonProof(k.keys[0], nonce, body))
+}
+
+//Verify tells whether proof is the proof of body for the challenge nonce, by any of the keys of k
+func (k *DaemonKey) Verify(nonce string, body []byte, proof string) bool {
+	if k == nil || nonce == "" || proof == "" {
+		return false
+	}
+	got, err := hex.DecodeString(proof)
+	if err != nil {
+		return false
+	}
+	for _, key := range k.keys {
+		if hmac.Equal(got, daemonProof(key, nonce, body)) {
+			return true
+		}
+	}
+	return false
+}
+
+//VerifyRequest tells whether proof is the proof of a request (body) for its own challenge nonce, like Verify, for a
+//request sent at the specified time (nanoseconds since the Unix epoch): the request must be within the replay window
+//and its challenge must not have been accepted already
+func (k *DaemonKey) VerifyRequest(nonce string, sent int64, window time.Duration, body []byte, proof string) bool {
+	if !k.Verify(nonce, body, proof) {
+		return false
+	}
+	at := time.Unix(0, sent)
+	if d := time.Since(at); d > window || d < -window {
+		return false
+	}
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if _, replayed := k.seen[nonce]; replayed {
+		return false
+	}
+	now := time.Now()
+	if !now.Before(k.nextForget) {
+		k.nextForget = now.Add(window / 8)
+		for n, until := range k.seen {
+			if now.After(until) {
+				delete(k.seen, n)
+			}
+		}
+	}
+	k.seen[nonce] = at.Add(window)
+	return true
+}
@@ -0,0 +1,96 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package util
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPermAllows(t *testing.T) {
+	for _, c := range []struct {
+		have, need string
+		want       bool
+	}{
+		{PermAdmin, PermWrite, true},
+		{PermWrite, PermWrite, true},
+		{PermWrite, PermAdmin, false},
+		{PermRead, PermWrite, false},
+		{PermNone, PermRead, false},
+		{"", PermNone, false},
+		{"root", PermRead, false},
+	} {
+		if got := PermAllows(c.have, c.need); got != c.want {
+			t.Errorf("PermAllows(%q, %q) = %v, want %v", c.have, c.need, got, c.want)
+		}
+	}
+}
+
+func TestDaemonKey(t *testing.T) {
+	old, cur := []byte("0123456789abcdef-old"), []byte("0123456789abcdef-new")
+	k := NewDaemonKey([][]byte{cur, old})
+	nonce, body := NewNonce(), []byte(`{"_op":"get"}`)
+	proof := k.Prove(nonce, body)
+	if !k.Verify(nonce, body, proof) {
+		t.Fatal("a proof of the first key was refused")
+	}
+
+	//a daemon still proving with a key replaced is accepted as long as the key is in the file
+	if !k.Verify(nonce, body, NewDaemonKey([][]byte{old}).Prove(nonce, body)) {
+		t.Fatal("a proof of the second key was refused")
+	}
+	if k.Verify(nonce, body, NewDaemonKey([][]byte{[]byte("0123456789abcdef-bad")}).Prove(nonce, body)) {
+		t.Fatal("a proof of an unknown key was accepted")
+	}
+	if k.Verify(NewNonce(), body, proof) || k.Verify(nonce, []byte(`{"_op":"set"}`), proof) {
+		t.Fatal("a proof was accepted for another nonce or message")
+	}
+
+	var none *DaemonKey
+	if NewDaemonKey(nil) != nil || none.Prove(nonce, body) != "" || none.Verify(nonce, body, proof) || k.Verify(nonce, body, "") {
+		t.Fatal("a missing key or proof must prove and accept nothing")
+	}
+}
+
+func TestDaemonKeyReplay(t *testing.T) {
+	k := NewDaemonKey([][]byte{[]byte("0123456789abcdef-cur")})
+	window := time.Minute
+	request := func(sent time.Time) (string, int64, []byte, string) {
+		nonce, body := NewNonce(), []byte(fmt.Sprintf(`{"_op":"get","_tm":%d}`, sent.UnixNano()))
+		return nonce, sent.UnixNano(), body, k.Prove(nonce, body)
+	}
+
+	nonce, sent, body, proof := request(time.Now())
+	if !k.VerifyRequest(nonce, sent, window, body, proof) {
+		t.Fatal("a fresh request was refused")
+	}
+	if k.VerifyRequest(nonce, sent, window, body, proof) {
+		t.Fatal("a replayed request was accepted")
+	}
+	for _, d := range []time.Duration{-2 * window, 2 * window} {
+		nonce, sent, body, proof := request(time.Now().Add(d))
+		if k.VerifyRequest(nonce, sent, window, body, proof) {
+			t.Fatalf("a request sent %s away from now was accepted", d)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//AuthReplayWindow bounds, when not configured (see SetReplayWindow), the difference between the time a frame
+//was signed and the time it is received: the clocks of the nodes must agree within it.
+//The nonces of the frames received within the window are remembered, so a frame cannot be received twice.
+const AuthReplayWindow = 30 * time.Second
+
+//MaxUnverifiedFrameLen is the largest frame read, when there are keys, before anything of it is verified:
+//the length of a larger frame must be signed (see Seal), so that a node without the key cannot make the reader allocate it
+const MaxUnverifiedFrameLen = 64 * 1024
+
+//DefaultAuthGrace is the time the keys replaced by Rotate remain accepted, when not configured
+const DefaultAuthGrace = 5 * time.Minute
+
+//MinAuthKeyLen is the minimum length, in bytes, of a cluster key
+const MinAuthKeyLen = 16
+
+/**
+ * Authenticated frame: when the cluster has a key, the payload of every frame (Alive, Request, Data, ...)
+ * starts with a header signing the Json body that follows it:
+ *
+ *      | 0x01 | key id (4) | time (8) | nonce (8) | length mac (16) | mac (32) | Json body |
+ *
+ *  - key id: the first 4 bytes of SHA-256(key), telling which key signed the frame;
+ *  - time: the time the frame was signed, in nanoseconds since the Unix epoch (little endian);
+ *  - nonce: random bytes, so that frames signed at the same time differ;
+ *  - length mac: the first 16 bytes of HMAC-SHA256(key, 0x01 | key id | time | nonce | payload length (4, little endian)),
+ *    checked before reading the body of a frame larger than MaxUnverifiedFrameLen;
+ *  - mac: HMAC-SHA256(key, 0x01 | key id | time | nonce | length mac | Json body).
+ *
+ * A plain frame starts with the Json body itself, that is with '{'.
+ *
+ * Encrypted frame: alive messages can be encrypted too (see SetEncryption), hiding the addresses, ports and timestamps
+ * of the nodes from the segment:
+ *
+ *      | 0x02 | key id (4) | nonce (12) | AES-256-GCM(time (8) | Json body) | tag (16) |
+ *
+ *  - the AES key is HMAC-SHA256(key, "nds alive encryption");
+ *  - nonce: random bytes, a fresh one for every frame;
+ *  - the version and the key id are authenticated as additional data; time is checked as for a signed frame.
+ */
+const (
+	authVersion   = 0x01
+	authIDLen     = 4
+	authNonceLen  = 8
+	authLenMACLen = 16
+	authSignedLen = 1 + authIDLen + 8 + authNonceLen
+	authHeaderLen = authSignedLen + authLenMACLen + sha256.Size
+
+	encVersion   = 0x02
+	encNonceLen  = 12
+	encHeaderLen = 1 + authIDLen + encNonceLen
+)
+
+//AuthError tells why a frame was dropped; it is an NDSError with code RetCode_DRPPKT
+type AuthError struct {
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return "not authenticated: " + e.Reason
+}
+
+func (e *AuthError) Unwrap() error {
+	return &NDSError{RetCode_DRPPKT}
+}
+
+type authKey struct {
+	id     [authIDLen]byte
+	secret []byte
+
+	//encrypts the alive messages, keyed from secret
+	aead cipher.AEAD
+}
+
+func newAuthKey(secret []byte) authKey {
+	k := authKey{secret: secret}
+	sum := sha256.Sum256(secret)
+	copy(k.id[:], sum[:])
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("nds alive encryption"))
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	k.aead, _ = cipher.NewGCM(block)
+	return k
+}
+
+/**
+ * Auth signs the frames sent and verifies the frames received with the keys of the cluster:
+ * the first key signs, all of them are accepted.
+ * Without keys (or with a nil Auth) frames are sent plain; signed frames are then accepted without being verified.
+ * An Auth is safe for concurrent use.
+ */
+type Auth struct {
+	mtx  sync.Mutex
+	keys []authKey
+
+	//the keys replaced by Rotate, each set until its own grace period ends
+	retired []retiredKeys
+
+	//the time and nonce of the frames received within the replay window, with the time they can be forgotten
+	seen       map[[8 + authNonceLen]byte]time.Time
+	nextForget time.Time
+
+	//the replay window, AuthReplayWindow if 0
+	window time.Duration
+
+	//alive messages are encrypted, not just signed
+	encrypt bool
+}
+
+//retiredKeys are keys replaced by Rotate, accepted until the end of their grace period;
+//plain frames are accepted meanwhile if there were no keys
+type retiredKeys struct {
+	keys  []authKey
+	plain bool
+	until time.Time
+}
+
+//NewAuth returns an Auth with keys, the first one signing
+func NewAuth(keys [][]byte) *Auth {
+	a := &Auth{seen: make(map[[8 + authNonceLen]byte]time.Time)}
+	for _, k := range keys {
+		a.keys = append(a.keys, newAuthKey(k))
+	}
+	return a
+}
+
+//ReadAuthKeys reads the keys of a key file: one per line, the first signing; empty lines and lines starting with '#' are skipped.
+//An empty path means no keys.
+func ReadAuthKeys(path string) ([][]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(line) < MinAuthKeyLen {
+			return nil, fmt.Errorf("%s:%d: a key must be at least %d bytes long", path, n, MinAuthKeyLen)
+		}
+		keys = append(keys, []byte(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no key", path)
+	}
+	return keys, nil
+}
+
+//Enabled tells whether frames are signed
+func (a *Auth) Enabled() bool {
+	if a == nil {
+		return false
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return len(a.keys) > 0
+}
+
+//KeyIDs returns the identifiers of the keys, in hex, the signing one first: keys are told apart without showing them
+func (a *Auth) KeyIDs() string {
+	if a == nil {
+		return ""
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	ids := make([]string, 0, len(a.keys))
+	for _, k := range a.keys {
+		ids = append(ids, hex.EncodeToString(k.id[:]))
+	}
+	return strings.Join(ids, ",")
+}
+
+//Rotate replaces the keys: the ones replaced remain accepted for grace, so that the nodes of the cluster
+//can move to the new keys one at a time. The keys replaced by former rotations remain accepted until their own
+//grace period ends.
+func (a *Auth) Rotate(keys [][]byte, grace time.Duration) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	now := time.Now()
+	retired := []retiredKeys{{keys: a.keys, plain: len(a.keys) == 0, until: now.Add(grace)}}
+	for _, r := range a.retired {
+		if now.Before(r.until) {
+			retired = append(retired, r)
+		}
+	}
+	a.retired = retired
+	a.keys = nil
+	for _, k := range keys {
+		a.keys = append(a.keys, newAuthKey(k))
+	}
+}
+
+//SetReplayWindow sets the largest difference accepted between the time a frame was signed and the time it is received,
+//that is how far apart the clocks of the nodes can be; 0 means AuthReplayWindow
+func (a *Auth) SetReplayWindow(window time.Duration) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.window = window
+}
+
+//ReplayWindow returns the largest difference accepted between the time a frame was signed and the time it is received
+func (a *Auth) ReplayWindow() time.Duration {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.replayWindow()
+}
+
+func (a *Auth) replayWindow() time.Duration {
+	if a.window == 0 {
+		return AuthReplayWindow
+	}
+	return a.window
+}
+
+//SetEncryption sets whether the alive messages sent are encrypted (see SealAlive), if there are keys
+func (a *Auth) SetEncryption(on bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.encrypt = on
+}
+
+//Encrypting tells whether the alive messages sent are encrypted
+func (a *Auth) Encrypting() bool {
+	if a == nil {
+		return false
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.encrypt && len(a.keys) > 0
+}
+
+//SealAlive returns the payload of a frame carrying the alive message body: encrypted if SetEncryption is on,
+//otherwise as Seal does. Both kinds are opened by Open.
+func (a *Auth) SealAlive(body []byte) []byte {
+	if !a.Encrypting() {
+		return a.Seal(body)
+	}
+	a.mtx.Lock()
+	k := a.keys[0]
+	a.mtx.Unlock()
+
+	payload := make([]byte, encHeaderLen, encHeaderLen+8+len(body)+k.aead.Overhead())
+	payload[0] = encVersion
+	copy(payload[1:], k.id[:])
+	nonce := payload[1+authIDLen : encHeaderLen]
+	rand.Read(nonce)
+
+	plain := make([]byte, 8, 8+len(body))
+	binary.LittleEndian.PutUint64(plain, uint64(time.Now().UnixNano()))
+	plain = append(plain, body...)
+	return k.aead.Seal(payload, nonce, plain, payload[:1+authIDLen])
+}
+
+//Seal returns the payload of a frame carrying body, signed if there are keys
+func (a *Auth) Seal(body []byte) []byte {
+	if a == nil {
+		return body
+	}
+	a.mtx.Lock()
+	if len(a.keys) == 0 {
+		a.mtx.Unlock()
+		return body
+	}
+	k := a.keys[0]
+	a.mtx.Unlock()
+
+	payload := make([]byte, authHeaderLen, authHeaderLen+len(body))
+	payload[0] = authVersion
+	copy(payload[1:], k.id[:])
+	binary.LittleEndian.PutUint64(payload[1+authIDLen:], uint64(time.Now().UnixNano()))
+	rand.Read(payload[1+authIDLen+8 : authSignedLen])
+	copy(payload[authSignedLen:], lengthMAC(k, payload[:authSignedLen], authHeaderLen+len(body)))
+	payload = append(payload, body...)
+
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(payload[:authSignedLen+authLenMACLen])
+	mac.Write(body)
+	copy(payload[authSignedLen+authLenMACLen:authHeaderLen], mac.Sum(nil))
+	return payload
+}
+
+//lengthMAC returns the mac signing the length of a payload, given the start of its header
+func lengthMAC(k authKey, signed []byte, length int) []byte {
+	var l [4]byte
+	binary.LittleEndian.PutUint32(l[:], uint32(length))
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(signed)
+	mac.Write(l[:])
+	return mac.Sum(nil)[:authLenMACLen]
+}
+
+//Open verifies the payload of a frame received and returns its body; a frame failing verification returns an *AuthError
+func (a *Auth) Open(payload []byte) ([]byte, error) {
+	if len(payload) > 0 && payload[0] == encVersion {
+		return a.openEncrypted(payload)
+	}
+	if len(payload) == 0 || payload[0] != authVersion {
+		if a != nil && !a.acceptsPlain() {
+			return nil, &AuthError{"not signed"}
+		}
+		return payload, nil
+	}
+	if len(payload) < authHeaderLen {
+		return nil, &AuthError{"truncated signature"}
+	}
+	if a == nil {
+		return payload[authHeaderLen:], nil
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if len(a.keys) == 0 {
+		return payload[authHeaderLen:], nil
+	}
+	k, ok := a.key(payload[1 : 1+authIDLen])
+	if !ok {
+		return nil, &AuthError{"unknown key " + hex.EncodeToString(payload[1:1+authIDLen])}
+	}
+	signed, body := payload[:authSignedLen+authLenMACLen], payload[authHeaderLen:]
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(signed)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), payload[len(signed):authHeaderLen]) {
+		return nil, &AuthError{"bad signature"}
+	}
+	if !hmac.Equal(lengthMAC(k, payload[:authSignedLen], len(payload)), payload[authSignedLen:len(signed)]) {
+		return nil, &AuthError{"bad length signature"}
+	}
+
+	sent := binary.LittleEndian.Uint64(payload[1+authIDLen:])
+	if err := a.fresh(sent, payload[1+authIDLen+8:authSignedLen]); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+//openEncrypted decrypts the payload of an encrypted frame and returns its body
+func (a *Auth) openEncrypted(payload []byte) ([]byte, error) {
+	if a == nil {
+		return nil, &AuthError{"encrypted, no key"}
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if len(a.keys) == 0 {
+		return nil, &AuthError{"encrypted, no key"}
+	}
+	if len(payload) < encHeaderLen+8 {
+		return nil, &AuthError{"truncated encryption header"}
+	}
+	k, ok := a.key(payload[1 : 1+authIDLen])
+	if !ok {
+		return nil, &AuthError{"unknown key " + hex.EncodeToString(payload[1:1+authIDLen])}
+	}
+	nonce := payload[1+authIDLen : encHeaderLen]
+	plain, err := k.aead.Open(nil, nonce, payload[encHeaderLen:], payload[:1+authIDLen])
+	if err != nil || len(plain) < 8 {
+		return nil, &AuthError{"cannot decrypt"}
+	}
+	if err := a.fresh(binary.LittleEndian.Uint64(plain), nonce); err != nil {
+		return nil, err
+	}
+	return plain[8:], nil
+}
+
+//fresh checks that a frame sent at the specified time (nanoseconds since the Unix epoch) is within the replay window
+//and that it was not received already, telling it by its time and nonce
+func (a *Auth) fresh(sent uint64, nonce []byte) error {
+	if err := a.inWindow(sent); err != nil {
+		return err
+	}
+	var id [8 + authNonceLen]byte
+	binary.LittleEndian.PutUint64(id[:], sent)
+	copy(id[8:], nonce)
+	if _, replayed := a.seen[id]; replayed {
+		return &AuthError{"replayed"}
+	}
+	now := time.Now()
+	a.forget(now)
+	a.seen[id] = time.Unix(0, int64(sent)).Add(a.replayWindow())
+	return nil
+}
+
+//inWindow checks that a frame sent at the specified time is within the replay window
+func (a *Auth) inWindow(sent uint64) error {
+	window := a.replayWindow()
+	if d := time.Since(time.Unix(0, int64(sent))); d > window || d < -window {
+		return &AuthError{fmt.Sprintf("signed %s away from now (node clocks must agree within %s)", d.Round(time.Millisecond), window)}
+	}
+	return nil
+}
+
+//acceptsPlain tells whether plain frames are accepted: without keys, or in the grace period following their introduction
+func (a *Auth) acceptsPlain() bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if len(a.keys) == 0 {
+		return true
+	}
+	now := time.Now()
+	for _, r := range a.retired {
+		if r.plain && now.Before(r.until) {
+			return true
+		}
+	}
+	return false
+}
+
+//key returns the key with identifier id, among the current ones and the replaced ones still accepted
+func (a *Auth) key(id []byte) (authKey, bool) {
+	for _, k := range a.keys {
+		if bytes.Equal(k.id[:], id) {
+			return k, true
+		}
+	}
+	now := time.Now()
+	for _, r := range a.retired {
+		if !now.Before(r.until) {
+			continue
+		}
+		for _, k := range r.keys {
+			if bytes.Equal(k.id[:], id) {
+				return k, true
+			}
+		}
+	}
+	return authKey{}, false
+}
+
+//forget drops, every now and then, the nonces of the frames that could no longer be accepted anyway
+func (a *Auth) forget(now time.Time) {
+	if now.Before(a.nextForget) {
+		return
+	}
+	a.nextForget = now.Add(a.replayWindow() / 8)
+	for nonce, until := range a.seen {
+		if now.After(until) {
+			delete(a.seen, nonce)
+		}
+	}
+}
+
+//NewFrame returns a frame (see NewFrame) carrying body, signed if there are keys
+func (a *Auth) NewFrame(body []byte) []byte {
+	return NewFrame(a.Seal(body))
+}
+
+//ReadFrame reads a frame (see ReadFrame) and returns its body, once verified.
+//When there are keys, the body of a frame larger than MaxUnverifiedFrameLen is read only once its signed length is verified.
+func (a *Auth) ReadFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	plen := binary.LittleEndian.Uint32(hdr[:])
+	if plen > MaxFrameLen {
+		return nil, &NDSError{RetCode_OVRSZ}
+	}
+
+	var head []byte
+	if plen > MaxUnverifiedFrameLen && a.Enabled() {
+		head = make([]byte, authHeaderLen)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return nil, err
+		}
+		if err := a.checkLength(head, int(plen)); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, plen)
+	copy(payload, head)
+	if _, err := io.ReadFull(r, payload[len(head):]); err != nil {
+		return nil, err
+	}
+	return a.Open(payload)
+}
+
+//checkLength verifies the length mac of the header of a payload of the specified length, before its body is read
+func (a *Auth) checkLength(head []byte, length int) error {
+	if head[0] == encVersion {
+		return &AuthError{fmt.Sprintf("encrypted frame of %d bytes", length)}
+	}
+	if head[0] != authVersion {
+		if a.acceptsPlain() {
+			return nil
+		}
+		return &AuthError{fmt.Sprintf("unsigned frame of %d bytes", length)}
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	k, ok := a.key(head[1 : 1+authIDLen])
+	if !ok {
+		return &AuthError{"unknown key " + hex.EncodeToString(head[1:1+authIDLen])}
+	}
+	if !hmac.Equal(lengthMAC(k, head[:authSignedLen], length), head[authSignedLen:authSignedLen+authLenMACLen]) {
+		return &AuthError{"bad length signature"}
+	}
+	return a.inWindow(binary.LittleEndian.Uint64(head[1+authIDLen:]))
+}
@@ -0,0 +1,131 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package util
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+var (
+	testKey     = []byte("0123456789abcdef0123456789abcdef")
+	testNextKey = []byte("fedcba9876543210fedcba9876543210")
+	testLastKey = []byte("the third key of the cluster, 42")
+)
+
+//sealAt signs body as Seal does, but as if at the specified time
+func sealAt(secret, body []byte, at time.Time) []byte {
+	k := newAuthKey(secret)
+	payload := make([]byte, authHeaderLen, authHeaderLen+len(body))
+	payload[0] = authVersion
+	copy(payload[1:], k.id[:])
+	binary.LittleEndian.PutUint64(payload[1+authIDLen:], uint64(at.UnixNano()))
+	copy(payload[authSignedLen:], lengthMAC(k, payload[:authSignedLen], authHeaderLen+len(body)))
+	payload = append(payload, body...)
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(payload[:authSignedLen+authLenMACLen])
+	mac.Write(body)
+	copy(payload[authSignedLen+authLenMACLen:authHeaderLen], mac.Sum(nil))
+	return payload
+}
+
+func isAuthError(err error) bool {
+	var authErr *AuthError
+	return errors.As(err, &authErr)
+}
+
+func TestLargeFrame(t *testing.T) {
+	a := NewAuth([][]byte{testKey})
+	body := bytes.Repeat([]byte("x"), 4*MaxUnverifiedFrameLen)
+	got, err := a.ReadFrame(bytes.NewReader(a.NewFrame(body)))
+	if err != nil {
+		t.Fatalf("reading a signed frame: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(body))
+	}
+}
+
+func TestLargeFrameUnverified(t *testing.T) {
+	a := NewAuth([][]byte{testKey})
+
+	//only the length and a header are there: reading the body would fail with io.ErrUnexpectedEOF instead
+	unsigned := make([]byte, 4+authHeaderLen)
+	binary.LittleEndian.PutUint32(unsigned, MaxFrameLen)
+	unsigned[4] = '{'
+	if _, err := a.ReadFrame(bytes.NewReader(unsigned)); !isAuthError(err) {
+		t.Fatalf("unsigned frame: got %v, want an AuthError", err)
+	}
+
+	other := NewAuth([][]byte{testNextKey}).NewFrame(make([]byte, 2*MaxUnverifiedFrameLen))
+	if _, err := a.ReadFrame(bytes.NewReader(other[:4+authHeaderLen])); !isAuthError(err) {
+		t.Fatalf("frame of an unknown key: got %v, want an AuthError", err)
+	}
+
+	forged := a.NewFrame(make([]byte, 2*MaxUnverifiedFrameLen))[:4+authHeaderLen]
+	binary.LittleEndian.PutUint32(forged, MaxFrameLen)
+	if _, err := a.ReadFrame(bytes.NewReader(forged)); !isAuthError(err) {
+		t.Fatalf("frame with a forged length: got %v, want an AuthError", err)
+	}
+}
+
+func TestRotateTwice(t *testing.T) {
+	first := NewAuth([][]byte{testKey})
+	a := NewAuth([][]byte{testKey})
+	a.Rotate([][]byte{testNextKey}, time.Hour)
+	a.Rotate([][]byte{testLastKey}, time.Hour)
+	if _, err := a.Open(first.Seal([]byte("{}"))); err != nil {
+		t.Fatalf("key replaced two rotations ago, within its grace: %v", err)
+	}
+
+	a = NewAuth([][]byte{testKey})
+	a.Rotate([][]byte{testNextKey}, 0)
+	a.Rotate([][]byte{testLastKey}, time.Hour)
+	if _, err := a.Open(first.Seal([]byte("{}"))); !isAuthError(err) {
+		t.Fatalf("key replaced past its grace: got %v, want an AuthError", err)
+	}
+	if _, err := a.Open(NewAuth([][]byte{testNextKey}).Seal([]byte("{}"))); err != nil {
+		t.Fatalf("key replaced by the last rotation: %v", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	a := NewAuth([][]byte{testKey})
+	late := time.Now().Add(-2 * AuthReplayWindow)
+	if _, err := a.Open(sealAt(testKey, []byte("{}"), late)); !isAuthError(err) {
+		t.Fatalf("frame signed %s ago: got %v, want an AuthError", 2*AuthReplayWindow, err)
+	}
+
+	a.SetReplayWindow(4 * AuthReplayWindow)
+	payload := sealAt(testKey, []byte("{}"), late)
+	if _, err := a.Open(payload); err != nil {
+		t.Fatalf("frame signed %s ago, within the window: %v", 2*AuthReplayWindow, err)
+	}
+	if _, err := a.Open(payload); !isAuthError(err) {
+		t.Fatalf("frame replayed: got %v, want an AuthError", err)
+	}
+}
@@ -0,0 +1,187 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package util
+
+import (
+	"fmt"
+	"net"
+)
+
+//ConfigError tells which setting of a Config is wrong and why; it is an NDSError with code RetCode_BADCFG
+type ConfigError struct {
+	//the setting, named as its command line option
+	Setting string
+	Reason  string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("bad configuration: %s: %s", e.Setting, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return &NDSError{RetCode_BADCFG}
+}
+
+//Validate checks the settings of cfg, returning a *ConfigError for the first wrong one
+func (cfg *Config) Validate() error {
+	if ip := net.ParseIP(cfg.MulticastAddress); ip == nil || ip.To4() == nil || !ip.IsMulticast() {
+		return &ConfigError{"join", fmt.Sprintf("%q is not an IPv4 multicast address", cfg.MulticastAddress)}
+	}
+	if cfg.MulticastPort == 0 || cfg.MulticastPort > 65535 {
+		return &ConfigError{"join-port", fmt.Sprintf("%d is not in the port range [1, 65535]", cfg.MulticastPort)}
+	}
+	if cfg.ListeningPort == 0 || cfg.ListeningPort > 65535 {
+		return &ConfigError{"port", fmt.Sprintf("%d is not in the port range [1, 65535]", cfg.ListeningPort)}
+	}
+
+	if cfg.LogType == "" {
+		return &ConfigError{"log", "either console or a file name is required"}
+	}
+	if _, ok := LogLevelStr2LvL[cfg.LogLevel]; !ok {
+		return &ConfigError{"verbosity", fmt.Sprintf("unknown level %q, expected one of off, trace, info, warn, err, critical", cfg.LogLevel)}
+	}
+	switch cfg.LogFormat {
+	case "", LogFormatText, LogFormatJSON, LogFormatLogfmt:
+	default:
+		return &ConfigError{"log-format", fmt.Sprintf("unknown format %q, expected one of text, json, logfmt", cfg.LogFormat)}
+	}
+	if cfg.LogMaxAge < 0 {
+		return &ConfigError{"log-max-age", "must not be negative"}
+	}
+
+	if cfg.TTL < 0 {
+		return &ConfigError{"ttl", "must not be negative"}
+	}
+	if cfg.TombstoneGrace < 0 {
+		return &ConfigError{"tombstone-grace", "must not be negative"}
+	}
+	if cfg.AuthKeyFile != "" {
+		if _, err := ReadAuthKeys(cfg.AuthKeyFile); err != nil {
+			return &ConfigError{"auth-key", err.Error()}
+		}
+	}
+	if cfg.AuthGrace < 0 {
+		return &ConfigError{"auth-grace", "must not be negative"}
+	}
+	if cfg.AuthMaxSkew < 0 {
+		return &ConfigError{"auth-max-skew", "must not be negative"}
+	}
+	if _, err := ReadACL(cfg.ACLFile); err != nil {
+		return &ConfigError{"acl", err.Error()}
+	}
+	if cfg.DaemonKeyFile != "" {
+		if _, err := ReadAuthKeys(cfg.DaemonKeyFile); err != nil {
+			return &ConfigError{"daemon-key", err.Error()}
+		}
+	}
+	if cfg.EncryptMulticast && cfg.AuthKeyFile == "" {
+		return &ConfigError{"encrypt-multicast", "requires auth-key"}
+	}
+	if _, err := LoadTLS(cfg); err != nil {
+		return err
+	}
+	if cfg.StartNode && cfg.TLSCAFile != "" && cfg.TLSCertFile == "" {
+		return &ConfigError{"tls-cert", "a daemon needs a certificate to accept the connections of the nodes using tls-ca"}
+	}
+	if cfg.Delete && cfg.SetVal {
+		return &ConfigError{"delete", "cannot be used along with set"}
+	}
+
+	for _, a := range []struct{ setting, address string }{
+		{"http", cfg.HTTPAddress},
+		{"grpc", cfg.GRPCAddress},
+		{"resp", cfg.RESPAddress},
+		{"memcache", cfg.MemcacheAddress},
+		{"dns", cfg.DNSAddress},
+		{"metrics", cfg.MetricsAddress},
+	} {
+		if a.address == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(a.address); err != nil {
+			return &ConfigError{a.setting, fmt.Sprintf("%q is not a host:port address", a.address)}
+		} else if n, err := net.LookupPort("tcp", port); err != nil || n < 0 || n > 65535 {
+			return &ConfigError{a.setting, fmt.Sprintf("%q has a bad port", a.address)}
+		}
+	}
+	return nil
+}
+
+//SettingChange is a setting of a daemon node whose value differs between two configurations
+type SettingChange struct {
+	//the setting, named as its command line option
+	Setting  string
+	Old, New string
+
+	//the change can be applied while the node runs; otherwise it takes a restart
+	Reloadable bool
+}
+
+func (c SettingChange) String() string {
+	return fmt.Sprintf("%s: %q -> %q", c.Setting, c.Old, c.New)
+}
+
+//Changes returns the settings of a daemon node differing in next, the ones that can be applied while running first.
+//The value set at startup (set, ttl) is not a setting of the node and is not compared, nor are the keys of auth-key,
+//the ACL and the TLS settings, whose contents live in files (see Peer.Reload and TLS.Changes).
+func (cfg *Config) Changes(next *Config) []SettingChange {
+	var reloadable, restart []SettingChange
+	compare := func(setting string, old, new interface{}, canReload bool) {
+		o, n := fmt.Sprint(old), fmt.Sprint(new)
+		if o == n {
+			return
+		}
+		if canReload {
+			reloadable = append(reloadable, SettingChange{setting, o, n, true})
+		} else {
+			restart = append(restart, SettingChange{setting, o, n, false})
+		}
+	}
+
+	compare("log", cfg.LogType, next.LogType, true)
+	compare("verbosity", cfg.LogLevel, next.LogLevel, true)
+	compare("log-format", cfg.LogFormat, next.LogFormat, true)
+	compare("log-shared", cfg.LogShared, next.LogShared, true)
+	compare("log-max-size", cfg.LogMaxSize, next.LogMaxSize, true)
+	compare("log-max-age", cfg.LogMaxAge, next.LogMaxAge, true)
+	compare("log-max-backups", cfg.LogMaxBackups, next.LogMaxBackups, true)
+	compare("log-compress", cfg.LogCompress, next.LogCompress, true)
+	compare("history-size", cfg.HistorySize, next.HistorySize, true)
+	compare("tombstone-grace", cfg.TombstoneGrace, next.TombstoneGrace, true)
+	compare("auth-grace", cfg.AuthGrace, next.AuthGrace, true)
+	compare("auth-max-skew", cfg.AuthMaxSkew, next.AuthMaxSkew, true)
+	compare("encrypt-multicast", cfg.EncryptMulticast, next.EncryptMulticast, true)
+
+	compare("join", cfg.MulticastAddress, next.MulticastAddress, false)
+	compare("join-port", cfg.MulticastPort, next.MulticastPort, false)
+	compare("port", cfg.ListeningPort, next.ListeningPort, false)
+	compare("http", cfg.HTTPAddress, next.HTTPAddress, false)
+	compare("grpc", cfg.GRPCAddress, next.GRPCAddress, false)
+	compare("resp", cfg.RESPAddress, next.RESPAddress, false)
+	compare("memcache", cfg.MemcacheAddress, next.MemcacheAddress, false)
+	compare("mdns", cfg.MDNS, next.MDNS, false)
+	compare("dns", cfg.DNSAddress, next.DNSAddress, false)
+	compare("dns-cluster", cfg.DNSCluster, next.DNSCluster, false)
+	compare("metrics", cfg.MetricsAddress, next.MetricsAddress, false)
+	compare("daemon-key", cfg.DaemonKeyFile, next.DaemonKeyFile, false)
+	return append(reloadable, restart...)
+}
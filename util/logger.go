@@ -21,10 +21,15 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package util
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"io"
-	"log"
-	"os"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type LogLevel int
@@ -51,84 +56,408 @@ const (
 
 var LogLevelStr2LvL = map[string]LogLevel{TraceStr: Trace, InfoStr: Info, WarnStr: Warn, ErrStr: Err, CriticalStr: Critical, OffStr: Off}
 
+var logLevel2Str = map[LogLevel]string{Trace: TraceStr, Info: InfoStr, Warn: WarnStr, Err: ErrStr, Critical: CriticalStr, Off: OffStr}
+
+//the levels of the classes (components), shared by the loggers of a class so that they can be changed at runtime;
+//a class takes the level configured by its first logger
+var classLevels = struct {
+	mtx        sync.Mutex
+	levels     map[string]*int32
+	configured map[string]LogLevel
+}{levels: make(map[string]*int32), configured: make(map[string]LogLevel)}
+
+func classLevel(class string, lvl LogLevel) *int32 {
+	classLevels.mtx.Lock()
+	defer classLevels.mtx.Unlock()
+	if level := classLevels.levels[class]; level != nil {
+		return level
+	}
+	level := new(int32)
+	*level = int32(lvl)
+	classLevels.levels[class] = level
+	classLevels.configured[class] = lvl
+	return level
+}
+
+//LogClassAll selects all the classes in SetLogLevel
+const LogClassAll = "all"
+
+//SetLogLevel changes the level of the loggers of class (e.g. "peer", "acpt", "mcast") or, with LogClassAll, of all of them
+func SetLogLevel(class string, level string) error {
+	lvl, ok := LogLevelStr2LvL[level]
+	if !ok {
+		return &NDSError{RetCode_BADARG}
+	}
+	classLevels.mtx.Lock()
+	defer classLevels.mtx.Unlock()
+	if class == LogClassAll {
+		for _, l := range classLevels.levels {
+			atomic.StoreInt32(l, int32(lvl))
+		}
+		return nil
+	}
+	l := classLevels.levels[strings.TrimSuffix(class, ".")]
+	if l == nil {
+		return &NDSError{RetCode_NOTFOUND}
+	}
+	atomic.StoreInt32(l, int32(lvl))
+	return nil
+}
+
+//ResetLogLevels changes the level of every class back to the configured one
+func ResetLogLevels() {
+	classLevels.mtx.Lock()
+	defer classLevels.mtx.Unlock()
+	for class, l := range classLevels.levels {
+		atomic.StoreInt32(l, int32(classLevels.configured[class]))
+	}
+}
+
+//LogLevels returns the current level of every class
+func LogLevels() map[string]string {
+	classLevels.mtx.Lock()
+	defer classLevels.mtx.Unlock()
+	levels := make(map[string]string, len(classLevels.levels))
+	for class, l := range classLevels.levels {
+		levels[class] = logLevel2Str[LogLevel(atomic.LoadInt32(l))]
+	}
+	return levels
+}
+
+//log record formats
+const (
+	LogFormatText   = "text"   //15:04:05.000000 [<class>.<level>] <message> key=value ...
+	LogFormatJSON   = "json"   //one JSON object per record: time, level, class, msg and the fields
+	LogFormatLogfmt = "logfmt" //time=... level=... class=... msg=... key=value ...
+)
+
+//Field is a typed piece of context attached to a log record
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+//keys of the fields shared by the components
+const (
+	FieldKeyNodeID  = "node_id"
+	FieldKeyPeer    = "peer"
+	FieldKeyTS      = "ts"
+	FieldKeyPktType = "pkt_type"
+	FieldKeyErr     = "err"
+)
+
+//FieldNodeID is the identifier of a node
+func FieldNodeID(id string) Field {
+	return Field{FieldKeyNodeID, id}
+}
+
+//FieldPeer is the address of the remote side of a packet or connection; port 0 means address already carries it, if any
+func FieldPeer(address string, port uint) Field {
+	if port == 0 {
+		return Field{FieldKeyPeer, address}
+	}
+	return Field{FieldKeyPeer, net.JoinHostPort(address, strconv.FormatUint(uint64(port), 10))}
+}
+
+//FieldTS is a timestamp
+func FieldTS(ts uint64) Field {
+	return Field{FieldKeyTS, ts}
+}
+
+//FieldPktType is the type of a packet (see MsgPktType*)
+func FieldPktType(pt string) Field {
+	return Field{FieldKeyPktType, pt}
+}
+
+//FieldErr is an error
+func FieldErr(err error) Field {
+	return Field{FieldKeyErr, err.Error()}
+}
+
+//FieldAny is any other piece of context
+func FieldAny(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+//Logger writes the records of a component (its class); Trace, Info, Warn, Err and Critical
+//take a printf style message, their "w" counterparts a message and typed fields.
 type Logger struct {
-	Lgr    *log.Logger
-	LgrLvl LogLevel
-	Class  string
-	Out    io.Writer
+	Class string
+
+	//the level of the class (see SetLogLevel)
+	level *int32
+
+	//fields attached to every record (see With)
+	fields []Field
 
-	//opt logger fd
-	l_fd *os.File
+	//where the records go, shared with the loggers derived with With
+	out *logOutput
+}
+
+//logOutput is where a logger writes: ReconfigureLogs replaces its target
+type logOutput struct {
+	class  string
+	target atomic.Value //*logTarget
+}
+
+type logTarget struct {
+	sink   *logSink
+	format string
+}
+
+//the outputs of the loggers not stopped
+var logOutputs = struct {
+	mtx sync.Mutex
+	m   map[*logOutput]bool
+}{m: make(map[*logOutput]bool)}
+
+//logSettings returns the level and the format configured by cfg
+func logSettings(cfg *Config) (LogLevel, string, error) {
+	lvl, ok := LogLevel(Info), true
+	if cfg.LogLevel != "" {
+		if lvl, ok = LogLevelStr2LvL[cfg.LogLevel]; !ok {
+			fmt.Printf("unknown log level:%s\n", cfg.LogLevel)
+			return lvl, "", &NDSError{RetCode_BADCFG}
+		}
+	}
+
+	switch cfg.LogFormat {
+	case "":
+		return lvl, LogFormatText, nil
+	case LogFormatText, LogFormatJSON, LogFormatLogfmt:
+		return lvl, cfg.LogFormat, nil
+	default:
+		fmt.Printf("unknown log format:%s\n", cfg.LogFormat)
+		return lvl, "", &NDSError{RetCode_BADCFG}
+	}
 }
 
 func (lgr *Logger) Init(class string, cfg *Config) error {
-	lgr.LgrLvl = LogLevelStr2LvL[cfg.LogLevel]
+	lgr.Stop()
 	lgr.Class = class
-	if cfg.LogType == "console" {
-		lgr.Out = os.Stdout
-	} else {
-		var err error
-		if lgr.l_fd, err = os.OpenFile(class+cfg.LogType, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+	lgr.fields = nil
+
+	lvl, format, err := logSettings(cfg)
+	if err != nil {
+		return err
+	}
+
+	sink, err := openLogSink(class, cfg)
+	if err != nil {
+		fmt.Println(err.Error())
+		return &NDSError{RetCode_IOERR}
+	}
+	lgr.out = &logOutput{class: class}
+	lgr.out.target.Store(&logTarget{sink: sink, format: format})
+	logOutputs.mtx.Lock()
+	logOutputs.m[lgr.out] = true
+	logOutputs.mtx.Unlock()
+	lgr.level = classLevel(strings.TrimSuffix(class, "."), lvl)
+	return nil
+}
+
+//Stop releases the logger: its file is closed once no other logger writes to it.
+//Loggers derived with With share the logger, so only one of them must be stopped; records logged afterwards may be lost.
+func (lgr *Logger) Stop() {
+	if lgr.out == nil {
+		return
+	}
+	logOutputs.mtx.Lock()
+	defer logOutputs.mtx.Unlock()
+	if logOutputs.m[lgr.out] {
+		delete(logOutputs.m, lgr.out)
+		lgr.out.target.Load().(*logTarget).sink.release()
+	}
+}
+
+//ReconfigureLogs moves the loggers not stopped to the destination, format and rotation of cfg, and makes the level
+//of cfg the configured one of every class; a level changed with SetLogLevel is retained unless the configured one changes.
+//If a log file cannot be opened, nothing changes.
+func ReconfigureLogs(cfg *Config) error {
+	lvl, format, err := logSettings(cfg)
+	if err != nil {
+		return err
+	}
+
+	logOutputs.mtx.Lock()
+	defer logOutputs.mtx.Unlock()
+	targets := make(map[*logOutput]*logTarget, len(logOutputs.m))
+	for out := range logOutputs.m {
+		sink, err := openLogSink(out.class, cfg)
+		if err != nil {
+			for _, t := range targets {
+				t.sink.release()
+			}
 			fmt.Println(err.Error())
 			return &NDSError{RetCode_IOERR}
 		}
-		lgr.Out = lgr.l_fd
+		sink.setRotation(cfg)
+		targets[out] = &logTarget{sink: sink, format: format}
+	}
+	for out, t := range targets {
+		old := out.target.Load().(*logTarget)
+		out.target.Store(t)
+		old.sink.release()
 	}
 
-	lgr.Lgr = log.New(lgr.Out, "", log.Lmsgprefix|log.Ltime|log.Lmicroseconds)
+	classLevels.mtx.Lock()
+	defer classLevels.mtx.Unlock()
+	for class, l := range classLevels.levels {
+		if classLevels.configured[class] != lvl {
+			classLevels.configured[class] = lvl
+			atomic.StoreInt32(l, int32(lvl))
+		}
+	}
 	return nil
 }
 
-func (lgr *Logger) Stop() {
-	if lgr.l_fd != nil {
-		lgr.l_fd.Close()
-	}
+//With returns a logger attaching fields to every record, writing where lgr does
+func (lgr *Logger) With(fields ...Field) Logger {
+	child := *lgr
+	child.fields = append(append([]Field(nil), lgr.fields...), fields...)
+	return child
 }
 
 func (lgr *Logger) Trace(format string, v ...interface{}) {
-	if lgr.LgrLvl > Trace {
-		return
-	}
-	lgr.Lgr.SetPrefix("[" + lgr.Class + TraceStr + "] ")
-	lgr.Lgr.Printf(format, v...)
+	lgr.logf(Trace, format, v...)
 }
 
 func (lgr *Logger) Info(format string, v ...interface{}) {
-	if lgr.LgrLvl > Info {
-		return
-	}
-	lgr.Lgr.SetPrefix("[" + lgr.Class + InfoStr + "] ")
-	lgr.Lgr.Printf(format, v...)
+	lgr.logf(Info, format, v...)
 }
 
 func (lgr *Logger) Warn(format string, v ...interface{}) {
-	if lgr.LgrLvl > Warn {
-		return
-	}
-	lgr.Lgr.SetPrefix("[" + lgr.Class + WarnStr + "] ")
-	lgr.Lgr.Printf(format, v...)
+	lgr.logf(Warn, format, v...)
 }
 
 func (lgr *Logger) Err(format string, v ...interface{}) {
-	if lgr.LgrLvl > Err {
+	lgr.logf(Err, format, v...)
+}
+
+func (lgr *Logger) Critical(format string, v ...interface{}) {
+	lgr.logf(Critical, format, v...)
+}
+
+func (lgr *Logger) Tracew(msg string, fields ...Field) {
+	lgr.Log(Trace, msg, fields...)
+}
+
+func (lgr *Logger) Infow(msg string, fields ...Field) {
+	lgr.Log(Info, msg, fields...)
+}
+
+func (lgr *Logger) Warnw(msg string, fields ...Field) {
+	lgr.Log(Warn, msg, fields...)
+}
+
+func (lgr *Logger) Errw(msg string, fields ...Field) {
+	lgr.Log(Err, msg, fields...)
+}
+
+func (lgr *Logger) Criticalw(msg string, fields ...Field) {
+	lgr.Log(Critical, msg, fields...)
+}
+
+//Enabled tells whether records with level lvl are written
+func (lgr *Logger) Enabled(lvl LogLevel) bool {
+	return lgr.out != nil && LogLevel(atomic.LoadInt32(lgr.level)) <= lvl
+}
+
+//logf is the adapter of the printf style calls: the formatted text is the message of the record
+func (lgr *Logger) logf(lvl LogLevel, format string, v ...interface{}) {
+	if !lgr.Enabled(lvl) {
 		return
 	}
-	lgr.Lgr.SetPrefix("[" + lgr.Class + ErrStr + "] ")
-	lgr.Lgr.Printf(format, v...)
+	lgr.Log(lvl, fmt.Sprintf(format, v...))
 }
 
-func (lgr *Logger) Critical(format string, v ...interface{}) {
-	if lgr.LgrLvl > Critical {
+//Log writes a record with level lvl, if enabled
+func (lgr *Logger) Log(lvl LogLevel, msg string, fields ...Field) {
+	if !lgr.Enabled(lvl) {
 		return
 	}
-	lgr.Lgr.SetPrefix("[" + lgr.Class + CriticalStr + "] ")
-	lgr.Lgr.Printf(format, v...)
+
+	now := time.Now()
+	class := strings.TrimSuffix(lgr.Class, ".")
+	t := lgr.out.target.Load().(*logTarget)
+	var b bytes.Buffer
+	switch t.format {
+	case LogFormatJSON:
+		b.WriteString(`{"time":`)
+		writeJSON(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		writeJSON(&b, logLevel2Str[lvl])
+		b.WriteString(`,"class":`)
+		writeJSON(&b, class)
+		b.WriteString(`,"msg":`)
+		writeJSON(&b, msg)
+		for _, f := range lgr.fields {
+			b.WriteByte(',')
+			writeJSON(&b, f.Key)
+			b.WriteByte(':')
+			writeJSON(&b, f.Value)
+		}
+		for _, f := range fields {
+			b.WriteByte(',')
+			writeJSON(&b, f.Key)
+			b.WriteByte(':')
+			writeJSON(&b, f.Value)
+		}
+		b.WriteByte('}')
+	case LogFormatLogfmt:
+		b.WriteString("time=" + now.Format(time.RFC3339Nano))
+		b.WriteString(" level=" + logLevel2Str[lvl])
+		b.WriteString(" class=")
+		writeLogfmt(&b, class)
+		b.WriteString(" msg=")
+		writeLogfmt(&b, msg)
+		writeLogfmtFields(&b, lgr.fields)
+		writeLogfmtFields(&b, fields)
+	default:
+		b.WriteString(now.Format("15:04:05.000000"))
+		b.WriteString(" [" + lgr.Class + logLevel2Str[lvl] + "] ")
+		b.WriteString(msg)
+		writeLogfmtFields(&b, lgr.fields)
+		writeLogfmtFields(&b, fields)
+	}
+	b.WriteByte('\n')
+	t.sink.write(b.Bytes())
+}
+
+//writeJSON writes v as JSON, without escaping HTML characters
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	var buff bytes.Buffer
+	enc := json.NewEncoder(&buff)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		buff.Reset()
+		enc.Encode(fmt.Sprint(v))
+	}
+	b.Write(bytes.TrimSuffix(buff.Bytes(), []byte("\n")))
+}
+
+func writeLogfmtFields(b *bytes.Buffer, fields []Field) {
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		writeLogfmt(b, fmt.Sprint(f.Value))
+	}
+}
+
+//writeLogfmt writes s, quoted if needed
+func writeLogfmt(b *bytes.Buffer, s string) {
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") {
+		b.WriteString(strconv.Quote(s))
+	} else {
+		b.WriteString(s)
+	}
 }
 
 var defLog Logger
 
 func DefLog() *Logger {
-	if defLog.Lgr == nil {
+	if defLog.out == nil {
 		if err := defLog.Init("dflt.", &Config{LogType: "console", LogLevel: "info"}); err != nil {
 			return nil
 		}
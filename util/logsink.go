@@ -0,0 +1,280 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package util
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//LogRotation tells when a log file is rotated: the current file is renamed <file>.<time> and a new one is started
+type LogRotation struct {
+	//rotate once the file would grow beyond MaxSize bytes; 0 disables
+	MaxSize int64
+
+	//rotate once the file has been written for MaxAge; 0 disables
+	MaxAge time.Duration
+
+	//rotated files retained, the oldest are removed; 0 retains all
+	MaxBackups int
+
+	//gzip the rotated files
+	Compress bool
+}
+
+//rotatedSuffix is the layout of the time appended to rotated files: it sorts as the time does
+const rotatedSuffix = "20060102T150405.000000"
+
+//logSink is where the records of one or more loggers go: each record is written with a single call.
+//File sinks are shared by the loggers writing to the same file.
+type logSink struct {
+	mtx    sync.Mutex
+	out    io.Writer
+	path   string
+	l_fd   *os.File
+	size   int64
+	opened time.Time
+	rot    LogRotation
+	refs   int
+}
+
+var consoleSink = &logSink{out: os.Stdout}
+
+var fileSinks = struct {
+	mtx sync.Mutex
+	m   map[string]*logSink
+}{m: make(map[string]*logSink)}
+
+//logFilePath returns the file the loggers of class write to, as an absolute path
+func logFilePath(class string, cfg *Config) (string, error) {
+	path := cfg.LogType
+	if !cfg.LogShared {
+		path = filepath.Join(filepath.Dir(path), class+filepath.Base(path))
+	}
+	return filepath.Abs(path)
+}
+
+//openLogSink returns the sink of the loggers of class
+func openLogSink(class string, cfg *Config) (*logSink, error) {
+	if cfg.LogType == "console" {
+		return consoleSink, nil
+	}
+	path, err := logFilePath(class, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	fileSinks.mtx.Lock()
+	defer fileSinks.mtx.Unlock()
+	if s := fileSinks.m[path]; s != nil {
+		s.refs++
+		return s, nil
+	}
+	s := &logSink{path: path, refs: 1, rot: logRotation(cfg)}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	fileSinks.m[path] = s
+	return s, nil
+}
+
+func logRotation(cfg *Config) LogRotation {
+	return LogRotation{
+		MaxSize:    int64(cfg.LogMaxSize) * 1024 * 1024,
+		MaxAge:     cfg.LogMaxAge,
+		MaxBackups: int(cfg.LogMaxBackups),
+		Compress:   cfg.LogCompress,
+	}
+}
+
+//setRotation changes when the file of the sink is rotated to what cfg tells
+func (s *logSink) setRotation(cfg *Config) {
+	if s.path == "" {
+		return
+	}
+	s.mtx.Lock()
+	s.rot = logRotation(cfg)
+	s.mtx.Unlock()
+}
+
+//release drops a reference to the sink, closing its file with the last one
+func (s *logSink) release() {
+	if s.path == "" {
+		return
+	}
+	fileSinks.mtx.Lock()
+	defer fileSinks.mtx.Unlock()
+	if s.refs--; s.refs > 0 {
+		return
+	}
+	delete(fileSinks.m, s.path)
+	s.mtx.Lock()
+	s.close()
+	s.mtx.Unlock()
+}
+
+//open opens (or creates) the file of the sink, appending to it
+func (s *logSink) open() error {
+	fd, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.l_fd, s.out = fd, fd
+	s.size, s.opened = 0, time.Now()
+	if info, err := fd.Stat(); err == nil {
+		s.size = info.Size()
+	}
+	return nil
+}
+
+func (s *logSink) close() {
+	if s.l_fd != nil {
+		s.l_fd.Close()
+		s.l_fd, s.out = nil, nil
+	}
+}
+
+func (s *logSink) write(record []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.out == nil {
+		//closed
+		return
+	}
+	if s.path != "" && s.due(len(record)) {
+		if err := s.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "rotating %s:%s\n", s.path, err.Error())
+			if s.out == nil {
+				return
+			}
+		}
+	}
+	n, _ := s.out.Write(record)
+	s.size += int64(n)
+}
+
+//due tells whether the file must be rotated before writing n more bytes
+func (s *logSink) due(n int) bool {
+	if s.rot.MaxSize > 0 && s.size > 0 && s.size+int64(n) > s.rot.MaxSize {
+		return true
+	}
+	return s.rot.MaxAge > 0 && time.Since(s.opened) >= s.rot.MaxAge
+}
+
+//rotate renames the current file and starts a new one; compression and cleanup happen in background
+func (s *logSink) rotate() error {
+	s.close()
+	rotated := s.path + "." + time.Now().Format(rotatedSuffix)
+	if err := os.Rename(s.path, rotated); err != nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	go cleanRotated(s.path, rotated, s.rot)
+	return nil
+}
+
+//cleanRotated compresses the file just rotated, if required, and removes the oldest rotated files
+func cleanRotated(path, rotated string, rot LogRotation) {
+	if rot.Compress {
+		if err := gzipFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "compressing %s:%s\n", rotated, err.Error())
+		}
+	}
+	if rot.MaxBackups <= 0 {
+		return
+	}
+	matches, _ := filepath.Glob(path + ".*")
+	//a backup is counted once by its rotation time: a compression in progress leaves both the plain and the .gz file
+	files := make(map[string][]string)
+	var backups []string
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		if _, err := time.Parse(rotatedSuffix, suffix); err == nil {
+			if files[suffix] == nil {
+				backups = append(backups, suffix)
+			}
+			files[suffix] = append(files[suffix], m)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > rot.MaxBackups {
+		for _, f := range files[backups[0]] {
+			os.Remove(f)
+		}
+		backups = backups[1:]
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+//ReopenLogs closes and reopens the log files, e.g. after logrotate moved them away (SIGHUP)
+func ReopenLogs() error {
+	fileSinks.mtx.Lock()
+	defer fileSinks.mtx.Unlock()
+	var first error
+	for _, s := range fileSinks.m {
+		s.mtx.Lock()
+		s.close()
+		if err := s.open(); err != nil && first == nil {
+			first = err
+		}
+		s.mtx.Unlock()
+	}
+	return first
+}
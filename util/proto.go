@@ -21,7 +21,9 @@ CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package util
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"io"
 )
 
 type MsgKey string
@@ -32,26 +34,67 @@ const (
 	MsgKeyPktSrcLstnPort = "_lp" //packet source listening port: the listening port of the source host
 	MsgKeyPktTS          = "_ts" //packet timestamp: the timestamp of the packet
 	MsgKeyPktDataVal     = "_dv" //packet data: the value inside a Data packet (TCP)
+	MsgKeyPktDataOrigin  = "_og" //packet data origin: the identifier of the node that set the value inside a Data packet (TCP)
+	MsgKeyPktTombstone   = "_tb" //packet tombstone: the value inside a Data packet (TCP) has been deleted
+	MsgKeyPktTTL         = "_tl" //packet time to live: the milliseconds the value inside a Data packet (TCP) still has to live
+	MsgKeyPktNodeID      = "_ni" //packet node id: the identifier of the source node of an Alive packet
+	MsgKeyPktDaemon      = "_dn" //packet daemon: the source node of an Alive packet is a daemon
+	MsgKeyPktHistory     = "_hs" //packet history: the values previously held by a node, inside a History packet (TCP)
+	MsgKeyPktMembers     = "_mb" //packet members: the daemon nodes known by a node, inside a Members packet (TCP)
+	MsgKeyReqOp          = "_op" //request operation: the operation a Request packet asks for (TCP)
+	MsgKeyReqCASTS       = "_ct" //request compare-and-set timestamp: the timestamp the node must hold for a set to be accepted
+	MsgKeyRespRetCode    = "_rc" //response return code: the outcome of a request (see RetCode)
+	MsgKeyReqToken       = "_tk" //request token: the bearer token the client (or "pure" setter node) presents, checked against the ACL
+	MsgKeyPktACLVersion  = "_av" //packet ACL version: the version of the ACL held by the source node of an Alive packet
+	MsgKeyPktACLHash     = "_ah" //packet ACL hash: the hash of the ACL held by the source node of an Alive packet
+	MsgKeyPktACL         = "_al" //packet ACL: the ACL held by a node, inside an ACL packet (TCP)
+	MsgKeyReqNonce       = "_nc" //request nonce: the challenge a daemon answering a Request packet proves itself with (see DaemonKey)
+	MsgKeyDaemonProof    = "_dp" //daemon proof: the source node of a packet holds the daemon key (see DaemonKey)
+	MsgKeyReqTime        = "_tm" //request time: the time (nanoseconds since the Unix epoch) a daemon proving itself sent a Request packet
 	MsgKeyInterrupt      = "_ir" //packet interrupt: a key used to generate events inside the application (interrupts generated by selector/peer)
 )
 
 const (
 	MsgPktTypeAlive = "an" //packet type value: Alive Node (UDP multicast)
 	MsgPktTypeData  = "dt" //packet type value: Data (TCP)
+	MsgPktTypeReq   = "rq" //packet type value: Request (TCP)
+	MsgPktTypeResp  = "rs" //packet type value: Response (TCP)
+	MsgPktTypeHist  = "hs" //packet type value: History (TCP)
+	MsgPktTypeMemb  = "mb" //packet type value: Members (TCP)
+	MsgPktTypeACL   = "ac" //packet type value: ACL (TCP)
+)
+
+const (
+	ReqOpGet     = "get"     //request operation value: get the value, answered with a Data packet
+	ReqOpWatch   = "watch"   //request operation value: watch the value, answered with a stream of Data packets
+	ReqOpSet     = "set"     //request operation value: set the value, answered with a Response packet
+	ReqOpHist    = "hist"    //request operation value: get the values previously held, answered with a History packet
+	ReqOpRestore = "restore" //request operation value: set again a value previously held, answered with a Response packet
+	ReqOpDel     = "del"     //request operation value: delete the value, answered with a Response packet
+	ReqOpMembers = "members" //request operation value: get the daemon nodes known by the node, answered with a Members packet
+	ReqOpACL     = "acl"     //request operation value: get the ACL held by the node, answered with an ACL packet
 )
 
 /**
  * Alive message (UDP multicast):
  *
  *      {
+ *       "_dn" : true,
  *       "_lp" : 31582,
+ *       "_ni" : "5f3a09c2",
  *       "_pt" : "an",
  *       "_si" : "172.17.0.2",
  *       "_ts" : 1612981749
  *      }
+ *
+ * A daemon holding an ACL tells its version and hash ("_av", "_ah"): a daemon holding an older one pulls it.
  */
 type AliveMsg struct {
+	Ah string `json:"_ah,omitempty"`
+	Av uint64 `json:"_av,omitempty"`
+	Dn bool   `json:"_dn,omitempty"`
 	Lp uint16 `json:"_lp"`
+	Ni string `json:"_ni,omitempty"`
 	Pt string `json:"_pt"`
 	Si string `json:"_si"`
 	Ts uint64 `json:"_ts"`
@@ -66,16 +109,224 @@ func (msg *AliveMsg) MarshalJSON() ([]byte, error) {
  *
  *     {
  *      "_dv" : "Jerico",
+ *      "_og" : "5f3a09c2",
+ *      "_pt" : "dt",
+ *      "_ts" : 1612981862
+ *     }
+ *
+ * A value set with a time to live carries the milliseconds it still has to live when the packet is sent:
+ * the receiving node counts them down with its own clock, so nodes need not agree on wall clock time.
+ * Once expired, the value is replaced by a tombstone with the same timestamp.
+ *
+ *     {
+ *      "_dv" : "Jerico",
+ *      "_og" : "5f3a09c2",
  *      "_pt" : "dt",
+ *      "_tl" : 29500,
  *      "_ts" : 1612981862
  *     }
+ *
+ * A deleted value travels as a tombstone:
+ *
+ *     {
+ *      "_dv" : "",
+ *      "_og" : "5f3a09c2",
+ *      "_pt" : "dt",
+ *      "_tb" : true,
+ *      "_ts" : 1612981970
+ *     }
+ *
+ * A "pure" setter node sends the bearer token of its user ("_tk"): a daemon pulling the value from it
+ * checks the write against the ACL of the cluster, and discards the value if denied.
+ * A daemon holding the daemon key proves itself ("_dp") when the request carries a challenge ("_nc"):
+ * the value it sends is taken as is, a value sent by any other node is checked against the ACL.
  */
 type DataMsg struct {
+	Dp string `json:"_dp,omitempty"`
 	Dv string `json:"_dv"`
+	Og string `json:"_og,omitempty"`
 	Pt string `json:"_pt"`
+	Tb bool   `json:"_tb,omitempty"`
+	Tk string `json:"_tk,omitempty"`
+	Tl uint64 `json:"_tl,omitempty"`
 	Ts uint64 `json:"_ts"`
 }
 
 func (msg *DataMsg) MarshalJSON() ([]byte, error) {
 	return json.Marshal(*msg)
 }
+
+/**
+ * Request message (TCP), the first packet sent over a point 2 point connection.
+ *
+ * Get: the node answers with a Data message and closes the connection.
+ *
+ *     {
+ *      "_op" : "get",
+ *      "_pt" : "rq"
+ *     }
+ *
+ * Watch: the node keeps the connection open and sends a Data message every time its timestamp advances;
+ * if the node holds a timestamp newer than "_ts" (the last one seen by the watcher), it is sent immediately.
+ *
+ *     {
+ *      "_op" : "watch",
+ *      "_pt" : "rq",
+ *      "_ts" : 1612981749
+ *     }
+ *
+ * History: the node answers with a History message.
+ *
+ * Restore: the node sets again, with a fresh timestamp, the value it held at timestamp "_ts"
+ * (the one with the greatest timestamp not after "_ts") and answers with a Response message.
+ *
+ * Set: the node sets the value with a fresh timestamp and answers with a Response message;
+ * when "_ct" is present, the value is set only if the node is synched at that timestamp;
+ * when "_tl" is present, the value expires after that many milliseconds.
+ *
+ *     {
+ *      "_ct" : 1612981749,
+ *      "_dv" : "Jerico",
+ *      "_op" : "set",
+ *      "_pt" : "rq",
+ *      "_tl" : 30000
+ *     }
+ *
+ * Del: like Set, but the node deletes the value.
+ *
+ * Members: the node answers with a Members message.
+ *
+ * ACL: the node answers with an ACL message.
+ *
+ * A request may carry the bearer token of the client ("_tk"), checked against the ACL of the cluster:
+ * a write (set, del, restore) denied is answered with a Response message carrying RetCode_DENIED, any other request
+ * denied is answered by closing the connection.
+ * A daemon asking for the value or the ACL sends a challenge ("_nc"), so that a daemon answering proves itself
+ * (see DaemonKey); holding the daemon key, it proves itself as well: "_dp" is the proof of the request without "_dp"
+ * for "_nc", "_tm" the time it was sent, and the daemon answering accepts it once only, within the replay window.
+ */
+type ReqMsg struct {
+	Ct *uint64 `json:"_ct,omitempty"`
+	Dp string  `json:"_dp,omitempty"`
+	Dv string  `json:"_dv,omitempty"`
+	Nc string  `json:"_nc,omitempty"`
+	Op string  `json:"_op"`
+	Pt string  `json:"_pt"`
+	Tk string  `json:"_tk,omitempty"`
+	Tl uint64  `json:"_tl,omitempty"`
+	Tm int64   `json:"_tm,omitempty"`
+	Ts uint64  `json:"_ts,omitempty"`
+}
+
+func (msg *ReqMsg) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*msg)
+}
+
+/**
+ * Response message (TCP): the outcome of a request and the timestamp held by the node afterwards.
+ *
+ *     {
+ *      "_pt" : "rs",
+ *      "_rc" : 0,
+ *      "_ts" : 1612981862
+ *     }
+ */
+type RespMsg struct {
+	Pt string  `json:"_pt"`
+	Rc RetCode `json:"_rc"`
+	Ts uint64  `json:"_ts"`
+}
+
+func (msg *RespMsg) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*msg)
+}
+
+/**
+ * History message (TCP): the values previously held by a node, oldest first.
+ *
+ *     {
+ *      "_hs" : [
+ *               {"_dv" : "Jerico", "_og" : "5f3a09c2", "_pt" : "dt", "_ts" : 1612981749},
+ *               {"_dv" : "Jerry", "_og" : "0b77e1d4", "_pt" : "dt", "_ts" : 1612981862}
+ *              ],
+ *      "_pt" : "hs"
+ *     }
+ */
+type HistMsg struct {
+	Hs []DataMsg `json:"_hs"`
+	Pt string    `json:"_pt"`
+}
+
+func (msg *HistMsg) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*msg)
+}
+
+/**
+ * ACL message (TCP): the ACL held by a node (see ACL), null if it holds none.
+ *
+ *     {
+ *      "_al" : {"version" : 3, "default" : "read", "identities" : [...]},
+ *      "_pt" : "ac"
+ *     }
+ *
+ * As for a Data message, a daemon holding the daemon key proves itself ("_dp") when the request carries a challenge.
+ */
+type ACLMsg struct {
+	Al *ACL   `json:"_al"`
+	Dp string `json:"_dp,omitempty"`
+	Pt string `json:"_pt"`
+}
+
+func (msg *ACLMsg) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*msg)
+}
+
+//MaxFrameLen is the upper bound accepted for the payload of a network packet
+const MaxFrameLen = 64 * 1024 * 1024
+
+/**
+ * All network level packets start with 4 bytes (little endian) denoting
+ * the length of the subsequent payload (that is the Json body).
+ */
+func NewFrame(payload []byte) []byte {
+	buff := make([]byte, len(payload)+4)
+	binary.LittleEndian.PutUint32(buff[0:4], uint32(len(payload)))
+	copy(buff[4:], payload)
+	return buff
+}
+
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	plen := binary.LittleEndian.Uint32(hdr[:])
+	if plen > MaxFrameLen {
+		return nil, &NDSError{RetCode_OVRSZ}
+	}
+	payload := make([]byte, plen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+/**
+ * Members message (TCP): the daemon nodes known by a node, itself included, described as their latest alive.
+ *
+ *     {
+ *      "_mb" : [
+ *               {"_dn" : true, "_lp" : 31582, "_ni" : "5f3a09c2", "_pt" : "an", "_si" : "172.17.0.2", "_ts" : 1612981862},
+ *               {"_dn" : true, "_lp" : 31582, "_ni" : "0b77e1d4", "_pt" : "an", "_si" : "172.17.0.3", "_ts" : 1612981862}
+ *              ],
+ *      "_pt" : "mb"
+ *     }
+ */
+type MembersMsg struct {
+	Mb []AliveMsg `json:"_mb"`
+	Pt string     `json:"_pt"`
+}
+
+func (msg *MembersMsg) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*msg)
+}
@@ -0,0 +1,197 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+/**
+ * TLS secures the point 2 point connections of a node with the certificates of its configuration:
+ *  - tls-cert, tls-key: the certificate the node presents, both when accepting and when connecting;
+ *  - tls-ca: the CA of the cluster, the certificates of the nodes connected must chain to it; without it, the system
+ *    roots are used and the certificate must match the host name connected;
+ *  - tls-verify-clients: the node accepts only connections presenting a certificate that chains to the CA (mutual TLS).
+ * A node connected is verified by its certificate alone, not by its host name, when the CA is given: nodes are found
+ * by their address, which is seldom in their certificate.
+ * Without any of them (or with a nil TLS) connections are plain.
+ * The certificates can be replaced while connections are accepted (see Update); a TLS is safe for concurrent use.
+ */
+type TLS struct {
+	mtx           sync.RWMutex
+	cert          *tls.Certificate
+	roots         *x509.CertPool
+	verifyClients bool
+
+	//identify the certificate and the CA without showing them
+	certID, caID string
+}
+
+//LoadTLS reads the certificates of cfg, returning a *ConfigError if they cannot be used
+func LoadTLS(cfg *Config) (*TLS, error) {
+	t := &TLS{verifyClients: cfg.TLSVerifyClients}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, &ConfigError{"tls-cert", "tls-cert and tls-key must be given together"}
+	}
+	if cfg.TLSVerifyClients && cfg.TLSCAFile == "" {
+		return nil, &ConfigError{"tls-verify-clients", "requires tls-ca"}
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, &ConfigError{"tls-cert", err.Error()}
+		}
+		sum := sha256.Sum256(cert.Certificate[0])
+		t.cert, t.certID = &cert, hex.EncodeToString(sum[:8])
+	}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, &ConfigError{"tls-ca", err.Error()}
+		}
+		t.roots = x509.NewCertPool()
+		if !t.roots.AppendCertsFromPEM(pem) {
+			return nil, &ConfigError{"tls-ca", fmt.Sprintf("%s: no PEM certificate", cfg.TLSCAFile)}
+		}
+		sum := sha256.Sum256(pem)
+		t.caID = hex.EncodeToString(sum[:8])
+	}
+	return t, nil
+}
+
+//Enabled tells whether connections are secured
+func (t *TLS) Enabled() bool {
+	if t == nil {
+		return false
+	}
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.cert != nil || t.roots != nil
+}
+
+//Changes returns the settings differing in next; a change turning TLS on or off cannot be applied while running
+func (t *TLS) Changes(next *TLS) []SettingChange {
+	var changes []SettingChange
+	canReload := t.Enabled() == next.Enabled()
+	compare := func(setting string, old, new interface{}) {
+		if o, n := fmt.Sprint(old), fmt.Sprint(new); o != n {
+			changes = append(changes, SettingChange{setting, o, n, canReload})
+		}
+	}
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	compare("tls-cert", t.certID, next.certID)
+	compare("tls-ca", t.caID, next.caID)
+	compare("tls-verify-clients", t.verifyClients, next.verifyClients)
+	return changes
+}
+
+//Update takes the certificates of next: the connections established afterwards use them
+func (t *TLS) Update(next *TLS) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.cert, t.roots, t.verifyClients = next.cert, next.roots, next.verifyClients
+	t.certID, t.caID = next.certID, next.caID
+}
+
+//ServerConfig returns the configuration of the connections accepted, reading the certificates at every handshake
+func (t *TLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mtx.RLock()
+			defer t.mtx.RUnlock()
+			if t.cert == nil {
+				return nil, errors.New("no certificate")
+			}
+			cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*t.cert}}
+			if t.verifyClients {
+				cfg.ClientAuth, cfg.ClientCAs = tls.RequireAndVerifyClientCert, t.roots
+			}
+			return cfg, nil
+		},
+	}
+}
+
+//ClientConfig returns the configuration of the connections to serverName, reading the certificates at every handshake;
+//an empty serverName is filled by tls.Dialer with the host connected.
+func (t *TLS) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		//verified by VerifyConnection, which can leave the host name out
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("tls: no certificate from the node connected")
+			}
+			t.mtx.RLock()
+			opts := x509.VerifyOptions{Roots: t.roots, Intermediates: x509.NewCertPool()}
+			t.mtx.RUnlock()
+			if opts.Roots == nil {
+				if cs.ServerName == "" {
+					return errors.New("tls: no host name to verify the node connected with")
+				}
+				opts.DNSName = cs.ServerName
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			t.mtx.RLock()
+			defer t.mtx.RUnlock()
+			if t.cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return t.cert, nil
+		},
+	}
+}
+
+//Serving tells whether this node has a certificate, that is whether the connections it accepts are secured
+func (t *TLS) Serving() bool {
+	if t == nil {
+		return false
+	}
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.cert != nil
+}
+
+//Listener secures the connections accepted by l, if this node has a certificate
+func (t *TLS) Listener(l net.Listener) net.Listener {
+	if !t.Serving() {
+		return l
+	}
+	return tls.NewListener(l, t.ServerConfig())
+}
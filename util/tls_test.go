@@ -0,0 +1,172 @@
+/* Original Work Copyright (c) 2021 Giuseppe Baccini - giuseppe.baccini@live.com
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of
+this software and associated documentation files (the "Software"), to deal in
+the Software without restriction, including without limitation the rights to
+use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+the Software, and to permit persons to whom the Software is furnished to do so,
+subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//generateTLS generates a CA and a certificate for 127.0.0.1 in a new directory, and loads them
+func generateTLS(t *testing.T, verifyClients bool) (*TLS, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if _, err := GenerateCerts(dir, []string{"127.0.0.1"}, time.Hour); err != nil {
+		t.Fatalf("generating the certificates: %v", err)
+	}
+	tlsConfig, err := LoadTLS(&Config{
+		TLSCertFile:      filepath.Join(dir, "127.0.0.1.pem"),
+		TLSKeyFile:       filepath.Join(dir, "127.0.0.1-key.pem"),
+		TLSCAFile:        filepath.Join(dir, "ca.pem"),
+		TLSVerifyClients: verifyClients,
+	})
+	if err != nil {
+		t.Fatalf("loading the certificates: %v", err)
+	}
+	return tlsConfig, dir
+}
+
+//serveEcho accepts the connections secured by srv, echoing what they send, and returns its address
+func serveEcho(t *testing.T, srv *TLS) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = srv.Listener(l)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+//caPool returns the pool of the CA generated in dir
+func caPool(t *testing.T, dir string) *x509.CertPool {
+	t.Helper()
+	pem, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	return pool
+}
+
+//echo sends a line over a connection to addr secured by cfg, returning the certificate of the node connected
+func echo(addr string, cfg *tls.Config) (*x509.Certificate, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line := []byte("ping\n")
+	if _, err := conn.Write(line); err != nil {
+		return nil, err
+	}
+	//with TLS 1.3 a client certificate refused shows up at the first read
+	got := make([]byte, len(line))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(got, line) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTLSRoundTrip(t *testing.T) {
+	srv, _ := generateTLS(t, false)
+	addr := serveEcho(t, srv)
+
+	if _, err := echo(addr, srv.ClientConfig("")); err != nil {
+		t.Fatalf("echo over TLS: %v", err)
+	}
+	other, _ := generateTLS(t, false)
+	if _, err := echo(addr, other.ClientConfig("")); err == nil {
+		t.Fatal("echo trusting another CA: succeeded, want a verification error")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	srv, dir := generateTLS(t, true)
+	addr := serveEcho(t, srv)
+
+	if _, err := echo(addr, srv.ClientConfig("")); err != nil {
+		t.Fatalf("echo with a certificate of the CA: %v", err)
+	}
+
+	//trusting the CA of the server, with no certificate or with one of another CA
+	if _, err := echo(addr, &tls.Config{RootCAs: caPool(t, dir), ServerName: "127.0.0.1"}); err == nil {
+		t.Fatal("echo without a certificate: succeeded, want it refused")
+	}
+	other, _ := generateTLS(t, false)
+	unsigned := other.ClientConfig("")
+	unsigned.VerifyConnection = nil
+	unsigned.InsecureSkipVerify = false
+	unsigned.RootCAs, unsigned.ServerName = caPool(t, dir), "127.0.0.1"
+	if _, err := echo(addr, unsigned); err == nil {
+		t.Fatal("echo with a certificate of another CA: succeeded, want it refused")
+	}
+}
+
+func TestTLSUpdate(t *testing.T) {
+	srv, dir := generateTLS(t, false)
+	addr := serveEcho(t, srv)
+	if _, err := echo(addr, srv.ClientConfig("")); err != nil {
+		t.Fatalf("echo before the update: %v", err)
+	}
+
+	next, nextDir := generateTLS(t, false)
+	srv.Update(next)
+	cert, err := echo(addr, next.ClientConfig(""))
+	if err != nil {
+		t.Fatalf("echo trusting the new CA: %v", err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: caPool(t, nextDir)}); err != nil {
+		t.Fatalf("certificate presented after the update: %v", err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: caPool(t, dir)}); err == nil {
+		t.Fatal("certificate presented after the update: chains to the former CA")
+	}
+	former, _ := LoadTLS(&Config{TLSCAFile: filepath.Join(dir, "ca.pem")})
+	if _, err := echo(addr, former.ClientConfig("")); err == nil {
+		t.Fatal("echo trusting the former CA after the update: succeeded, want a verification error")
+	}
+}
@@ -22,6 +22,7 @@ package util
 
 import (
 	"fmt"
+	"time"
 )
 
 type RetCode int
@@ -64,6 +65,8 @@ const (
 	RetCode_BADIDX  = 301 /**< bad index */
 	RetCode_BADSTTS = 302 /**< bad status */
 	RetCode_BADCFG  = 303 /**< bad configuration */
+	RetCode_TSMISMT = 304 /**< timestamp mismatch (compare-and-set) */
+	RetCode_DENIED  = 305 /**< permission denied (see ACL) */
 
 	//network specific
 	RetCode_DRPPKT  = 400 /**< packet dropped*/
@@ -81,14 +84,66 @@ func (e *NDSError) Error() string {
 	return fmt.Sprintf("NDSError:%d", e.Code)
 }
 
+//Is makes errors.Is match two NDSError carrying the same code
+func (e *NDSError) Is(target error) bool {
+	t, ok := target.(*NDSError)
+	return ok && t.Code == e.Code
+}
+
+//the multicast group joined when not configured
+const (
+	DefaultMulticastAddress = "232.232.200.82"
+	DefaultMulticastPort    = 8745
+)
+
 type Config struct {
 	StartNode        bool
 	MulticastAddress string
 	MulticastPort    uint
 	ListeningPort    uint
 	Val              string
+	SetVal           bool
+	TTL              time.Duration
 	GetVal           bool
-
-	LogType  string
-	LogLevel string
+	Delete           bool
+	Watch            bool
+	WatchFrom        uint
+	IfTS             uint
+	PrintTS          bool
+	History          bool
+	GetAt            uint
+	Restore          uint
+	Members          bool
+	Status           bool
+	HistorySize      uint
+	NodeID           string
+	TombstoneGrace   time.Duration
+	HTTPAddress      string
+	GRPCAddress      string
+	RESPAddress      string
+	MemcacheAddress  string
+	MDNS             bool
+	DNSAddress       string
+	DNSCluster       string
+	MetricsAddress   string
+	AuthKeyFile      string
+	AuthGrace        time.Duration
+	AuthMaxSkew      time.Duration
+	EncryptMulticast bool
+	ACLFile          string
+	DaemonKeyFile    string
+	Token            string
+	TLSCertFile      string
+	TLSKeyFile       string
+	TLSCAFile        string
+	TLSVerifyClients bool
+
+	LogType       string
+	LogLevel      string
+	LogFormat     string
+	LogShared     bool
+	LogMaxSize    uint
+	LogMaxAge     time.Duration
+	LogMaxBackups uint
+	LogCompress   bool
 }